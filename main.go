@@ -12,11 +12,12 @@ import (
 
 func main() {
 	r := router.NewRouter()
-	headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Origin"})
-	methods := handlers.AllowedMethods([]string{"GET", "POST"})
+	headers := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type", "Authorization", "Origin", "X-Archive-Passphrase", "X-Webhook-Secret"})
+	methods := handlers.AllowedMethods([]string{"GET", "POST", "DELETE"})
 	origins := handlers.AllowedOrigins([]string{"https://accounts.google.com", os.Getenv("FRONTEND_BASE_URL")})
+	exposedHeaders := handlers.ExposedHeaders([]string{"X-Failed-Items", "X-Deduplicated-Bytes", "X-Sync-Mode", "X-Sync-History-Id"})
 	allowCreds := handlers.AllowCredentials()
-	log.Fatal(http.ListenAndServe(GetPort(), handlers.CORS(headers, methods, origins, allowCreds)(r)))
+	log.Fatal(http.ListenAndServe(GetPort(), handlers.CORS(headers, methods, origins, exposedHeaders, allowCreds)(r)))
 }
 
 // GetPort gets the Port from the environment so we can run on Heroku
@@ -0,0 +1,165 @@
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// revocationURL is Google's endpoint revoking a token, see
+// https://developers.google.com/identity/protocols/oauth2/web-server#tokenrevoke
+var revocationURL = "https://oauth2.googleapis.com/revoke"
+
+var revocationClient = &http.Client{Timeout: 10 * time.Second}
+
+// revokeToken revokes token at Google. Revoking a refresh token revokes the
+// whole grant, so every access token issued along with it stops working
+// too. Tokens Google doesn't know, as they have expired or were already
+// revoked, are as good as revoked.
+var revokeToken = func(token string) error {
+	res, err := revocationClient.PostForm(revocationURL, url.Values{"token": {token}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096)) // nolint
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("revocation endpoint responded with %s", res.Status)
+	}
+	return nil
+}
+
+// revokedJWTs are the IDs of the JWTs of users who logged out.
+var revokedJWTs = newDenylist()
+
+// denylist keeps IDs until the JWTs they identify expire, after which
+// DecodeJwtToken refuses them anyway.
+type denylist struct {
+	mu  sync.Mutex
+	ids map[string]time.Time
+	now func() time.Time
+}
+
+func newDenylist() *denylist {
+	return &denylist{ids: make(map[string]time.Time), now: time.Now}
+}
+
+// add denies id until expiresAt.
+func (d *denylist) add(id string, expiresAt time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	for i, exp := range d.ids {
+		if !now.Before(exp) {
+			delete(d.ids, i)
+		}
+	}
+	d.ids[id] = expiresAt
+}
+
+func (d *denylist) contains(id string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exp, ok := d.ids[id]
+	return ok && d.now().Before(exp)
+}
+
+// keptGrant is the response of a logout that kept the Google grant, as
+// schedules of the user still run with it.
+type keptGrant struct {
+	GrantRevoked bool   `json:"grantRevoked"`
+	Schedules    int    `json:"schedules,omitempty"`
+	Message      string `json:"message"`
+}
+
+// Logout ends the session of the user who sent the JWT bearer token: their
+// Google tokens are forgotten and the JWT is refused until it expires. The
+// tokens are revoked too, unless schedules the user created run with the
+// same grant: the response then says so, and the grant stays until the
+// schedules are deleted and the user logs out again, or they revoke it at
+// Google.
+func (oauth *Oauth) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, err := DecodeJwtToken(bearerToken(r))
+	if err != nil {
+		errorResponse(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var schedules int
+	token, err := Tokens.Get(claims.RandomID)
+	if err == nil {
+		// The session is kept when the schedules can't be counted, so the
+		// user can try again.
+		if schedules, err = oauth.schedulesOf(claims.RandomID); err != nil {
+			log.Printf("unable to count the schedules of the user: %v", err)
+			errorResponse(w, http.StatusBadGateway, "Unable to check the schedules, please try again")
+			return
+		}
+	}
+	switch {
+	case schedules != 0:
+		// Revoking the grant would stop the schedules.
+	case err == nil:
+		revoke := token.RefreshToken
+		if len(revoke) == 0 {
+			revoke = token.AccessToken
+		}
+		// The session is kept when the token can't be revoked, so the user
+		// can try again.
+		if err := revokeToken(revoke); err != nil {
+			log.Printf("unable to revoke the google token: %v", err)
+			errorResponse(w, http.StatusBadGateway, "Unable to revoke the Google token, please try again")
+			return
+		}
+	case err != ErrTokenNotFound:
+		log.Printf("unable to read the tokens: %v", err)
+	}
+
+	if err := Tokens.Delete(claims.RandomID); err != nil {
+		errorResponse(w, http.StatusInternalServerError, "Unable to delete the tokens "+err.Error())
+		return
+	}
+	if len(claims.Id) != 0 {
+		revokedJWTs.add(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	}
+	if schedules != 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(keptGrant{ // nolint
+			Schedules: schedules,
+			Message:   "Your schedules still have access to your mailbox, delete them before logging out to revoke it",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// schedulesOf counts the schedules running with the grant of userID.
+func (oauth *Oauth) schedulesOf(userID string) (int, error) {
+	if oauth.SchedulesOf == nil {
+		return 0, nil
+	}
+	return oauth.SchedulesOf(userID)
+}
+
+// bearerToken reads the bearer token from the Authorization header of r.
+func bearerToken(r *http.Request) string {
+	splitToken := strings.Split(r.Header.Get("Authorization"), "Bearer")
+	if len(splitToken) != 2 {
+		return ""
+	}
+	return strings.TrimSpace(splitToken[1])
+}
+
+func errorResponse(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message}) // nolint
+}
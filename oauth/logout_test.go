@@ -0,0 +1,212 @@
+package oauth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func Test_denylist_contains(t *testing.T) {
+	now := time.Now()
+	d := newDenylist()
+	d.now = func() time.Time { return now }
+	d.add("expiring", now.Add(time.Minute))
+	d.add("valid", now.Add(time.Hour))
+	now = now.Add(2 * time.Minute)
+
+	tests := []struct {
+		id   string
+		want bool
+	}{
+		{id: "valid", want: true},
+		{id: "expiring", want: false},
+		{id: "unknown", want: false},
+	}
+	for _, tt := range tests {
+		if got := d.contains(tt.id); got != tt.want {
+			t.Errorf("contains(%v) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+
+	d.add("other", now.Add(time.Hour))
+	if _, ok := d.ids["expiring"]; ok {
+		t.Errorf("add() kept the expired IDs")
+	}
+}
+
+// newTestRevocationEndpoint serves the revocation endpoint, responding with
+// status and recording the tokens it revokes.
+func newTestRevocationEndpoint(status int) (*httptest.Server, *[]string) {
+	var revoked []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		revoked = append(revoked, r.FormValue("token"))
+		w.WriteHeader(status)
+	}))
+	return server, &revoked
+}
+
+// loginForTest stores token for a new user and returns their RandomID and
+// JWT.
+func loginForTest(t *testing.T, o *Oauth, token *oauth2.Token) (string, string) {
+	randomID := o.generateRandomString()
+	if err := Tokens.Put(randomID, token, time.Now().Add(jwtLifetime)); err != nil {
+		t.Fatalf("Put() unexpected error: %v", err)
+	}
+	jwtToken, err := o.generateJwtToken(randomID)
+	if err != nil {
+		t.Fatalf("generateJwtToken() unexpected error: %v", err)
+	}
+	return randomID, jwtToken
+}
+
+func logout(o *Oauth, jwtToken string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/auth/logout", nil)
+	r.Header.Set("Authorization", "Bearer "+jwtToken)
+	w := httptest.NewRecorder()
+	o.Logout(w, r)
+	return w
+}
+
+func Test_Logout_shouldEndTheSession(t *testing.T) {
+	server, revoked := newTestRevocationEndpoint(http.StatusOK)
+	defer server.Close()
+	defer func(u string) { revocationURL = u }(revocationURL)
+	revocationURL = server.URL
+	o := &Oauth{}
+
+	randomID, jwtToken := loginForTest(t, o, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+	_, otherJwtToken := loginForTest(t, o, &oauth2.Token{AccessToken: "other-access", RefreshToken: "other-refresh"})
+
+	if w := logout(o, jwtToken); w.Code != http.StatusNoContent {
+		t.Fatalf("Logout() = %v, want %v (%v)", w.Code, http.StatusNoContent, w.Body)
+	}
+	if len(*revoked) != 1 || (*revoked)[0] != "refresh" {
+		t.Errorf("Logout() revoked %v, want the refresh token", *revoked)
+	}
+	if _, err := Tokens.Get(randomID); err != ErrTokenNotFound {
+		t.Errorf("Logout() kept the tokens: %v", err)
+	}
+	if _, err := DecodeJwtToken(jwtToken); err == nil {
+		t.Errorf("DecodeJwtToken() accepted the JWT of a user who logged out")
+	}
+	if _, err := DecodeJwtToken(otherJwtToken); err != nil {
+		t.Errorf("DecodeJwtToken() refused the JWT of another user: %v", err)
+	}
+	if w := logout(o, jwtToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("Logout() again = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_Logout_shouldHandleTheRevocationResponse(t *testing.T) {
+	defer func(u string) { revocationURL = u }(revocationURL)
+	o := &Oauth{}
+
+	tests := []struct {
+		name         string
+		status       int
+		want         int
+		wantLoggedIn bool
+	}{
+		{name: "revoked", status: http.StatusOK, want: http.StatusNoContent},
+		{name: "already invalid token", status: http.StatusBadRequest, want: http.StatusNoContent},
+		{name: "unavailable", status: http.StatusServiceUnavailable, want: http.StatusBadGateway, wantLoggedIn: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, _ := newTestRevocationEndpoint(tt.status)
+			defer server.Close()
+			revocationURL = server.URL
+
+			randomID, jwtToken := loginForTest(t, o, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+			if w := logout(o, jwtToken); w.Code != tt.want {
+				t.Errorf("Logout() = %v, want %v", w.Code, tt.want)
+			}
+			_, err := Tokens.Get(randomID)
+			_, jwtErr := DecodeJwtToken(jwtToken)
+			if loggedIn := err == nil && jwtErr == nil; loggedIn != tt.wantLoggedIn {
+				t.Errorf("Logout() left the user logged in = %v, want %v (%v, %v)", loggedIn, tt.wantLoggedIn, err, jwtErr)
+			}
+		})
+	}
+}
+
+func Test_Logout_shouldRejectInvalidTokens(t *testing.T) {
+	defer func(f func(string) error) { revokeToken = f }(revokeToken)
+	revokeToken = func(string) error {
+		t.Errorf("Logout() revoked a token without a valid JWT")
+		return nil
+	}
+	o := &Oauth{}
+
+	if w := logout(o, "invalidJwtToken"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Logout() = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
+
+func Test_Logout_shouldKeepTheGrantOfSchedules(t *testing.T) {
+	defer func(u string) { revocationURL = u }(revocationURL)
+
+	tests := []struct {
+		name        string
+		schedulesOf func(string) (int, error)
+		want        int
+		wantRevoked bool
+		wantKept    keptGrant
+	}{
+		{
+			name:        "no schedules",
+			schedulesOf: func(string) (int, error) { return 0, nil },
+			want:        http.StatusNoContent,
+			wantRevoked: true,
+		},
+		{
+			name:        "schedules",
+			schedulesOf: func(string) (int, error) { return 2, nil },
+			want:        http.StatusOK,
+			wantKept:    keptGrant{Schedules: 2},
+		},
+		{
+			name:        "schedules unknown",
+			schedulesOf: func(string) (int, error) { return 0, errors.New("schedules unavailable") },
+			want:        http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, revoked := newTestRevocationEndpoint(http.StatusOK)
+			defer server.Close()
+			revocationURL = server.URL
+			o := &Oauth{SchedulesOf: tt.schedulesOf}
+
+			randomID, jwtToken := loginForTest(t, o, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"})
+			w := logout(o, jwtToken)
+			if w.Code != tt.want {
+				t.Fatalf("Logout() = %v, want %v (%v)", w.Code, tt.want, w.Body)
+			}
+			if gotRevoked := len(*revoked) != 0; gotRevoked != tt.wantRevoked {
+				t.Errorf("Logout() revoked the grant = %v, want %v", gotRevoked, tt.wantRevoked)
+			}
+			if w.Code == http.StatusOK {
+				var got keptGrant
+				if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+					t.Fatalf("Logout() unexpected body: %v", err)
+				}
+				if got.GrantRevoked || got.Schedules != tt.wantKept.Schedules || len(got.Message) == 0 {
+					t.Errorf("Logout() = %+v, want the grant kept for %v schedules", got, tt.wantKept.Schedules)
+				}
+			}
+			// The session only ends once the schedules were counted.
+			_, err := Tokens.Get(randomID)
+			_, jwtErr := DecodeJwtToken(jwtToken)
+			wantLoggedIn := w.Code == http.StatusBadGateway
+			if loggedIn := err == nil && jwtErr == nil; loggedIn != wantLoggedIn {
+				t.Errorf("Logout() left the user logged in = %v, want %v (%v, %v)", loggedIn, wantLoggedIn, err, jwtErr)
+			}
+		})
+	}
+}
@@ -2,9 +2,7 @@ package oauth
 
 import (
 	"context"
-	"encoding/gob"
 	"errors"
-	"fmt"
 	"log"
 	"net/http"
 	"os"
@@ -12,7 +10,6 @@ import (
 
 	"github.com/dchest/uniuri"
 	"github.com/dgrijalva/jwt-go"
-	"github.com/gorilla/sessions"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"google.golang.org/api/gmail/v1"
@@ -23,7 +20,6 @@ var (
 	googleOauthConfig *oauth2.Config
 )
 var jwtKey = []byte(os.Getenv("JWT_SECRET_KEY"))
-var store = sessions.NewCookieStore([]byte(os.Getenv("SESSION_KEY")))
 
 func init() {
 	googleOauthConfig = &oauth2.Config{
@@ -33,20 +29,39 @@ func init() {
 		Scopes:       []string{gmail.GmailReadonlyScope},
 		Endpoint:     google.Endpoint,
 	}
+}
 
-	gob.Register(&time.Time{})
+// Error codes sent to the frontend as the error parameter of
+// FRONTEND_REDIRECT_URL when a login fails.
+const (
+	// errorInvalidState means the login wasn't started by this browser,
+	// was already completed or has expired.
+	errorInvalidState = "invalid_state"
+	// errorAccessDenied means the user didn't grant access to their
+	// mailbox.
+	errorAccessDenied = "access_denied"
+	// errorExchangeFailed means Google refused to exchange the code for
+	// tokens, as it is invalid or was already used.
+	errorExchangeFailed = "exchange_failed"
+	// errorServer means the login failed on our side.
+	errorServer = "server_error"
+	// errorTemporarilyUnavailable means too many logins are in progress,
+	// the user may try again later.
+	errorTemporarilyUnavailable = "temporarily_unavailable"
+)
 
-	store.Options = &sessions.Options{
-		Path:     "/",
-		MaxAge:   600, // 10 minutes
-		HttpOnly: true,
-		Secure: true,
-		SameSite: http.SameSiteNoneMode,
-	}
+// redirectWithError sends the user back to the frontend with the code of
+// the error their login failed with.
+func redirectWithError(w http.ResponseWriter, r *http.Request, code string) {
+	http.Redirect(w, r, os.Getenv("FRONTEND_REDIRECT_URL")+"?error="+code, http.StatusTemporaryRedirect)
 }
 
+// Oauth handles logins with Google. The state of each login in progress is
+// kept apart, so it is safe to share between concurrent logins.
 type Oauth struct {
-	stateString string
+	// SchedulesOf counts the schedules created by the user logged in as
+	// userID, which run with the same grant as their login. It may be nil.
+	SchedulesOf func(userID string) (int, error)
 }
 
 func (oauth *Oauth) generateRandomString() string {
@@ -56,52 +71,87 @@ func (oauth *Oauth) generateRandomString() string {
 
 func (oauth *Oauth) GoogleLogin(w http.ResponseWriter, r *http.Request) {
 	oauthStateString := oauth.generateRandomString()
-	oauth.stateString = oauthStateString
-	url := googleOauthConfig.AuthCodeURL(oauthStateString, oauth2.AccessTypeOffline)
+	verifier, err := newCodeVerifier()
+	if err != nil {
+		log.Println("unable to generate a PKCE code verifier:", err)
+		redirectWithError(w, r, errorServer)
+		return
+	}
+	if !logins.add(oauthStateString, verifier) {
+		log.Println("too many logins in progress")
+		redirectWithError(w, r, errorTemporarilyUnavailable)
+		return
+	}
+	setStateCookie(w, oauthStateString, loginTTL)
+	url := googleOauthConfig.AuthCodeURL(
+		oauthStateString,
+		oauth2.AccessTypeOffline,
+		oauth2.SetAuthURLParam("code_challenge", codeChallenge(verifier)),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	)
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
 func (oauth *Oauth) GoogleCallback(w http.ResponseWriter, r *http.Request) {
-	if r.FormValue("state") != oauth.stateString {
+	state := r.FormValue("state")
+	// The state must be the one of a login started by this browser, and
+	// can only be used once.
+	cookie, err := r.Cookie(stateCookieName)
+	setStateCookie(w, "", -1)
+	var l *login
+	if err == nil && cookie.Value == state {
+		l = logins.consume(state)
+	}
+	if l == nil {
 		log.Println("invalid oauth google state")
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		redirectWithError(w, r, errorInvalidState)
+		return
+	}
+	if len(r.FormValue("error")) != 0 {
+		log.Println("google login failed:", r.FormValue("error"))
+		redirectWithError(w, r, errorAccessDenied)
 		return
 	}
 
 	code := r.FormValue("code")
-	oauth2Token := getToken(code)
-	err := oauth.saveoauthTokensInSession(w, r, oauth2Token)
+	oauth2Token, err := getToken(code, l.verifier)
 	if err != nil {
-		http.Redirect(w, r, "/", http.StatusInternalServerError)
+		log.Printf("unable to exchange the code: %v", err)
+		redirectWithError(w, r, errorExchangeFailed)
+		return
+	}
+	randomID := oauth.generateRandomString()
+	// The tokens are only usable along with the JWT, so they go together.
+	if err := Tokens.Put(randomID, oauth2Token, time.Now().Add(jwtLifetime)); err != nil {
+		log.Printf("unable to store the tokens: %v", err)
+		redirectWithError(w, r, errorServer)
 		return
 	}
 
-	jwtToken, _ := oauth.generateJwtToken()
+	jwtToken, err := oauth.generateJwtToken(randomID)
+	if err != nil {
+		log.Printf("unable to sign the JWT: %v", err)
+		redirectWithError(w, r, errorServer)
+		return
+	}
 
 	http.Redirect(w, r, os.Getenv("FRONTEND_REDIRECT_URL")+"?access_token="+jwtToken, http.StatusFound)
 }
 
-var getToken = func(code string) *oauth2.Token {
-	token, err := googleOauthConfig.Exchange(context.TODO(), code)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token: %v", err)
-	}
-	return token
+var getToken = func(code, verifier string) (*oauth2.Token, error) {
+	return googleOauthConfig.Exchange(
+		context.TODO(), code, oauth2.SetAuthURLParam("code_verifier", verifier))
 }
 
-// GetGmailService will return a gmail service.
-func GetGmailService(token, refreshToken string, expiry time.Time) *gmail.Service {
-	ctx := context.Background()
-	oauth2Token := &oauth2.Token{
-		AccessToken:  token,
-		RefreshToken: refreshToken,
-		Expiry:       expiry,
-	}
-	service, err := gmail.NewService(ctx, option.WithTokenSource(googleOauthConfig.TokenSource(ctx, oauth2Token)))
+// GetGmailService will return a gmail service authorized with the tokens
+// stored for userID. Tokens refreshed along the way are stored back.
+func GetGmailService(userID string) (*gmail.Service, error) {
+	token, err := Tokens.Get(userID)
 	if err != nil {
-		log.Fatalf("Unable to retrieve Gmail client: %v", err)
+		return nil, err
 	}
-	return service
+	src := newPersistingTokenSource(userID, Tokens, token)
+	return gmail.NewService(context.Background(), option.WithTokenSource(src))
 }
 
 // Claims struct to be encoded to a JWT.
@@ -110,11 +160,16 @@ type Claims struct {
 	jwt.StandardClaims
 }
 
-func (oauth *Oauth) generateJwtToken() (string, error) {
-	expirationTime := time.Now().Add(6 * time.Hour)
+// jwtLifetime is how long a JWT, and the tokens stored along with it, last.
+const jwtLifetime = 6 * time.Hour
+
+func (oauth *Oauth) generateJwtToken(randomID string) (string, error) {
+	expirationTime := time.Now().Add(jwtLifetime)
 	claims := &Claims{
-		RandomID: oauth.stateString,
+		RandomID: randomID,
 		StandardClaims: jwt.StandardClaims{
+			// The ID lets Logout revoke this token.
+			Id: oauth.generateRandomString(),
 			// In JWT, the expiry time is expressed as unix milliseconds
 			ExpiresAt: expirationTime.Unix(),
 		},
@@ -141,88 +196,9 @@ func DecodeJwtToken(tokenString string) (*Claims, error) {
 	if !tkn.Valid {
 		return nil, errors.New(err.Error())
 	}
-
-	return claims, nil
-}
-
-func (oauth *Oauth) saveoauthTokensInSession(
-	w http.ResponseWriter,
-	r *http.Request,
-	oauth2Token *oauth2.Token,
-) error {
-
-	sessionTkn, err := store.Get(r, "oauth-tkn-session")
-	if err != nil {
-		fmt.Println("Error creating oauth-tkn-session: ", err.Error())
-		return err
-	}
-	sessionRtkn, err := store.Get(r, "session-rtkn-session")
-	if err != nil {
-		fmt.Println("Error creating session-rtkn-session: ", err.Error())
-		return err
-	}
-	sessionExp, err := store.Get(r, "expiry-session")
-	if err != nil {
-		fmt.Println("Error creating expiry-session: ", err.Error())
-		return err
-	}
-
-	sessionTkn.Values[oauth.stateString+"AccessToken"] = oauth2Token.AccessToken
-	sessionRtkn.Values[oauth.stateString+"RefreshToken"] = oauth2Token.RefreshToken
-	sessionExp.Values[oauth.stateString+"Expiry"] = oauth2Token.Expiry
-
-	err = sessionTkn.Save(r, w)
-	if err != nil {
-		fmt.Println("Error saving session-tkn-session: ", err.Error())
-		return err
-	}
-
-	err = sessionRtkn.Save(r, w)
-	if err != nil {
-		fmt.Println("Error saving session-rtkn-session: ", err.Error())
-		return err
-	}
-	err = sessionExp.Save(r, w)
-	if err != nil {
-		fmt.Println("Error saving expiry-session: ", err.Error())
-		return err
+	if revokedJWTs.contains(claims.Id) {
+		return nil, errors.New("token has been revoked, please log in again")
 	}
 
-	return nil
-}
-
-// RetrieveTokensFromSession returns a token stored in the session
-func RetrieveTokensFromSession(
-	r *http.Request,
-	randomID string,
-) (string, string, time.Time, error) {
-	sessionTkn, err := store.Get(r, "oauth-tkn-session")
-	if err != nil {
-		return "", "", time.Now(), err
-	}
-	sessionRtkn, err := store.Get(r, "session-rtkn-session")
-	if err != nil {
-		return "", "", time.Now(), err
-	}
-	sessionExp, err := store.Get(r, "expiry-session")
-	if err != nil {
-		return "", "", time.Now(), err
-	}
-
-	tkn, ok := sessionTkn.Values[randomID+"AccessToken"].(string)
-	if !ok {
-		return "", "", time.Now(), errors.New("received unexpected type of token")
-	}
-
-	rtkn, ok := sessionRtkn.Values[randomID+"RefreshToken"].(string)
-	if !ok {
-		return "", "", time.Now(), errors.New("received unexpected type of refresh token")
-	}
-
-	expiry, ok := sessionExp.Values[randomID+"Expiry"].(*time.Time)
-	if !ok {
-		return "", "", time.Now(), errors.New("received unexpected type of token expiry time")
-	}
-
-	return tkn, rtkn, *expiry, nil
+	return claims, nil
 }
@@ -3,6 +3,7 @@ package oauth
 import (
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -47,16 +48,16 @@ func Test_GoogleCallback_shouldRedirectOnWrongState(t *testing.T) {
 func Test_GoogleCallback_shouldRedirect(t *testing.T) {
 
 	r := httptest.NewRequest(http.MethodGet, "/auth/google/callback?state=pseudo-random&code=somecodehere", nil)
+	r.AddCookie(&http.Cookie{Name: stateCookieName, Value: "pseudo-random"})
 	w := httptest.NewRecorder()
 
 	expectedStatusCode := 302
 
-	o := &Oauth{
-		stateString: "pseudo-random",
-	}
+	o := &Oauth{}
+	logins.add("pseudo-random", "verifier")
 
-	getToken = func(code string) *oauth2.Token {
-		return &oauth2.Token{}
+	getToken = func(code, verifier string) (*oauth2.Token, error) {
+		return &oauth2.Token{}, nil
 	}
 
 	o.GoogleCallback(w, r)
@@ -68,20 +69,87 @@ func Test_GoogleCallback_shouldRedirect(t *testing.T) {
 	}
 }
 
+func Test_GoogleCallback_shouldRedirectWithAnErrorCode(t *testing.T) {
+	g := newFakeGoogle()
+	defer g.Close()
+	defer func(e oauth2.Endpoint) { googleOauthConfig.Endpoint = e }(googleOauthConfig.Endpoint)
+	googleOauthConfig.Endpoint = g.endpoint()
+	defer func(f func(string, string) (*oauth2.Token, error)) { getToken = f }(getToken)
+	getToken = exchangeToken
+	o := &Oauth{}
+	// authorize consents to the login with state in place of GoogleLogin's
+	// redirect.
+	authorize := func(state string) string {
+		return g.authorize(t, "/auth?"+url.Values{
+			"state":                 {state},
+			"code_challenge":        {codeChallenge(logins.logins[state].verifier)},
+			"code_challenge_method": {"S256"},
+		}.Encode())
+	}
+
+	// A code only works for the login it was issued for.
+	otherState, _ := startLogin(t, o)
+	otherCode := authorize(otherState)
+
+	tests := []struct {
+		name   string
+		query  url.Values
+		cookie *http.Cookie
+		want   string
+	}{
+		{name: "wrong state", query: url.Values{"state": {"wrong"}, "code": {"code"}}, want: errorInvalidState},
+		{name: "denied access", query: url.Values{"error": {"access_denied"}}, want: errorAccessDenied},
+		{name: "bad code", query: url.Values{"code": {"bad"}}, want: errorExchangeFailed},
+		{name: "code of another login", query: url.Values{"code": {otherCode}}, want: errorExchangeFailed},
+		{name: "no code", query: url.Values{}, want: errorExchangeFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, cookie := startLogin(t, o)
+			if len(tt.query.Get("state")) == 0 {
+				tt.query.Set("state", state)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/auth/google/callback?"+tt.query.Encode(), nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			o.GoogleCallback(w, r)
+
+			location, _ := url.Parse(w.Header().Get("Location"))
+			if w.Code != http.StatusTemporaryRedirect || location.Query().Get("error") != tt.want {
+				t.Errorf("GoogleCallback() = %v %v, want %v with error %v", w.Code, location, http.StatusTemporaryRedirect, tt.want)
+			}
+		})
+	}
+
+	// Logins still complete after the failed ones.
+	state, cookie := startLogin(t, o)
+	if w := callback(o, state, authorize(state), cookie); w.Code != http.StatusFound {
+		t.Errorf("GoogleCallback() after failed logins = %v, want %v", w.Code, http.StatusFound)
+	}
+}
+
 func Test_GetGmailService(t *testing.T) {
 	expectedBasePathValue := "https://www.googleapis.com/gmail/v1/users/"
-	actualValue := GetGmailService("oauthToken", "refreshToken", time.Now())
+	Tokens.Put("pseudo-random", &oauth2.Token{AccessToken: "oauthToken", RefreshToken: "refreshToken", Expiry: time.Now()}, time.Time{}) // nolint
+	actualValue, err := GetGmailService("pseudo-random")
+	if err != nil {
+		t.Fatalf("GetGmailService() unexpected error: %v", err)
+	}
 	if actualValue.BasePath != expectedBasePathValue {
 		t.Errorf("GetGmailService() = %v, want %v", actualValue, expectedBasePathValue)
 	}
 }
 
-func Test_generateJwtToken_shouldReturnToken(t *testing.T) {
-	o := &Oauth{
-		stateString: "pseudo-random",
+func Test_GetGmailService_shouldReturnAnErrorWithoutTokens(t *testing.T) {
+	if _, err := GetGmailService("unknown"); err != ErrTokenNotFound {
+		t.Errorf("GetGmailService() error = %v, want %v", err, ErrTokenNotFound)
 	}
+}
+
+func Test_generateJwtToken_shouldReturnToken(t *testing.T) {
+	o := &Oauth{}
 
-	jwtToken, _ := o.generateJwtToken()
+	jwtToken, _ := o.generateJwtToken("pseudo-random")
 
 	if len(strings.Split(jwtToken, ".")) != 3 {
 		t.Errorf("generateJwtToken() expected some value but got an empty string")
@@ -89,16 +157,14 @@ func Test_generateJwtToken_shouldReturnToken(t *testing.T) {
 }
 
 func Test_DecodeJwtToken_shouldReturnAClaim(t *testing.T) {
-	o := &Oauth{
-		stateString: "pseudo-random",
-	}
+	o := &Oauth{}
 
-	jwtToken, _ := o.generateJwtToken()
+	jwtToken, _ := o.generateJwtToken("pseudo-random")
 
 	claim, _ := DecodeJwtToken(jwtToken)
 
-	if claim.RandomID != o.stateString {
-		t.Errorf("DecodeJwtToken() = %v, want %v", claim.RandomID, o.stateString)
+	if claim.RandomID != "pseudo-random" {
+		t.Errorf("DecodeJwtToken() = %v, want %v", claim.RandomID, "pseudo-random")
 	}
 }
 
@@ -109,3 +175,19 @@ func Test_DecodeJwtToken_shouldReturnAnError(t *testing.T) {
 		t.Errorf("DecodeJwtToken() expected an error but it wasn't returned")
 	}
 }
+
+func Test_GoogleLogin_shouldRefuseLoginsBeyondTheBound(t *testing.T) {
+	defer func(s *loginStore) { logins = s }(logins)
+	logins = newLoginStore(loginTTL, 0)
+
+	w := httptest.NewRecorder()
+	(&Oauth{}).GoogleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/google/login", nil))
+
+	location, _ := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusTemporaryRedirect || location.Query().Get("error") != errorTemporarilyUnavailable {
+		t.Errorf("GoogleLogin() = %v %v, want %v with error %v", w.Code, location, http.StatusTemporaryRedirect, errorTemporarilyUnavailable)
+	}
+	if len(w.Header().Get("Set-Cookie")) != 0 {
+		t.Errorf("GoogleLogin() set a state cookie for a refused login")
+	}
+}
@@ -0,0 +1,134 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// loginTTL is how long a user has to complete a login with Google.
+const loginTTL = 10 * time.Minute
+
+// maxPendingLogins bounds the logins in progress, which anyone can start.
+const maxPendingLogins = 10000
+
+// loginSweepInterval is how often the expired logins are forgotten.
+const loginSweepInterval = time.Minute
+
+// stateCookieName is the cookie binding a login to the browser that
+// started it.
+const stateCookieName = "oauth-state"
+
+// logins are the logins in progress.
+var logins = newLoginStore(loginTTL, maxPendingLogins)
+
+func init() {
+	go logins.sweepEvery(loginSweepInterval)
+}
+
+// login is a login in progress, between GoogleLogin and GoogleCallback.
+type login struct {
+	// verifier is the PKCE code verifier the code of the login is
+	// exchanged with.
+	verifier  string
+	expiresAt time.Time
+}
+
+// loginStore keeps the state of every login in progress until it is used
+// or expires, so that each state is only accepted once. It holds at most max
+// logins.
+type loginStore struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	logins map[string]*login
+	now    func() time.Time
+}
+
+func newLoginStore(ttl time.Duration, max int) *loginStore {
+	return &loginStore{ttl: ttl, max: max, logins: make(map[string]*login), now: time.Now}
+}
+
+// add starts a login with state and a PKCE code verifier. It returns false
+// when too many logins are in progress already.
+func (s *loginStore) add(state, verifier string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.logins) >= s.max {
+		return false
+	}
+	s.logins[state] = &login{verifier: verifier, expiresAt: s.now().Add(s.ttl)}
+	return true
+}
+
+// sweep forgets the expired logins.
+func (s *loginStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for st, l := range s.logins {
+		if !now.Before(l.expiresAt) {
+			delete(s.logins, st)
+		}
+	}
+}
+
+func (s *loginStore) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.sweep()
+	}
+}
+
+// consume ends the login with state and returns it, or nil if it wasn't in
+// progress or has expired.
+func (s *loginStore) consume(state string) *login {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.logins[state]
+	if !ok {
+		return nil
+	}
+	delete(s.logins, state)
+	if !s.now().Before(l.expiresAt) {
+		return nil
+	}
+	return l
+}
+
+// newCodeVerifier returns a random PKCE code verifier, see
+// https://tools.ietf.org/html/rfc7636#section-4.1
+func newCodeVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// codeChallenge returns the S256 code challenge of verifier.
+func codeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// setStateCookie binds the login with state to the browser for maxAge, or
+// removes the binding when maxAge is negative. The cookie is Lax so that it
+// is sent along when Google redirects the user back.
+func setStateCookie(w http.ResponseWriter, state string, maxAge time.Duration) {
+	cookie := &http.Cookie{
+		Name:     stateCookieName,
+		Value:    state,
+		Path:     "/auth/google",
+		MaxAge:   int(maxAge / time.Second),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge < 0 {
+		cookie.MaxAge = -1
+	}
+	http.SetCookie(w, cookie)
+}
@@ -0,0 +1,348 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func Test_loginStore_consume(t *testing.T) {
+	now := time.Now()
+	s := newLoginStore(time.Minute, 10)
+	s.now = func() time.Time { return now }
+	s.add("used", "v1")
+	s.add("expired", "v2")
+	s.consume("used")
+	now = now.Add(30 * time.Second)
+	s.add("later", "v3")
+	now = now.Add(45 * time.Second)
+
+	tests := []struct {
+		state        string
+		wantVerifier string
+	}{
+		{state: "unknown"},
+		{state: "used"},
+		{state: "expired"},
+		{state: "later", wantVerifier: "v3"},
+		{state: "later"},
+	}
+	for _, tt := range tests {
+		got := s.consume(tt.state)
+		if (got != nil) != (len(tt.wantVerifier) != 0) || (got != nil && got.verifier != tt.wantVerifier) {
+			t.Errorf("consume(%v) = %+v, want verifier %q", tt.state, got, tt.wantVerifier)
+		}
+	}
+}
+
+func Test_loginStore_sweep_shouldForgetExpiredLogins(t *testing.T) {
+	now := time.Now()
+	s := newLoginStore(time.Minute, 10)
+	s.now = func() time.Time { return now }
+	s.add("first", "v1")
+	now = now.Add(2 * time.Minute)
+	s.add("second", "v2")
+	s.sweep()
+
+	if len(s.logins) != 1 {
+		t.Errorf("sweep() kept %v logins, want %v", len(s.logins), 1)
+	}
+}
+
+func Test_loginStore_add_shouldBoundTheLoginsInProgress(t *testing.T) {
+	now := time.Now()
+	s := newLoginStore(time.Minute, 2)
+	s.now = func() time.Time { return now }
+
+	tests := []struct {
+		state string
+		want  bool
+	}{
+		{state: "first", want: true},
+		{state: "second", want: true},
+		{state: "third", want: false},
+	}
+	for _, tt := range tests {
+		if got := s.add(tt.state, "verifier"); got != tt.want {
+			t.Errorf("add(%v) = %v, want %v", tt.state, got, tt.want)
+		}
+	}
+
+	// Logins free their place once used or swept.
+	s.consume("first")
+	if !s.add("third", "verifier") {
+		t.Errorf("add() refused a login after another one ended")
+	}
+	now = now.Add(2 * time.Minute)
+	s.sweep()
+	if !s.add("fourth", "verifier") {
+		t.Errorf("add() refused a login after the others expired")
+	}
+}
+
+// startLogin runs GoogleLogin and returns the state it sent to Google and
+// the cookie it set.
+func startLogin(t *testing.T, o *Oauth) (string, *http.Cookie) {
+	w := httptest.NewRecorder()
+	o.GoogleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/google/login", nil))
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Errorf("GoogleLogin() redirected to an invalid URL: %v", err)
+		return "", nil
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == stateCookieName {
+			return location.Query().Get("state"), c
+		}
+	}
+	t.Errorf("GoogleLogin() didn't set the %v cookie", stateCookieName)
+	return "", nil
+}
+
+func callback(o *Oauth, state, code string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/auth/google/callback?"+url.Values{
+		"state": {state},
+		"code":  {code},
+	}.Encode(), nil)
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	o.GoogleCallback(w, r)
+	return w
+}
+
+func Test_GoogleCallback_shouldRejectStatesOfOtherLogins(t *testing.T) {
+	defer func(f func(string, string) (*oauth2.Token, error)) { getToken = f }(getToken)
+	getToken = func(code, verifier string) (*oauth2.Token, error) {
+		return &oauth2.Token{}, nil
+	}
+	o := &Oauth{}
+
+	state, cookie := startLogin(t, o)
+	otherState, otherCookie := startLogin(t, o)
+
+	tests := []struct {
+		name   string
+		state  string
+		cookie *http.Cookie
+		want   int
+	}{
+		{name: "without the cookie", state: state, want: http.StatusTemporaryRedirect},
+		{name: "cookie of another login", state: state, cookie: otherCookie, want: http.StatusTemporaryRedirect},
+		{name: "forged state", state: "forged", cookie: &http.Cookie{Name: stateCookieName, Value: "forged"}, want: http.StatusTemporaryRedirect},
+		{name: "own login", state: state, cookie: cookie, want: http.StatusFound},
+		{name: "replayed state", state: state, cookie: cookie, want: http.StatusTemporaryRedirect},
+		{name: "other login", state: otherState, cookie: otherCookie, want: http.StatusFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := callback(o, tt.state, "code", tt.cookie); w.Code != tt.want {
+				t.Errorf("GoogleCallback() = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GoogleLogin_shouldKeepOverlappingLoginsApart(t *testing.T) {
+	defer func(f func(string, string) (*oauth2.Token, error)) { getToken = f }(getToken)
+	getToken = func(code, verifier string) (*oauth2.Token, error) {
+		return &oauth2.Token{
+			AccessToken:  "token-" + code,
+			RefreshToken: "refresh-" + code,
+			Expiry:       time.Now().Add(time.Hour),
+		}, nil
+	}
+	o := &Oauth{}
+
+	const users = 50
+	var started, done sync.WaitGroup
+	started.Add(users)
+	done.Add(users)
+	randomIDs := make([]string, users)
+	for i := 0; i < users; i++ {
+		go func(i int) {
+			defer done.Done()
+			state, cookie := startLogin(t, o)
+			// Every login starts before any of them completes.
+			started.Done()
+			started.Wait()
+
+			code := fmt.Sprintf("code-%d", i)
+			w := callback(o, state, code, cookie)
+			if w.Code != http.StatusFound {
+				t.Errorf("GoogleCallback() of user %d = %v, want %v", i, w.Code, http.StatusFound)
+				return
+			}
+
+			location, _ := url.Parse(w.Header().Get("Location"))
+			claim, err := DecodeJwtToken(location.Query().Get("access_token"))
+			if err != nil {
+				t.Errorf("GoogleCallback() of user %d sent an invalid token: %v", i, err)
+				return
+			}
+			randomIDs[i] = claim.RandomID
+
+			token, err := Tokens.Get(claim.RandomID)
+			if err != nil || token.AccessToken != "token-"+code || token.RefreshToken != "refresh-"+code {
+				t.Errorf("user %d got tokens %v, %v, want the ones of %v", i, token, err, code)
+			}
+		}(i)
+	}
+	done.Wait()
+
+	seen := make(map[string]bool)
+	for i, id := range randomIDs {
+		if seen[id] {
+			t.Errorf("user %d got the RandomID %q of another user", i, id)
+		}
+		seen[id] = true
+	}
+}
+
+// exchangeToken is the getToken that talks to the provider, which other
+// tests replace.
+var exchangeToken = getToken
+
+// fakeGoogle is an OAuth provider that hands out a token for a code only if
+// it is exchanged with the verifier of the challenge the code was issued
+// for, and refreshes any refresh token.
+type fakeGoogle struct {
+	*httptest.Server
+	mu         sync.Mutex
+	challenges map[string]string
+}
+
+func newFakeGoogle() *fakeGoogle {
+	g := &fakeGoogle{challenges: make(map[string]string)}
+	g.Server = httptest.NewServer(http.HandlerFunc(g.token))
+	return g
+}
+
+func (g *fakeGoogle) endpoint() oauth2.Endpoint {
+	return oauth2.Endpoint{AuthURL: g.URL + "/auth", TokenURL: g.URL + "/token"}
+}
+
+// authorize plays the user consenting on authURL, and returns a code bound
+// to its challenge.
+func (g *fakeGoogle) authorize(t *testing.T, authURL string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid auth URL: %v", err)
+	}
+	if method := u.Query().Get("code_challenge_method"); method != "S256" {
+		t.Errorf("auth URL code_challenge_method = %v, want %v", method, "S256")
+	}
+	code := "code-" + u.Query().Get("state")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.challenges[code] = u.Query().Get("code_challenge")
+	return code
+}
+
+func (g *fakeGoogle) token(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := r.ParseForm(); err != nil || r.URL.Path != "/token" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "invalid_request"}`) // nolint
+		return
+	}
+	if r.PostForm.Get("grant_type") == "refresh_token" {
+		refresh := r.PostForm.Get("refresh_token")
+		io.WriteString(w, `{"access_token": "refreshed-`+refresh+`", "token_type": "Bearer", "expires_in": 3600}`) // nolint
+		return
+	}
+	code := r.PostForm.Get("code")
+	g.mu.Lock()
+	challenge, ok := g.challenges[code]
+	delete(g.challenges, code)
+	g.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"error": "invalid_grant"}`) // nolint
+		return
+	}
+	io.WriteString(w, `{"access_token": "token-`+code+`", "token_type": "Bearer", "expires_in": 3600}`) // nolint
+}
+
+func Test_GoogleLogin_shouldExchangeTheCodeWithPKCE(t *testing.T) {
+	g := newFakeGoogle()
+	defer g.Close()
+	defer func(e oauth2.Endpoint) { googleOauthConfig.Endpoint = e }(googleOauthConfig.Endpoint)
+	googleOauthConfig.Endpoint = g.endpoint()
+	defer func(f func(string, string) (*oauth2.Token, error)) { getToken = f }(getToken)
+	getToken = exchangeToken
+	o := &Oauth{}
+
+	w := httptest.NewRecorder()
+	o.GoogleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/google/login", nil))
+	location, _ := url.Parse(w.Header().Get("Location"))
+	state := location.Query().Get("state")
+	code := g.authorize(t, location.String())
+
+	l := logins.consume(state)
+	if l == nil {
+		t.Fatalf("GoogleLogin() didn't start a login")
+	}
+	if challenge := location.Query().Get("code_challenge"); challenge != codeChallenge(l.verifier) {
+		t.Errorf("GoogleLogin() code_challenge = %v, want the challenge of %v", challenge, l.verifier)
+	}
+	if len(l.verifier) < 43 || len(l.verifier) > 128 {
+		t.Errorf("GoogleLogin() verifier length = %v, want between 43 and 128", len(l.verifier))
+	}
+
+	token, err := getToken(code, l.verifier)
+	if err != nil {
+		t.Fatalf("getToken() unexpected error: %v", err)
+	}
+	if token.AccessToken != "token-"+code {
+		t.Errorf("getToken() = %v, want %v", token.AccessToken, "token-"+code)
+	}
+}
+
+func Test_GoogleCallback_shouldSendTheVerifierOfTheLogin(t *testing.T) {
+	g := newFakeGoogle()
+	defer g.Close()
+	defer func(e oauth2.Endpoint) { googleOauthConfig.Endpoint = e }(googleOauthConfig.Endpoint)
+	googleOauthConfig.Endpoint = g.endpoint()
+	defer func(f func(string, string) (*oauth2.Token, error)) { getToken = f }(getToken)
+	getToken = exchangeToken
+	o := &Oauth{}
+
+	w := httptest.NewRecorder()
+	o.GoogleLogin(w, httptest.NewRequest(http.MethodGet, "/auth/google/login", nil))
+	location, _ := url.Parse(w.Header().Get("Location"))
+	code := g.authorize(t, location.String())
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == stateCookieName {
+			cookie = c
+		}
+	}
+
+	w = callback(o, location.Query().Get("state"), code, cookie)
+	if w.Code != http.StatusFound {
+		t.Fatalf("GoogleCallback() = %v, want %v", w.Code, http.StatusFound)
+	}
+
+	location, _ = url.Parse(w.Header().Get("Location"))
+	claim, err := DecodeJwtToken(location.Query().Get("access_token"))
+	if err != nil {
+		t.Fatalf("GoogleCallback() sent an invalid token: %v", err)
+	}
+	if token, err := Tokens.Get(claim.RandomID); err != nil || token.AccessToken != "token-"+code {
+		t.Errorf("GoogleCallback() saved %v, %v, want the token of %v", token, err, code)
+	}
+}
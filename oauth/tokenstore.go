@@ -0,0 +1,435 @@
+package oauth
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/oauth2"
+)
+
+// ErrTokenNotFound is returned when no tokens are stored for a user.
+var ErrTokenNotFound = errors.New("no tokens stored for this user, please log in again")
+
+// TokenStore keeps the oauth tokens of every user, keyed by the RandomID of
+// their JWT.
+type TokenStore interface {
+	// Get returns the tokens of userID, or ErrTokenNotFound once they
+	// expired.
+	Get(userID string) (*oauth2.Token, error)
+	// Put saves the tokens of userID until expiresAt, replacing any previous
+	// ones. Tokens with a zero expiresAt are kept until they are deleted.
+	Put(userID string, token *oauth2.Token, expiresAt time.Time) error
+	// Update replaces the tokens of userID and keeps their expiry. It
+	// returns ErrTokenNotFound when none are stored anymore.
+	Update(userID string, token *oauth2.Token) error
+	// Delete forgets the tokens of userID.
+	Delete(userID string) error
+}
+
+// ErrSecretNotFound is returned when no secret is stored under a name.
+var ErrSecretNotFound = errors.New("no secret stored under this name")
+
+// SecretStore keeps the other secrets of users, such as the secrets their
+// webhooks are signed with, by name.
+type SecretStore interface {
+	// Get returns the secret stored under name, or ErrSecretNotFound.
+	Get(name string) ([]byte, error)
+	// Put saves secret under name, replacing any previous one.
+	Put(name string, secret []byte) error
+	// Delete forgets the secret stored under name.
+	Delete(name string) error
+}
+
+// tokenSweepInterval is how often the expired tokens are deleted.
+const tokenSweepInterval = time.Hour
+
+// Tokens stores the tokens of users who logged in, and Secrets their other
+// secrets. They are kept in the TOKEN_STORE_FILE BoltDB file when it is set
+// and only in memory otherwise, encrypted with the base64 encoded 32 bytes
+// TOKEN_ENCRYPTION_KEY.
+var Tokens, Secrets = storesFromEnv()
+
+func storesFromEnv() (TokenStore, SecretStore) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv("TOKEN_ENCRYPTION_KEY"))
+	if err != nil {
+		log.Fatalf("Invalid TOKEN_ENCRYPTION_KEY: %v", err)
+	}
+	path := os.Getenv("TOKEN_STORE_FILE")
+	if len(key) == 0 {
+		// Tokens saved to a file with a key lost on restart could never be
+		// read again.
+		if len(path) != 0 {
+			log.Fatal("TOKEN_ENCRYPTION_KEY must be set along with TOKEN_STORE_FILE")
+		}
+		log.Println("TOKEN_ENCRYPTION_KEY is not set, tokens are encrypted with a random key")
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Unable to generate a token encryption key: %v", err)
+		}
+	}
+
+	var s *encryptedTokenStore
+	if len(path) != 0 {
+		s, err = newBoltTokenStore(path, key)
+	} else {
+		s, err = newEncryptedTokenStore(key, newMemoryBlobs())
+	}
+	if err != nil {
+		log.Fatalf("Unable to open the token store: %v", err)
+	}
+	go s.sweepEvery(tokenSweepInterval)
+	return s, &encryptedSecretStore{s}
+}
+
+// blobStore is where an encryptedTokenStore keeps the sealed tokens.
+type blobStore interface {
+	// get returns nil when nothing is stored for key.
+	get(key string) ([]byte, error)
+	put(key string, value []byte) error
+	delete(key string) error
+	// deleteIf deletes the values for which remove returns true.
+	deleteIf(remove func(value []byte) bool) error
+}
+
+// encryptedTokenStore seals tokens with AES-GCM before storing them. Each
+// value starts with the unix time the tokens expire at, 0 for never, so
+// expired tokens can be swept without decrypting anything. The user ID and
+// the expiry are authenticated along, so the tokens of a user can't be
+// passed off as the ones of another nor kept longer.
+type encryptedTokenStore struct {
+	aead  cipher.AEAD
+	blobs blobStore
+	now   func() time.Time
+}
+
+// expiryLen is the size of the expiry prefixing the stored values.
+const expiryLen = 8
+
+func newEncryptedTokenStore(key []byte, blobs blobStore) (*encryptedTokenStore, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("the token encryption key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTokenStore{aead: aead, blobs: blobs, now: time.Now}, nil
+}
+
+// NewMemoryTokenStore returns a TokenStore keeping tokens in memory,
+// encrypted with the 32 bytes key.
+func NewMemoryTokenStore(key []byte) (TokenStore, error) {
+	return newEncryptedTokenStore(key, newMemoryBlobs())
+}
+
+// NewMemorySecretStore returns a SecretStore keeping secrets in memory,
+// encrypted with the 32 bytes key.
+func NewMemorySecretStore(key []byte) (SecretStore, error) {
+	s, err := newEncryptedTokenStore(key, newMemoryBlobs())
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedSecretStore{s}, nil
+}
+
+// NewBoltTokenStore returns a TokenStore keeping tokens in the BoltDB file
+// at path, encrypted with the 32 bytes key.
+func NewBoltTokenStore(path string, key []byte) (TokenStore, error) {
+	return newBoltTokenStore(path, key)
+}
+
+func newBoltTokenStore(path string, key []byte) (*encryptedTokenStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(tokensBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return newEncryptedTokenStore(key, &boltBlobs{db: db})
+}
+
+func (s *encryptedTokenStore) Get(userID string) (*oauth2.Token, error) {
+	token, _, err := s.get(userID)
+	return token, err
+}
+
+// get returns the tokens of userID and when they expire.
+func (s *encryptedTokenStore) get(userID string) (*oauth2.Token, int64, error) {
+	b, expiry, err := s.open(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+	token := new(oauth2.Token)
+	if err := json.Unmarshal(b, token); err != nil {
+		return nil, 0, err
+	}
+	return token, expiry, nil
+}
+
+// open decrypts the value stored for key and returns it along with its
+// expiry, or ErrTokenNotFound.
+func (s *encryptedTokenStore) open(key string) ([]byte, int64, error) {
+	value, err := s.blobs.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if value == nil || s.expired(value) {
+		return nil, 0, ErrTokenNotFound
+	}
+	size := s.aead.NonceSize()
+	if len(value) < expiryLen+size {
+		return nil, 0, errors.New("stored tokens are corrupted")
+	}
+	header, sealed := value[:expiryLen], value[expiryLen:]
+	b, err := s.aead.Open(nil, sealed[:size], sealed[size:], additionalData(key, header))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to decrypt the stored tokens: %v", err)
+	}
+	return b, int64(binary.BigEndian.Uint64(header)), nil
+}
+
+func (s *encryptedTokenStore) Put(userID string, token *oauth2.Token, expiresAt time.Time) error {
+	var expiry int64
+	if !expiresAt.IsZero() {
+		expiry = expiresAt.Unix()
+	}
+	return s.put(userID, token, expiry)
+}
+
+func (s *encryptedTokenStore) Update(userID string, token *oauth2.Token) error {
+	_, expiry, err := s.get(userID)
+	if err != nil {
+		return err
+	}
+	return s.put(userID, token, expiry)
+}
+
+func (s *encryptedTokenStore) put(userID string, token *oauth2.Token, expiry int64) error {
+	b, err := json.Marshal(token)
+	if err != nil {
+		return err
+	}
+	return s.seal(userID, b, expiry)
+}
+
+// seal encrypts b and stores it for key until expiry.
+func (s *encryptedTokenStore) seal(key string, b []byte, expiry int64) error {
+	header := make([]byte, expiryLen, expiryLen+s.aead.NonceSize())
+	binary.BigEndian.PutUint64(header, uint64(expiry))
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	value := append(header, nonce...)
+	return s.blobs.put(key, s.aead.Seal(value, nonce, b, additionalData(key, header)))
+}
+
+func additionalData(key string, header []byte) []byte {
+	return append([]byte(key), header...)
+}
+
+func (s *encryptedTokenStore) Delete(userID string) error {
+	return s.blobs.delete(userID)
+}
+
+// secretKeyPrefix keeps the secrets apart from the tokens stored along.
+const secretKeyPrefix = "secret/"
+
+// encryptedSecretStore keeps secrets with the tokens of an
+// encryptedTokenStore, encrypted the same way. Secrets never expire.
+type encryptedSecretStore struct {
+	tokens *encryptedTokenStore
+}
+
+func (s *encryptedSecretStore) Get(name string) ([]byte, error) {
+	b, _, err := s.tokens.open(secretKeyPrefix + name)
+	if err == ErrTokenNotFound {
+		return nil, ErrSecretNotFound
+	}
+	return b, err
+}
+
+func (s *encryptedSecretStore) Put(name string, secret []byte) error {
+	return s.tokens.seal(secretKeyPrefix+name, secret, 0)
+}
+
+func (s *encryptedSecretStore) Delete(name string) error {
+	return s.tokens.blobs.delete(secretKeyPrefix + name)
+}
+
+// expired tells whether the tokens stored as value have expired.
+func (s *encryptedTokenStore) expired(value []byte) bool {
+	if len(value) < expiryLen {
+		return false
+	}
+	expiry := int64(binary.BigEndian.Uint64(value[:expiryLen]))
+	return expiry != 0 && s.now().Unix() >= expiry
+}
+
+// sweep deletes the expired tokens.
+func (s *encryptedTokenStore) sweep() error {
+	return s.blobs.deleteIf(s.expired)
+}
+
+func (s *encryptedTokenStore) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := s.sweep(); err != nil {
+			log.Printf("unable to delete the expired tokens: %v", err)
+		}
+	}
+}
+
+type memoryBlobs struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobs() *memoryBlobs {
+	return &memoryBlobs{blobs: make(map[string][]byte)}
+}
+
+func (m *memoryBlobs) get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.blobs[key], nil
+}
+
+func (m *memoryBlobs) put(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = value
+	return nil
+}
+
+func (m *memoryBlobs) delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+func (m *memoryBlobs) deleteIf(remove func(value []byte) bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, value := range m.blobs {
+		if remove(value) {
+			delete(m.blobs, key)
+		}
+	}
+	return nil
+}
+
+var tokensBucket = []byte("tokens")
+
+type boltBlobs struct {
+	db *bolt.DB
+}
+
+func (b *boltBlobs) get(key string) ([]byte, error) {
+	var value []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// Values are only valid for the life of the transaction.
+		if v := tx.Bucket(tokensBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (b *boltBlobs) put(key string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Put([]byte(key), value)
+	})
+}
+
+func (b *boltBlobs) delete(key string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(tokensBucket).Delete([]byte(key))
+	})
+}
+
+func (b *boltBlobs) deleteIf(remove func(value []byte) bool) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(tokensBucket)
+		// Deleting while iterating with a cursor skips keys, so the keys
+		// are collected first.
+		var keys [][]byte
+		err := bucket.ForEach(func(k, v []byte) error {
+			if remove(v) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := bucket.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// persistingTokenSource saves the tokens src refreshes back to the store,
+// so the next request of the user starts from the fresh access token.
+type persistingTokenSource struct {
+	mu     sync.Mutex
+	userID string
+	store  TokenStore
+	src    oauth2.TokenSource
+	// last is the access token last known to the store.
+	last string
+}
+
+func newPersistingTokenSource(userID string, store TokenStore, token *oauth2.Token) *persistingTokenSource {
+	return &persistingTokenSource{
+		userID: userID,
+		store:  store,
+		src:    googleOauthConfig.TokenSource(context.Background(), token),
+		last:   token.AccessToken,
+	}
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := s.src.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if token.AccessToken != s.last {
+		// The refreshed token still works for this request, so failing to
+		// save it only costs another refresh later. Tokens deleted in the
+		// meantime, by a logout, stay deleted.
+		if err := s.store.Update(s.userID, token); err != nil && err != ErrTokenNotFound {
+			log.Printf("unable to save the refreshed tokens: %v", err)
+		}
+		s.last = token.AccessToken
+	}
+	return token, nil
+}
@@ -0,0 +1,236 @@
+package oauth
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+var testTokenKey = bytes.Repeat([]byte{7}, 32)
+
+// newTestBoltTokenStore opens a token store in a new directory, which the
+// caller removes.
+func newTestBoltTokenStore(t *testing.T) (TokenStore, string) {
+	dir, err := ioutil.TempDir("", "tokenstore-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	path := filepath.Join(dir, "tokens.db")
+	s, err := NewBoltTokenStore(path, testTokenKey)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("NewBoltTokenStore() unexpected error: %v", err)
+	}
+	return s, path
+}
+
+func closeBoltTokenStore(s TokenStore) {
+	s.(*encryptedTokenStore).blobs.(*boltBlobs).db.Close()
+}
+
+func Test_TokenStore_shouldRoundTripTokens(t *testing.T) {
+	memory, err := NewMemoryTokenStore(testTokenKey)
+	if err != nil {
+		t.Fatalf("NewMemoryTokenStore() unexpected error: %v", err)
+	}
+	bolt, path := newTestBoltTokenStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer closeBoltTokenStore(bolt)
+
+	stores := map[string]TokenStore{"memory": memory, "bolt": bolt}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			want := &oauth2.Token{
+				AccessToken:  "access",
+				TokenType:    "Bearer",
+				RefreshToken: "refresh",
+				Expiry:       time.Date(2020, 4, 1, 12, 0, 0, 0, time.UTC),
+			}
+			if err := s.Put("user", want, time.Time{}); err != nil {
+				t.Fatalf("Put() unexpected error: %v", err)
+			}
+			got, err := s.Get("user")
+			if err != nil {
+				t.Fatalf("Get() unexpected error: %v", err)
+			}
+			if got.AccessToken != want.AccessToken || got.RefreshToken != want.RefreshToken ||
+				got.TokenType != want.TokenType || !got.Expiry.Equal(want.Expiry) {
+				t.Errorf("Get() = %+v, want %+v", got, want)
+			}
+
+			if _, err := s.Get("other"); err != ErrTokenNotFound {
+				t.Errorf("Get() of another user error = %v, want %v", err, ErrTokenNotFound)
+			}
+			if err := s.Delete("user"); err != nil {
+				t.Fatalf("Delete() unexpected error: %v", err)
+			}
+			if _, err := s.Get("user"); err != ErrTokenNotFound {
+				t.Errorf("Get() after Delete() error = %v, want %v", err, ErrTokenNotFound)
+			}
+		})
+	}
+}
+
+func Test_encryptedTokenStore_shouldExpireTokens(t *testing.T) {
+	memory, _ := newEncryptedTokenStore(testTokenKey, newMemoryBlobs())
+	bolt, path := newTestBoltTokenStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer closeBoltTokenStore(bolt)
+
+	stores := map[string]*encryptedTokenStore{"memory": memory, "bolt": bolt.(*encryptedTokenStore)}
+	for name, s := range stores {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+			s.now = func() time.Time { return now }
+			s.Put("expiring", &oauth2.Token{AccessToken: "expiring"}, now.Add(time.Hour)) // nolint
+			s.Put("schedule", &oauth2.Token{AccessToken: "schedule"}, time.Time{})        // nolint
+
+			// Refreshed tokens keep the expiry of the login.
+			if err := s.Update("expiring", &oauth2.Token{AccessToken: "refreshed"}); err != nil {
+				t.Fatalf("Update() unexpected error: %v", err)
+			}
+			if err := s.Update("deleted", &oauth2.Token{AccessToken: "refreshed"}); err != ErrTokenNotFound {
+				t.Errorf("Update() of deleted tokens error = %v, want %v", err, ErrTokenNotFound)
+			}
+
+			now = now.Add(time.Hour)
+			if _, err := s.Get("expiring"); err != ErrTokenNotFound {
+				t.Errorf("Get() of expired tokens error = %v, want %v", err, ErrTokenNotFound)
+			}
+			if err := s.sweep(); err != nil {
+				t.Fatalf("sweep() unexpected error: %v", err)
+			}
+			for _, tt := range []struct {
+				userID string
+				want   bool
+			}{
+				{userID: "expiring", want: false},
+				{userID: "schedule", want: true},
+				{userID: "deleted", want: false},
+			} {
+				value, _ := s.blobs.get(tt.userID)
+				if got := value != nil; got != tt.want {
+					t.Errorf("sweep() kept %v = %v, want %v", tt.userID, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func Test_encryptedSecretStore_shouldKeepSecretsApartFromTokens(t *testing.T) {
+	tokens, _ := newEncryptedTokenStore(testTokenKey, newMemoryBlobs())
+	secrets := &encryptedSecretStore{tokens}
+	tokens.Put("user", &oauth2.Token{AccessToken: "access"}, time.Now().Add(-time.Minute)) // nolint
+
+	if err := secrets.Put("user", []byte("webhook secret")); err != nil {
+		t.Fatalf("Put() unexpected error: %v", err)
+	}
+	if err := tokens.sweep(); err != nil {
+		t.Fatalf("sweep() unexpected error: %v", err)
+	}
+	got, err := secrets.Get("user")
+	if err != nil || string(got) != "webhook secret" {
+		t.Errorf("Get() = %q, %v, want %q", got, err, "webhook secret")
+	}
+	if bytes.Contains(tokens.blobs.(*memoryBlobs).blobs[secretKeyPrefix+"user"], []byte("webhook secret")) {
+		t.Errorf("Put() stored the secret in plain text")
+	}
+
+	if err := secrets.Delete("user"); err != nil {
+		t.Fatalf("Delete() unexpected error: %v", err)
+	}
+	if _, err := secrets.Get("user"); err != ErrSecretNotFound {
+		t.Errorf("Get() after Delete() error = %v, want %v", err, ErrSecretNotFound)
+	}
+}
+
+func Test_NewBoltTokenStore_shouldOnlyStoreEncryptedTokens(t *testing.T) {
+	s, path := newTestBoltTokenStore(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	s.Put("user", &oauth2.Token{AccessToken: "secret-access", RefreshToken: "secret-refresh"}, time.Time{}) // nolint
+	closeBoltTokenStore(s)
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read the store: %v", err)
+	}
+	if bytes.Contains(b, []byte("secret-")) {
+		t.Errorf("token store file holds the tokens in plain text")
+	}
+
+	// The tokens outlive the store, but only for the key they were stored
+	// with.
+	for _, tt := range []struct {
+		name    string
+		key     []byte
+		wantErr bool
+	}{
+		{name: "same key", key: testTokenKey},
+		{name: "other key", key: bytes.Repeat([]byte{8}, 32), wantErr: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			reopened, err := NewBoltTokenStore(path, tt.key)
+			if err != nil {
+				t.Fatalf("NewBoltTokenStore() unexpected error: %v", err)
+			}
+			defer closeBoltTokenStore(reopened)
+			token, err := reopened.Get("user")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && token.RefreshToken != "secret-refresh" {
+				t.Errorf("Get() = %v, want %v", token.RefreshToken, "secret-refresh")
+			}
+		})
+	}
+}
+
+func Test_encryptedTokenStore_Get_shouldRejectTokensOfAnotherUser(t *testing.T) {
+	blobs := &memoryBlobs{blobs: make(map[string][]byte)}
+	s, _ := newEncryptedTokenStore(testTokenKey, blobs)
+	s.Put("victim", &oauth2.Token{AccessToken: "access"}, time.Time{}) // nolint
+	blobs.blobs["attacker"] = blobs.blobs["victim"]
+
+	if _, err := s.Get("attacker"); err == nil {
+		t.Errorf("Get() expected an error for tokens sealed for another user")
+	}
+}
+
+func Test_NewMemoryTokenStore_shouldRejectInvalidKeys(t *testing.T) {
+	if _, err := NewMemoryTokenStore([]byte("short")); err == nil {
+		t.Errorf("NewMemoryTokenStore() expected an error for a 5 bytes key")
+	}
+}
+
+func Test_persistingTokenSource_shouldStoreRefreshedTokens(t *testing.T) {
+	g := newFakeGoogle()
+	defer g.Close()
+	defer func(e oauth2.Endpoint) { googleOauthConfig.Endpoint = e }(googleOauthConfig.Endpoint)
+	googleOauthConfig.Endpoint = g.endpoint()
+
+	s, _ := NewMemoryTokenStore(testTokenKey)
+	expired := &oauth2.Token{AccessToken: "expired", RefreshToken: "refresh", Expiry: time.Now().Add(-time.Minute)}
+	s.Put("user", expired, time.Time{}) // nolint
+
+	src := newPersistingTokenSource("user", s, expired)
+	token, err := src.Token()
+	if err != nil {
+		t.Fatalf("Token() unexpected error: %v", err)
+	}
+	if token.AccessToken != "refreshed-refresh" {
+		t.Errorf("Token() = %v, want %v", token.AccessToken, "refreshed-refresh")
+	}
+
+	stored, err := s.Get("user")
+	if err != nil {
+		t.Fatalf("Get() unexpected error: %v", err)
+	}
+	if stored.AccessToken != "refreshed-refresh" || stored.RefreshToken != "refresh" || !stored.Expiry.After(time.Now()) {
+		t.Errorf("stored token = %+v, want the refreshed one", stored)
+	}
+}
@@ -11,15 +11,27 @@ import (
 type Oauth interface {
 	GoogleLogin(w http.ResponseWriter, r *http.Request)
 	GoogleCallback(w http.ResponseWriter, r *http.Request)
+	Logout(w http.ResponseWriter, r *http.Request)
 }
 
 // NewRouter creates new router
 func NewRouter() *mux.Router {
-	var o Oauth = &oauth.Oauth{}
+	var o Oauth = &oauth.Oauth{SchedulesOf: scraper.SchedulesOf}
 
 	r := mux.NewRouter()
 	r.HandleFunc("/auth/google/login", o.GoogleLogin)
 	r.HandleFunc("/auth/google/callback", o.GoogleCallback)
+	r.HandleFunc("/auth/logout", o.Logout).Methods(http.MethodPost)
 	r.HandleFunc("/download/attachment", scraper.Scrape)
+	r.HandleFunc("/download/preview", scraper.Preview)
+	r.HandleFunc("/download/selection", scraper.ScrapeSelection).Methods(http.MethodPost)
+	r.HandleFunc("/jobs", scraper.CreateJob).Methods(http.MethodPost)
+	r.HandleFunc("/jobs/{id}", scraper.GetJob).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}/events", scraper.GetJobEvents).Methods(http.MethodGet)
+	r.HandleFunc("/jobs/{id}/archive", scraper.GetJobArchive).Methods(http.MethodGet)
+	r.HandleFunc("/schedules", scraper.CreateSchedule).Methods(http.MethodPost)
+	r.HandleFunc("/schedules", scraper.ListSchedules).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{id}", scraper.GetSchedule).Methods(http.MethodGet)
+	r.HandleFunc("/schedules/{id}", scraper.DeleteSchedule).Methods(http.MethodDelete)
 	return r
 }
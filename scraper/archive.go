@@ -0,0 +1,249 @@
+package scraper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ArchiveWriter adds the files of a scrape to an archive. A file is written
+// to the io.Writer returned by Create until the next call to Create or Close.
+// Close finishes the archive but doesn't close what it is written to.
+type ArchiveWriter interface {
+	Create(name string) (io.Writer, error)
+	Close() error
+}
+
+// archiveFormat describes a kind of archive a scrape can produce.
+type archiveFormat struct {
+	name        string
+	contentType string
+	extension   string
+	// newWriter returns a writer for an archive sent to w. It is nil for
+	// formats that aren't sent as a single stream of bytes.
+	newWriter func(w io.Writer) (ArchiveWriter, error)
+}
+
+var (
+	zipFormat = &archiveFormat{
+		name:        "zip",
+		contentType: "application/zip",
+		extension:   ".zip",
+		newWriter: func(w io.Writer) (ArchiveWriter, error) {
+			return newZipWriter(w), nil
+		},
+	}
+	tarGzFormat = &archiveFormat{
+		name:        "tar.gz",
+		contentType: "application/gzip",
+		extension:   ".tar.gz",
+		newWriter: func(w io.Writer) (ArchiveWriter, error) {
+			return newTarGzWriter(w), nil
+		},
+	}
+	tarZstFormat = &archiveFormat{
+		name:        "tar.zst",
+		contentType: "application/zstd",
+		extension:   ".tar.zst",
+		newWriter:   newTarZstWriter,
+	}
+	// directoryFormat leaves the files in a directory on the server, for
+	// jobs whose results are picked up from there.
+	directoryFormat = &archiveFormat{name: "dir"}
+)
+
+var archiveFormats = []*archiveFormat{zipFormat, tarGzFormat, tarZstFormat, directoryFormat}
+
+// acceptedContentTypes maps the media types clients may ask for in an Accept
+// header to the formats serving them.
+var acceptedContentTypes = map[string]*archiveFormat{
+	"application/zip":    zipFormat,
+	"application/gzip":   tarGzFormat,
+	"application/x-gzip": tarGzFormat,
+	"application/x-gtar": tarGzFormat,
+	"application/zstd":   tarZstFormat,
+}
+
+// archiveDirectory is where jobs using the dir format leave their files,
+// each in a directory named after the job. The format is disabled when it
+// isn't set.
+var archiveDirectory = os.Getenv("ARCHIVE_DIRECTORY")
+
+// formatFromRequest picks the archive format named by the format parameter
+// or, without one, the first supported type of the Accept header. Scrapes
+// are zipped by default.
+func formatFromRequest(r *http.Request) (*archiveFormat, error) {
+	name, accept := r.FormValue("format"), r.Header.Get("Accept")
+	if len(name) != 0 {
+		for _, f := range archiveFormats {
+			if f.name != name {
+				continue
+			}
+			if f == directoryFormat && len(archiveDirectory) == 0 {
+				return nil, errors.New("the dir format isn't enabled on this server")
+			}
+			return f, nil
+		}
+		names := make([]string, len(archiveFormats))
+		for i, f := range archiveFormats {
+			names[i] = f.name
+		}
+		return nil, fmt.Errorf("format must be one of %s", strings.Join(names, ", "))
+	}
+
+	for _, accepted := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || params["q"] == "0" {
+			continue
+		}
+		if f, ok := acceptedContentTypes[mediaType]; ok {
+			return f, nil
+		}
+	}
+	return zipFormat, nil
+}
+
+// zipWriter writes a zip archive.
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func newZipWriter(w io.Writer) ArchiveWriter {
+	return &zipWriter{zw: zip.NewWriter(w)}
+}
+
+func (z *zipWriter) Create(name string) (io.Writer, error) {
+	return z.zw.Create(name)
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// tarWriter writes a tarball. Tar headers hold the size of a file, so each
+// file is buffered until the next one is created.
+type tarWriter struct {
+	tw      *tar.Writer
+	name    string
+	buf     bytes.Buffer
+	closers []io.Closer
+}
+
+func newTarWriter(w io.Writer, closers ...io.Closer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), closers: closers}
+}
+
+func newTarGzWriter(w io.Writer) ArchiveWriter {
+	gw := gzip.NewWriter(w)
+	return newTarWriter(gw, gw)
+}
+
+func newTarZstWriter(w io.Writer) (ArchiveWriter, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	return newTarWriter(zw, zw), nil
+}
+
+func (t *tarWriter) Create(name string) (io.Writer, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	t.name = name
+	return &t.buf, nil
+}
+
+func (t *tarWriter) flush() error {
+	if len(t.name) == 0 {
+		return nil
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     t.name,
+		Mode:     0644,
+		Size:     int64(t.buf.Len()),
+		ModTime:  time.Now(),
+	}
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := t.buf.WriteTo(t.tw); err != nil {
+		return err
+	}
+	t.name = ""
+	return nil
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.flush(); err != nil {
+		return err
+	}
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	for _, c := range t.closers {
+		if err := c.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// directoryWriter writes the files of a scrape in a directory on the disk.
+type directoryWriter struct {
+	root string
+	f    *os.File
+}
+
+func newDirectoryWriter(root string) (ArchiveWriter, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &directoryWriter{root: root}, nil
+}
+
+func (d *directoryWriter) Create(name string) (io.Writer, error) {
+	if err := d.closeFile(); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(d.root, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, filepath.Clean(d.root)+string(filepath.Separator)) {
+		return nil, errors.New("the file " + name + " is outside the archive directory")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	d.f = f
+	return f, nil
+}
+
+func (d *directoryWriter) closeFile() error {
+	if d.f == nil {
+		return nil
+	}
+	err := d.f.Close()
+	d.f = nil
+	return err
+}
+
+func (d *directoryWriter) Close() error {
+	return d.closeFile()
+}
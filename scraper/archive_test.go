@@ -0,0 +1,266 @@
+package scraper
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_formatFromRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		accept  string
+		want    *archiveFormat
+		wantErr bool
+	}{
+		{name: "default", target: "/", want: zipFormat},
+		{name: "format parameter", target: "/?format=tar.zst", want: tarZstFormat},
+		{name: "format parameter wins over accept", target: "/?format=zip", accept: "application/gzip", want: zipFormat},
+		{name: "accept header", target: "/", accept: "application/gzip", want: tarGzFormat},
+		{name: "first supported accepted type", target: "/", accept: "text/html, application/zstd;q=0.9, application/zip", want: tarZstFormat},
+		{name: "refused type", target: "/", accept: "application/zstd;q=0, application/gzip", want: tarGzFormat},
+		{name: "unsupported accept header", target: "/", accept: "text/html, */*", want: zipFormat},
+		{name: "unknown format", target: "/?format=rar", wantErr: true},
+		{name: "dir format without a directory", target: "/?format=dir", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if len(tt.accept) != 0 {
+				r.Header.Set("Accept", tt.accept)
+			}
+			got, err := formatFromRequest(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("formatFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("formatFromRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+var testArchiveFiles = map[string]string{
+	"a.pdf":           "first file",
+	"sender/b.pdf":    "second file",
+	"manifest.json":   "[]",
+	"sender/2019/c.x": "",
+}
+
+var testArchiveOrder = []string{"a.pdf", "sender/b.pdf", "sender/2019/c.x", "manifest.json"}
+
+func writeTestArchive(t *testing.T, aw ArchiveWriter) {
+	for _, name := range testArchiveOrder {
+		f, err := aw.Create(name)
+		if err != nil {
+			t.Fatalf("Create(%v) unexpected error: %v", name, err)
+		}
+		if _, err := io.WriteString(f, testArchiveFiles[name]); err != nil {
+			t.Fatalf("Write(%v) unexpected error: %v", name, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Close() unexpected error: %v", err)
+	}
+}
+
+func readTar(t *testing.T, r io.Reader) map[string]string {
+	files := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatalf("invalid tarball: %v", err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("unable to read %v: %v", hdr.Name, err)
+		}
+		files[hdr.Name] = string(b)
+	}
+}
+
+func Test_archiveFormats_shouldRoundTrip(t *testing.T) {
+	tests := []struct {
+		format *archiveFormat
+		read   func(t *testing.T, b []byte) map[string]string
+	}{
+		{
+			format: zipFormat,
+			read: func(t *testing.T, b []byte) map[string]string {
+				zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				if err != nil {
+					t.Fatalf("invalid zip: %v", err)
+				}
+				files := make(map[string]string)
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatalf("unable to open %v: %v", f.Name, err)
+					}
+					content, _ := ioutil.ReadAll(rc)
+					rc.Close()
+					files[f.Name] = string(content)
+				}
+				return files
+			},
+		},
+		{
+			format: tarGzFormat,
+			read: func(t *testing.T, b []byte) map[string]string {
+				gr, err := gzip.NewReader(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("invalid gzip: %v", err)
+				}
+				return readTar(t, gr)
+			},
+		},
+		{
+			format: tarZstFormat,
+			read: func(t *testing.T, b []byte) map[string]string {
+				zr, err := zstd.NewReader(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("invalid zstd: %v", err)
+				}
+				defer zr.Close()
+				return readTar(t, zr)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			aw, err := tt.format.newWriter(&buf)
+			if err != nil {
+				t.Fatalf("newWriter() unexpected error: %v", err)
+			}
+			writeTestArchive(t, aw)
+
+			if got := tt.read(t, buf.Bytes()); !reflect.DeepEqual(got, testArchiveFiles) {
+				t.Errorf("archive = %v, want %v", got, testArchiveFiles)
+			}
+		})
+	}
+}
+
+func Test_directoryWriter(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+
+	aw, err := newDirectoryWriter(filepath.Join(root, "job"))
+	if err != nil {
+		t.Fatalf("newDirectoryWriter() unexpected error: %v", err)
+	}
+	writeTestArchive(t, aw)
+
+	for name, want := range testArchiveFiles {
+		got, err := ioutil.ReadFile(filepath.Join(root, "job", filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("unable to read %v: %v", name, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := aw.Create("../escaped.pdf"); err == nil {
+		t.Errorf("Create() expected an error for a file outside the directory")
+	}
+}
+
+func Test_job_execute_shouldWriteFilesToADirectory(t *testing.T) {
+	root, err := ioutil.TempDir("", "archive-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(root)
+	defer func(dir string) { archiveDirectory = dir }(archiveDirectory)
+	archiveDirectory = root
+
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+		format:  directoryFormat,
+	}
+	j := newJob("owner", testFilter, p)
+	j.execute()
+	j.cleanup()
+
+	status := j.status()
+	if status.State != jobSucceeded {
+		t.Fatalf("execute() state = %v, want %v (%v)", status.State, jobSucceeded, status.Error)
+	}
+	if want := filepath.Join(root, j.id); status.Directory != want {
+		t.Errorf("execute() directory = %v, want %v", status.Directory, want)
+	}
+	names, err := filepath.Glob(filepath.Join(root, j.id, "*.pdf"))
+	if err != nil || len(names) != 5 {
+		t.Errorf("execute() wrote %v, want %v attachments", names, 5)
+	}
+	if _, err := os.Stat(filepath.Join(root, j.id, manifestJSONFileName)); err != nil {
+		t.Errorf("execute() expected a manifest: %v", err)
+	}
+}
+
+func Test_sendArchive_shouldRejectTheDirFormat(t *testing.T) {
+	p := newTestPipeline(&mockMessage{})
+	p.format = directoryFormat
+	w := httptest.NewRecorder()
+
+	sendArchive(w, httptest.NewRequest(http.MethodGet, "/", nil), p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("sendArchive() = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func Test_streamArchive_shouldUseTheRequestedFormat(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+		format:  tarGzFormat,
+	}
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if contentType := w.Header().Get("Content-type"); contentType != "application/gzip" {
+		t.Errorf("streamArchive() content type = %v, want %v", contentType, "application/gzip")
+	}
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("streamArchive() wrote an invalid gzip: %v", err)
+	}
+	files := readTar(t, gr)
+	if _, ok := files[manifestCSVFileName]; !ok || len(files) != 7 {
+		t.Errorf("streamArchive() wrote %v files, want 5 attachments and the manifests", len(files))
+	}
+}
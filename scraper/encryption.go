@@ -0,0 +1,309 @@
+package scraper
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/pbkdf2"
+	// Keys without hash preferences fall back to RIPEMD-160.
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// passphraseHeader carries the passphrase of an encrypted archive, so that
+// it doesn't end up in access logs like a query parameter would.
+const passphraseHeader = "X-Archive-Passphrase"
+
+// minPassphraseLength is the shortest passphrase accepted to encrypt an
+// archive.
+const minPassphraseLength = 8
+
+// Ways to encrypt an archive.
+const (
+	encryptionDisabled = ""
+	encryptionAES      = "aes"
+	encryptionOpenPGP  = "pgp"
+)
+
+// WinZip AES encryption, see https://www.winzip.com/win/en/aes_info.html
+const (
+	aesZipMethod      = 99
+	aesZipExtraID     = 0x9901
+	aesZipVersion     = 1 // AE-1, which keeps the CRC of the plaintext
+	aesZipStrength    = 3 // AES-256
+	aesZipKeyLength   = 32
+	aesZipSaltLength  = 16
+	aesZipVerifierLen = 2
+	aesZipMACLength   = 10
+	aesZipIterations  = 1000
+)
+
+const (
+	pgpContentType = "application/pgp-encrypted"
+	pgpExtension   = ".gpg"
+)
+
+// encryption protects an archive with a passphrase or, for OpenPGP, with the
+// public keys of its recipients. Archives are encrypted as they are written
+// so they never reach the disk in plaintext.
+type encryption struct {
+	method     string
+	passphrase []byte
+	recipients openpgp.EntityList
+}
+
+// encryptionFromRequest reads how the archive of r should be encrypted:
+// encrypt=aes makes a WinZip AES-256 zip, whose file names stay readable,
+// and encrypt=pgp an OpenPGP message holding the whole archive. The
+// passphrase is sent in the X-Archive-Passphrase header, OpenPGP archives
+// can be encrypted to an armored publicKey instead.
+func encryptionFromRequest(r *http.Request, format *archiveFormat) (*encryption, error) {
+	method := r.FormValue("encrypt")
+	if method == encryptionDisabled {
+		return nil, nil
+	}
+	if format == directoryFormat {
+		return nil, errors.New("the dir format can't be encrypted")
+	}
+
+	e := &encryption{method: method, passphrase: []byte(r.Header.Get(passphraseHeader))}
+
+	switch method {
+	case encryptionAES:
+		if format != zipFormat {
+			return nil, errors.New("aes encryption is only available for the zip format")
+		}
+	case encryptionOpenPGP:
+		if key := r.FormValue("publicKey"); len(key) != 0 {
+			recipients, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+			if err != nil {
+				return nil, errors.New("invalid publicKey: " + err.Error())
+			}
+			e.recipients = recipients
+			e.passphrase = nil
+			return e, nil
+		}
+	default:
+		return nil, errors.New("encrypt must be either aes or pgp")
+	}
+
+	if len(e.passphrase) < minPassphraseLength {
+		return nil, errors.New("a passphrase of at least 8 characters is required to encrypt the archive")
+	}
+	return e, nil
+}
+
+// contentType returns the content type of archives in format once they are
+// encrypted.
+func (e *encryption) contentType(format *archiveFormat) string {
+	if e != nil && e.method == encryptionOpenPGP {
+		return pgpContentType
+	}
+	return format.contentType
+}
+
+func (e *encryption) extension(format *archiveFormat) string {
+	if e != nil && e.method == encryptionOpenPGP {
+		return format.extension + pgpExtension
+	}
+	return format.extension
+}
+
+// newWriter returns a writer for an archive in format sent encrypted to w.
+func (e *encryption) newWriter(w io.Writer, format *archiveFormat) (ArchiveWriter, error) {
+	if e == nil {
+		return format.newWriter(w)
+	}
+	if e.method == encryptionAES {
+		return newAESZipWriter(w, e.passphrase), nil
+	}
+
+	hints := &openpgp.FileHints{IsBinary: true, ModTime: time.Now()}
+	config := &packet.Config{DefaultCipher: packet.CipherAES256}
+	var pw io.WriteCloser
+	var err error
+	if len(e.recipients) != 0 {
+		pw, err = openpgp.Encrypt(w, e.recipients, nil, hints, config)
+	} else {
+		pw, err = openpgp.SymmetricallyEncrypt(w, e.passphrase, hints, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+	aw, err := format.newWriter(pw)
+	if err != nil {
+		return nil, err
+	}
+	return &closingArchiveWriter{ArchiveWriter: aw, c: pw}, nil
+}
+
+// closingArchiveWriter also closes what the archive is written to when it
+// is closed.
+type closingArchiveWriter struct {
+	ArchiveWriter
+	c io.Closer
+}
+
+func (a *closingArchiveWriter) Close() error {
+	if err := a.ArchiveWriter.Close(); err != nil {
+		return err
+	}
+	return a.c.Close()
+}
+
+// aesZipWriter writes a zip archive whose files are encrypted with WinZip
+// AES-256, which 7-Zip, WinZip and libarchive can open.
+type aesZipWriter struct {
+	zw *zip.Writer
+}
+
+func newAESZipWriter(w io.Writer, passphrase []byte) ArchiveWriter {
+	zw := zip.NewWriter(w)
+	zw.RegisterCompressor(aesZipMethod, func(w io.Writer) (io.WriteCloser, error) {
+		return newAESZipFileWriter(w, passphrase)
+	})
+	return &aesZipWriter{zw: zw}
+}
+
+func (z *aesZipWriter) Create(name string) (io.Writer, error) {
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], aesZipExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], aesZipVersion)
+	copy(extra[6:], "AE")
+	extra[8] = aesZipStrength
+	binary.LittleEndian.PutUint16(extra[9:], zip.Deflate)
+
+	return z.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   aesZipMethod,
+		Flags:    0x1, // encrypted
+		Extra:    extra,
+		Modified: time.Now(),
+	})
+}
+
+func (z *aesZipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// aesZipFileWriter deflates and encrypts a single file of an AES zip. Its
+// data is a salt, a password verifier, the encrypted deflated content and an
+// authentication code of that content.
+type aesZipFileWriter struct {
+	w   io.Writer
+	fw  *flate.Writer
+	ctr *aesZipCTR
+	mac hash.Hash
+	// header holds the salt and the password verifier until the first
+	// write, as the zip writer creates compressors before writing the
+	// local file header.
+	header []byte
+}
+
+func newAESZipFileWriter(w io.Writer, passphrase []byte) (*aesZipFileWriter, error) {
+	salt := make([]byte, aesZipSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keys := pbkdf2.Key(passphrase, salt, aesZipIterations, 2*aesZipKeyLength+aesZipVerifierLen, sha1.New)
+	block, err := aes.NewCipher(keys[:aesZipKeyLength])
+	if err != nil {
+		return nil, err
+	}
+
+	f := &aesZipFileWriter{
+		w:      w,
+		ctr:    newAESZipCTR(block),
+		mac:    hmac.New(sha1.New, keys[aesZipKeyLength:2*aesZipKeyLength]),
+		header: append(salt, keys[2*aesZipKeyLength:]...),
+	}
+	f.fw, err = flate.NewWriter(writerFunc(f.writeEncrypted), flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *aesZipFileWriter) Write(b []byte) (int, error) {
+	return f.fw.Write(b)
+}
+
+func (f *aesZipFileWriter) writeHeader() error {
+	if f.header == nil {
+		return nil
+	}
+	_, err := f.w.Write(f.header)
+	f.header = nil
+	return err
+}
+
+func (f *aesZipFileWriter) writeEncrypted(b []byte) (int, error) {
+	if err := f.writeHeader(); err != nil {
+		return 0, err
+	}
+	encrypted := make([]byte, len(b))
+	f.ctr.XORKeyStream(encrypted, b)
+	f.mac.Write(encrypted) // nolint
+	return f.w.Write(encrypted)
+}
+
+func (f *aesZipFileWriter) Close() error {
+	if err := f.fw.Close(); err != nil {
+		return err
+	}
+	if err := f.writeHeader(); err != nil {
+		return err
+	}
+	_, err := f.w.Write(f.mac.Sum(nil)[:aesZipMACLength])
+	return err
+}
+
+// aesZipCTR is AES in counter mode as WinZip uses it: the counter is a
+// little-endian number starting at 1, unlike the one of cipher.NewCTR.
+type aesZipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func newAESZipCTR(block cipher.Block) *aesZipCTR {
+	return &aesZipCTR{block: block, used: aes.BlockSize}
+}
+
+func (c *aesZipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
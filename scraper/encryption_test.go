@@ -0,0 +1,320 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/pbkdf2"
+	"google.golang.org/api/gmail/v1"
+)
+
+const testPassphrase = "correct horse battery"
+
+func newTestEntity(t *testing.T) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("Test", "", "test@mail.com", nil)
+	if err != nil {
+		t.Fatalf("unable to create a key: %v", err)
+	}
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatalf("unable to armor the key: %v", err)
+	}
+	if err := entity.Serialize(w); err != nil {
+		t.Fatalf("unable to serialize the key: %v", err)
+	}
+	w.Close()
+	return entity, buf.String()
+}
+
+func Test_encryptionFromRequest(t *testing.T) {
+	_, publicKey := newTestEntity(t)
+
+	tests := []struct {
+		name       string
+		form       url.Values
+		passphrase string
+		format     *archiveFormat
+		want       string
+		wantErr    bool
+	}{
+		{name: "no encryption", format: zipFormat, want: encryptionDisabled},
+		{name: "aes", form: url.Values{"encrypt": {"aes"}}, passphrase: testPassphrase, format: zipFormat, want: encryptionAES},
+		{name: "aes tarball", form: url.Values{"encrypt": {"aes"}}, passphrase: testPassphrase, format: tarGzFormat, wantErr: true},
+		{name: "pgp with a passphrase", form: url.Values{"encrypt": {"pgp"}}, passphrase: testPassphrase, format: tarZstFormat, want: encryptionOpenPGP},
+		{name: "pgp with a public key", form: url.Values{"encrypt": {"pgp"}, "publicKey": {publicKey}}, format: tarGzFormat, want: encryptionOpenPGP},
+		{name: "invalid public key", form: url.Values{"encrypt": {"pgp"}, "publicKey": {"not a key"}}, format: tarGzFormat, wantErr: true},
+		{name: "missing passphrase", form: url.Values{"encrypt": {"pgp"}}, format: tarGzFormat, wantErr: true},
+		{name: "short passphrase", form: url.Values{"encrypt": {"aes"}}, passphrase: "short", format: zipFormat, wantErr: true},
+		{name: "unknown method", form: url.Values{"encrypt": {"rot13"}}, passphrase: testPassphrase, format: zipFormat, wantErr: true},
+		{name: "dir format", form: url.Values{"encrypt": {"pgp"}}, passphrase: testPassphrase, format: directoryFormat, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+tt.form.Encode(), nil)
+			if len(tt.passphrase) != 0 {
+				r.Header.Set(passphraseHeader, tt.passphrase)
+			}
+			e, err := encryptionFromRequest(r, tt.format)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("encryptionFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got := encryptionDisabled
+			if e != nil {
+				got = e.method
+			}
+			if got != tt.want {
+				t.Errorf("encryptionFromRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+var errWrongPassphrase = errors.New("wrong passphrase")
+
+// readAESZip decrypts the files of a WinZip AES zip.
+func readAESZip(b []byte, passphrase string) (map[string]string, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	zr.RegisterDecompressor(aesZipMethod, func(r io.Reader) io.ReadCloser {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return ioutil.NopCloser(&errReader{err})
+		}
+		salt := data[:aesZipSaltLength]
+		verifier := data[aesZipSaltLength : aesZipSaltLength+aesZipVerifierLen]
+		encrypted := data[aesZipSaltLength+aesZipVerifierLen : len(data)-aesZipMACLength]
+		code := data[len(data)-aesZipMACLength:]
+
+		keys := pbkdf2.Key([]byte(passphrase), salt, aesZipIterations, 2*aesZipKeyLength+aesZipVerifierLen, sha1.New)
+		if !bytes.Equal(verifier, keys[2*aesZipKeyLength:]) {
+			return ioutil.NopCloser(&errReader{errWrongPassphrase})
+		}
+		mac := hmac.New(sha1.New, keys[aesZipKeyLength:2*aesZipKeyLength])
+		mac.Write(encrypted)
+		if !hmac.Equal(code, mac.Sum(nil)[:aesZipMACLength]) {
+			return ioutil.NopCloser(&errReader{errors.New("invalid authentication code")})
+		}
+		block, _ := aes.NewCipher(keys[:aesZipKeyLength])
+		compressed := make([]byte, len(encrypted))
+		newAESZipCTR(block).XORKeyStream(compressed, encrypted)
+		return flate.NewReader(bytes.NewReader(compressed))
+	})
+
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		if f.Method != aesZipMethod || f.Flags&0x1 == 0 {
+			return nil, errors.New(f.Name + " isn't encrypted")
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		files[f.Name] = string(content)
+	}
+	return files, nil
+}
+
+type errReader struct {
+	err error
+}
+
+func (r *errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func Test_aesZipWriter_shouldEncryptEveryFile(t *testing.T) {
+	var buf bytes.Buffer
+	writeTestArchive(t, newAESZipWriter(&buf, []byte(testPassphrase)))
+
+	if bytes.Contains(buf.Bytes(), []byte("second file")) {
+		t.Errorf("the archive contains plaintext")
+	}
+	got, err := readAESZip(buf.Bytes(), testPassphrase)
+	if err != nil {
+		t.Fatalf("unable to read the archive: %v", err)
+	}
+	if !reflect.DeepEqual(got, testArchiveFiles) {
+		t.Errorf("archive = %v, want %v", got, testArchiveFiles)
+	}
+	if _, err := readAESZip(buf.Bytes(), "wrong passphrase"); err != errWrongPassphrase {
+		t.Errorf("reading with a wrong passphrase = %v, want %v", err, errWrongPassphrase)
+	}
+}
+
+func Test_aesZipCTR_shouldMatchWinZipCounters(t *testing.T) {
+	block, _ := aes.NewCipher(make([]byte, aesZipKeyLength))
+	ctr := newAESZipCTR(block)
+	stream := make([]byte, 2*aes.BlockSize)
+	ctr.XORKeyStream(stream, stream)
+
+	// The counter of the first block is 1 and the one of the second 2,
+	// both little-endian.
+	for i, n := range []byte{1, 2} {
+		counter := make([]byte, aes.BlockSize)
+		counter[0] = n
+		want := make([]byte, aes.BlockSize)
+		block.Encrypt(want, counter)
+		if got := stream[i*aes.BlockSize : (i+1)*aes.BlockSize]; !bytes.Equal(got, want) {
+			t.Errorf("block %d = %x, want %x", i, got, want)
+		}
+	}
+}
+
+func Test_encryption_newWriter_shouldEncryptWithOpenPGP(t *testing.T) {
+	entity, publicKey := newTestEntity(t)
+	recipients, err := openpgp.ReadArmoredKeyRing(strings.NewReader(publicKey))
+	if err != nil {
+		t.Fatalf("unable to read the key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		e       *encryption
+		keyring openpgp.EntityList
+		prompt  openpgp.PromptFunction
+	}{
+		{
+			name: "passphrase",
+			e:    &encryption{method: encryptionOpenPGP, passphrase: []byte(testPassphrase)},
+			prompt: func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+				return []byte(testPassphrase), nil
+			},
+		},
+		{
+			name:    "public key",
+			e:       &encryption{method: encryptionOpenPGP, recipients: recipients},
+			keyring: openpgp.EntityList{entity},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			aw, err := tt.e.newWriter(&buf, tarGzFormat)
+			if err != nil {
+				t.Fatalf("newWriter() unexpected error: %v", err)
+			}
+			writeTestArchive(t, aw)
+
+			md, err := openpgp.ReadMessage(&buf, tt.keyring, tt.prompt, nil)
+			if err != nil {
+				t.Fatalf("unable to decrypt the archive: %v", err)
+			}
+			gr, err := gzip.NewReader(md.UnverifiedBody)
+			if err != nil {
+				t.Fatalf("invalid gzip: %v", err)
+			}
+			if got := readTar(t, gr); !reflect.DeepEqual(got, testArchiveFiles) {
+				t.Errorf("archive = %v, want %v", got, testArchiveFiles)
+			}
+		})
+	}
+}
+
+func Test_job_execute_shouldNotWritePlaintextToTheDisk(t *testing.T) {
+	tests := []struct {
+		name      string
+		format    *archiveFormat
+		e         *encryption
+		extension string
+		plaintext []string
+	}{
+		{
+			name:      "aes",
+			format:    zipFormat,
+			e:         &encryption{method: encryptionAES, passphrase: []byte(testPassphrase)},
+			extension: ".zip",
+			// AES zips only encrypt the content of files.
+			plaintext: []string{"attachment of 16c2", "billing@vendor.com"},
+		},
+		{
+			name:      "pgp",
+			format:    tarGzFormat,
+			e:         &encryption{method: encryptionOpenPGP, passphrase: []byte(testPassphrase)},
+			extension: ".tar.gz.gpg",
+			plaintext: []string{"attachment of 16c2", "billing@vendor.com", manifestCSVFileName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pipeline{
+				service:    new(gmail.Service),
+				ms:         &mockMessage{},
+				cont:       &mockMessageContentWithMetadata{},
+				as:         &mockAttachmentWithData{},
+				format:     tt.format,
+				encryption: tt.e,
+			}
+			j := newJob("owner", testFilter, p)
+			j.execute()
+			defer j.cleanup()
+
+			archivePath, ok := j.archive()
+			if !ok {
+				t.Fatalf("execute() failed: %v", j.status().Error)
+			}
+			if !strings.HasSuffix(archivePath, tt.extension) {
+				t.Errorf("execute() wrote %v, want a %v file", archivePath, tt.extension)
+			}
+			b, err := ioutil.ReadFile(archivePath)
+			if err != nil {
+				t.Fatalf("unable to read the archive: %v", err)
+			}
+			for _, plaintext := range tt.plaintext {
+				if bytes.Contains(b, []byte(plaintext)) {
+					t.Errorf("the archive on the disk contains %q", plaintext)
+				}
+			}
+		})
+	}
+}
+
+func Test_streamArchive_shouldSendEncryptedArchives(t *testing.T) {
+	p := &pipeline{
+		service:    new(gmail.Service),
+		ms:         &mockMessage{},
+		cont:       &mockMessageContentWithAttachment{},
+		as:         &mockAttachmentWithData{},
+		format:     tarZstFormat,
+		encryption: &encryption{method: encryptionOpenPGP, passphrase: []byte(testPassphrase)},
+	}
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if contentType := w.Header().Get("Content-type"); contentType != pgpContentType {
+		t.Errorf("streamArchive() content type = %v, want %v", contentType, pgpContentType)
+	}
+	want := `attachment; filename="attachments.tar.zst.gpg"`
+	if disposition := w.Header().Get("Content-Disposition"); disposition != want {
+		t.Errorf("streamArchive() content disposition = %v, want %v", disposition, want)
+	}
+}
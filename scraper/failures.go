@@ -0,0 +1,107 @@
+package scraper
+
+import (
+	"encoding/json"
+)
+
+// failuresFileName is the name of the file listing skipped items in an
+// archive.
+const failuresFileName = "errors.json"
+
+type stage string
+
+const (
+	stageList       stage = "list"
+	stageContent    stage = "content"
+	stageAttachment stage = "attachment"
+	stageSave       stage = "save"
+)
+
+// failure describes a message or an attachment that was left out of an
+// archive.
+type failure struct {
+	MessageID string `json:"messageId,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+	Stage     stage  `json:"stage"`
+	Error     string `json:"error"`
+}
+
+// fail handles an error in one of the stages according to the pipeline's
+// error policy. It either aborts the scrape, reporting the error through
+// errorsCh, or skips the item and records it as a failure.
+func (p *pipeline) fail(
+	msg string,
+	err error,
+	s stage,
+	msgID string,
+	fileName string,
+	errorsCh chan *messageError,
+) {
+	if p.onError == skipOnError {
+		p.recordFailure(msg, err, s, msgID, fileName)
+		return
+	}
+	populateErrorChan(msg, err, errorsCh)
+	p.stop()
+}
+
+// recordFailure keeps track of a skipped item and reports it as a progress
+// event.
+func (p *pipeline) recordFailure(
+	msg string,
+	err error,
+	s stage,
+	msgID string,
+	fileName string,
+) {
+	f := failure{
+		MessageID: msgID,
+		Filename:  fileName,
+		Stage:     s,
+		Error:     (&messageError{msg: msg, err: err}).Error(),
+	}
+
+	p.mu.Lock()
+	p.failures = append(p.failures, f)
+	p.mu.Unlock()
+
+	p.progress.publish(progressEvent{
+		Type:      eventError,
+		MessageID: f.MessageID,
+		Filename:  f.Filename,
+		Stage:     f.Stage,
+		Error:     f.Error,
+	})
+}
+
+// failureCount returns the number of items skipped so far.
+func (p *pipeline) failureCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.failures)
+}
+
+// failureList returns the items skipped so far.
+func (p *pipeline) failureList() []failure {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	failures := make([]failure, len(p.failures))
+	copy(failures, p.failures)
+	return failures
+}
+
+// writeFailures adds the list of skipped items to the archive, if any.
+func (p *pipeline) writeFailures(aw ArchiveWriter) error {
+	failures := p.failureList()
+	if len(failures) == 0 {
+		return nil
+	}
+
+	f, err := aw.Create(failuresFileName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(failures)
+}
@@ -0,0 +1,294 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func readFailures(t *testing.T, archive []byte) []failure {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("invalid zip: %v", err)
+	}
+	for _, f := range zr.File {
+		if f.Name != failuresFileName {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unable to open %v: %v", failuresFileName, err)
+		}
+		defer rc.Close()
+
+		var failures []failure
+		if err := json.NewDecoder(rc).Decode(&failures); err != nil {
+			t.Fatalf("invalid %v: %v", failuresFileName, err)
+		}
+		return failures
+	}
+	return nil
+}
+
+type mockAttachmentWithInvalidData struct {
+}
+
+func (a *mockAttachmentWithInvalidData) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	if msgID == "41ff9" {
+		return &gmail.MessagePartBody{Data: "not base64!"}, nil
+	}
+	return &gmail.MessagePartBody{Data: "aGk="}, nil
+}
+
+func Test_run_shouldListSkippedItemsInTheArchive(t *testing.T) {
+	tests := []struct {
+		name string
+		as   attachmentService
+		want failure
+	}{
+		{
+			name: "attachment stage",
+			as:   &mockAttachmentWithPermanentError{},
+			want: failure{
+				MessageID: "fgb",
+				Filename:  "Jan-01-1970-fgb.pdf",
+				Stage:     stageAttachment,
+				Error:     "Unable to retrieve Attachment googleapi: Error 404: Requested entity was not found.",
+			},
+		},
+		{
+			name: "save stage",
+			as:   &mockAttachmentWithInvalidData{},
+			want: failure{
+				MessageID: "41ff9",
+				Filename:  "Jan-01-1970-41ff9.pdf",
+				Stage:     stageSave,
+				Error:     "Unable to decode the attachment illegal base64 data at input byte 3",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &pipeline{
+				service: new(gmail.Service),
+				ms:      &mockMessage{},
+				cont:    &mockMessageContentWithAttachment{},
+				as:      tt.as,
+				onError: skipOnError,
+			}
+
+			var buf bytes.Buffer
+			if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+				t.Fatalf("run() unexpected error: %v", err)
+			}
+
+			got := readFailures(t, buf.Bytes())
+			if !reflect.DeepEqual(got, []failure{tt.want}) {
+				t.Errorf("run() failures = %+v, want %+v", got, []failure{tt.want})
+			}
+		})
+	}
+}
+
+func Test_run_shouldKeepMessagesListedBeforeAPageFailed(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessageWithFetchNextPageError{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+		onError: skipOnError,
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+
+	if p.attachments != 1 {
+		t.Errorf("run() saved %v attachments, want %v", p.attachments, 1)
+	}
+	got := readFailures(t, buf.Bytes())
+	if len(got) != 1 || got[0].Stage != stageList {
+		t.Errorf("run() failures = %+v, want a single list failure", got)
+	}
+}
+
+func Test_run_shouldNotWriteAnEmptyErrorManifest(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+		onError: skipOnError,
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	if got := readFailures(t, buf.Bytes()); got != nil {
+		t.Errorf("run() failures = %+v, want no %v", got, failuresFileName)
+	}
+}
+
+func Test_streamArchive_shouldReportFailedItemsInATrailer(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithPermanentError{},
+		onError: skipOnError,
+	}
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if got := w.Result().Trailer.Get(failedItemsHeader); got != "1" {
+		t.Errorf("streamArchive() %v = %q, want %q", failedItemsHeader, got, "1")
+	}
+}
+
+// mockManyMessages lists the IDs "0" to n-1 on a single page.
+type mockManyMessages struct {
+	n int
+}
+
+func (m *mockManyMessages) fetchMessages(
+	ctx context.Context, service *gmail.Service,
+	query string) (*gmail.ListMessagesResponse, error) {
+	msgs := make([]*gmail.Message, m.n)
+	for i := range msgs {
+		msgs[i] = &gmail.Message{Id: strconv.Itoa(i)}
+	}
+	return &gmail.ListMessagesResponse{Messages: msgs}, nil
+}
+
+func (m *mockManyMessages) fetchNextPage(
+	ctx context.Context, service *gmail.Service,
+	query string,
+	NextPageToken string) (*gmail.ListMessagesResponse, error) {
+	return &gmail.ListMessagesResponse{}, nil
+}
+
+// mockSlowContent returns message "0" right away, failing permanently when
+// failFirst is set, and the other messages once the scrape is aborted or
+// after a while.
+type mockSlowContent struct {
+	failFirst bool
+	calls     int32
+}
+
+func (m *mockSlowContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	atomic.AddInt32(&m.calls, 1)
+	if id == "0" && m.failFirst {
+		return nil, &googleapi.Error{Code: 404, Message: "Requested entity was not found."}
+	}
+	if id != "0" {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return (&mockMessageContentWithAttachment{}).getContent(ctx, service, id)
+}
+
+type failingArchiveWriter struct{}
+
+func (failingArchiveWriter) Create(name string) (io.Writer, error) {
+	return nil, errors.New("disk full")
+}
+
+func (failingArchiveWriter) Close() error {
+	return nil
+}
+
+func Test_run_shouldStopFetchingAfterAFatalError(t *testing.T) {
+	tests := []struct {
+		name      string
+		failFirst bool
+		aw        ArchiveWriter
+	}{
+		{name: "permanent error", failFirst: true, aw: newZipWriter(new(bytes.Buffer))},
+		{name: "archive write error", aw: failingArchiveWriter{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cont := &mockSlowContent{failFirst: tt.failFirst}
+			p := &pipeline{
+				service: new(gmail.Service),
+				ms:      &mockManyMessages{n: 500},
+				cont:    cont,
+				as:      &mockAttachmentWithData{},
+				onError: failOnError,
+				limits:  limits{contentWorkers: 4, attachmentWorkers: 2},
+			}
+
+			if err := p.run("from:test@mail.com", tt.aw); err == nil {
+				t.Fatalf("run() expected an error")
+			}
+			// Message "0" and a call in flight on each of the 4 workers when
+			// the scrape was aborted, but none after.
+			if calls := atomic.LoadInt32(&cont.calls); calls > 5 {
+				t.Errorf("run() fetched %v messages, want at most %v", calls, 5)
+			}
+		})
+	}
+}
+
+// closeRecordingWriter records whether the archive was finalized.
+type closeRecordingWriter struct {
+	ArchiveWriter
+	closed bool
+}
+
+func (w *closeRecordingWriter) Close() error {
+	w.closed = true
+	return w.ArchiveWriter.Close()
+}
+
+func Test_run_shouldNotFinalizeTheArchiveAfterAFatalError(t *testing.T) {
+	p := &pipeline{
+		service:  new(gmail.Service),
+		ms:       &mockManyMessages{n: 20},
+		cont:     &mockSlowContent{failFirst: true},
+		as:       &mockAttachmentWithData{},
+		onError:  failOnError,
+		limits:   limits{contentWorkers: 4, attachmentWorkers: 2},
+		progress: newProgress(),
+	}
+	aw := &closeRecordingWriter{ArchiveWriter: newZipWriter(new(bytes.Buffer))}
+
+	if err := p.run("from:test@mail.com", aw); err == nil {
+		t.Fatalf("run() expected an error")
+	}
+	if aw.closed {
+		t.Errorf("run() finalized the archive of a failed scrape")
+	}
+	events, _, _ := p.progress.since(0)
+	for _, e := range events {
+		if e.Type == eventArchiveFinalized {
+			t.Errorf("run() published %v for a failed scrape", e.Type)
+		}
+	}
+	if last := events[len(events)-1]; last.Type != eventError {
+		t.Errorf("run() last event = %v, want %v", last.Type, eventError)
+	}
+}
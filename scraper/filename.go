@@ -0,0 +1,118 @@
+package scraper
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxFileNameLength is the longest name, in bytes, most file systems accept
+// for a single file.
+const maxFileNameLength = 255
+
+var (
+	errEmptyFileName     = errors.New("the file name is empty")
+	errAbsoluteFileName  = errors.New("the file name is an absolute path")
+	errTraversalFileName = errors.New("the file name escapes the archive")
+)
+
+// windowsReservedNames can't be used as file names on Windows, whatever
+// their extension.
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFileName turns the name an email gives an attachment into a single
+// file name that is safe to extract on any system. Absolute paths and names
+// climbing out of a directory are rejected, anything else is normalized to
+// NFC and stripped of control, separator and reserved characters.
+func sanitizeFileName(name string) (string, error) {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+
+	slashed := strings.Replace(name, `\`, "/", -1)
+	if strings.HasPrefix(slashed, "/") || hasVolumeName(slashed) {
+		return "", errAbsoluteFileName
+	}
+	for _, segment := range strings.Split(slashed, "/") {
+		if strings.TrimSpace(segment) == ".." {
+			return "", errTraversalFileName
+		}
+	}
+
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsControl(r):
+			return -1
+		case strings.ContainsRune(`/\<>:"|?*`, r):
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimLeft(name, " ")
+	name = strings.TrimRight(name, " .")
+	if len(name) == 0 {
+		return "", errEmptyFileName
+	}
+
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	if windowsReservedNames[strings.ToUpper(strings.TrimRight(strings.SplitN(name, ".", 2)[0], " "))] {
+		base = "_" + base
+	}
+	if len(ext) > maxFileNameLength/2 {
+		ext = ""
+	}
+	return truncate(base, maxFileNameLength-len(ext)) + ext, nil
+}
+
+// hasVolumeName reports whether name starts with a Windows drive letter.
+func hasVolumeName(name string) bool {
+	return len(name) >= 2 && name[1] == ':' &&
+		('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z')
+}
+
+// truncate shortens s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// fileNames hands out the names of the files of an archive, so that no two
+// attachments overwrite each other. Names are compared case-insensitively
+// since archives are often extracted on case-insensitive file systems.
+type fileNames map[string]bool
+
+func newFileNames(reserved ...string) fileNames {
+	n := make(fileNames)
+	for _, name := range reserved {
+		n[strings.ToLower(name)] = true
+	}
+	return n
+}
+
+// unique returns name if it is free, otherwise the first free name among
+// "name (2).ext", "name (3).ext" and so on.
+func (n fileNames) unique(name string) string {
+	candidate := name
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; n[strings.ToLower(candidate)]; i++ {
+		candidate = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	n[strings.ToLower(candidate)] = true
+	return candidate
+}
@@ -0,0 +1,256 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_sanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    string
+		wantErr error
+	}{
+		{name: "plain name", input: "invoice.pdf", want: "invoice.pdf"},
+		{name: "unicode is normalized to NFC", input: "cafe\u0301.pdf", want: "caf\u00e9.pdf"},
+		{name: "invalid utf-8", input: "bad\xffname.txt", want: "bad_name.txt"},
+		{name: "control characters", input: "in\x00vo\nice\t.pdf", want: "invoice.pdf"},
+		{name: "separators", input: "reports/2019\\q4.pdf", want: "reports_2019_q4.pdf"},
+		{name: "reserved characters", input: `a<b>c:d"e|f?g*.pdf`, want: "a_b_c_d_e_f_g_.pdf"},
+		{name: "trailing dots and spaces", input: " invoice.pdf. . ", want: "invoice.pdf"},
+		{name: "dots inside a name", input: "v1..2.pdf", want: "v1..2.pdf"},
+		{name: "windows reserved name", input: "CON", want: "_CON"},
+		{name: "windows reserved name with extensions", input: "lpt1.tar.gz", want: "_lpt1.tar.gz"},
+		{name: "name starting like a reserved name", input: "console.log", want: "console.log"},
+		{name: "long name keeps its extension", input: strings.Repeat("a", 300) + ".pdf", want: strings.Repeat("a", 251) + ".pdf"},
+		{name: "long name isn't cut inside a character", input: strings.Repeat("é", 200) + ".pdf", want: strings.Repeat("é", 125) + ".pdf"},
+		{name: "parent directory", input: "../../etc/passwd", wantErr: errTraversalFileName},
+		{name: "parent directory in the middle", input: "a/../../b.pdf", wantErr: errTraversalFileName},
+		{name: "windows parent directory", input: `..\..\boot.ini`, wantErr: errTraversalFileName},
+		{name: "absolute path", input: "/etc/passwd", wantErr: errAbsoluteFileName},
+		{name: "windows absolute path", input: `\\server\share\a.pdf`, wantErr: errAbsoluteFileName},
+		{name: "drive letter", input: "C:\\Windows\\a.dll", wantErr: errAbsoluteFileName},
+		{name: "empty", input: "", wantErr: errEmptyFileName},
+		{name: "only dots", input: "..", wantErr: errTraversalFileName},
+		{name: "current directory", input: ".", wantErr: errEmptyFileName},
+		{name: "only control characters", input: "\x01\x02", wantErr: errEmptyFileName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sanitizeFileName(tt.input)
+			if err != tt.wantErr {
+				t.Fatalf("sanitizeFileName(%q) error = %v, want %v", tt.input, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("sanitizeFileName(%q) = %q, want %q", tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_fileNames_unique(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved []string
+		inputs   []string
+		want     []string
+	}{
+		{
+			name:   "distinct names are kept",
+			inputs: []string{"a.pdf", "b.pdf"},
+			want:   []string{"a.pdf", "b.pdf"},
+		},
+		{
+			name:   "collisions are numbered",
+			inputs: []string{"name.pdf", "name.pdf", "name.pdf"},
+			want:   []string{"name.pdf", "name (2).pdf", "name (3).pdf"},
+		},
+		{
+			name:   "collisions ignore case",
+			inputs: []string{"Name.PDF", "name.pdf"},
+			want:   []string{"Name.PDF", "name (2).pdf"},
+		},
+		{
+			name:   "numbered names already taken are skipped",
+			inputs: []string{"name (2).pdf", "name.pdf", "name.pdf"},
+			want:   []string{"name (2).pdf", "name.pdf", "name (3).pdf"},
+		},
+		{
+			name:   "names without an extension",
+			inputs: []string{"README", "README"},
+			want:   []string{"README", "README (2)"},
+		},
+		{
+			name:     "reserved names",
+			reserved: []string{manifestCSVFileName},
+			inputs:   []string{"manifest.csv"},
+			want:     []string{"manifest (2).csv"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := newFileNames(tt.reserved...)
+			var got []string
+			for _, input := range tt.inputs {
+				got = append(got, names.unique(input))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unique() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type mockMessageContentWithSameNames struct {
+}
+
+func (m *mockMessageContentWithSameNames) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	gm := gmail.Message{
+		Id: id,
+		Payload: &gmail.MessagePart{
+			Parts: []*gmail.MessagePart{
+				{
+					PartId:   "1",
+					Filename: "../invoice.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "first"},
+				},
+				{
+					PartId:   "2",
+					Filename: "invoice.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "second"},
+				},
+				{
+					PartId:   "3",
+					Filename: "invoice.pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "third"},
+				},
+			},
+		},
+	}
+	return &gm, nil
+}
+
+func Test_run_shouldNotOverwriteAttachmentsWithTheSameName(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessageWithFetchNextPageError{},
+		cont:    &mockMessageContentWithSameNames{},
+		as:      &mockAttachmentWithData{},
+		onError: skipOnError,
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("run() wrote an invalid zip: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, f := range attachmentFiles(zr) {
+		if seen[f.Name] {
+			t.Errorf("run() wrote %v twice", f.Name)
+		}
+		if strings.Contains(f.Name, "..") || strings.Contains(f.Name, "/") {
+			t.Errorf("run() wrote an unsafe name %v", f.Name)
+		}
+		seen[f.Name] = true
+		names = append(names, f.Name)
+	}
+	if len(names) != 3 {
+		t.Errorf("run() wrote %v, want %v files", names, 3)
+	}
+}
+
+// mockLateFirstContent gives every message the same two attachment names
+// and returns the messages listed first last.
+type mockLateFirstContent struct {
+	n int
+}
+
+func (m *mockLateFirstContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	i, _ := strconv.Atoi(id)
+	time.Sleep(time.Duration(m.n-i) * time.Millisecond)
+	gm := gmail.Message{
+		Id:           id,
+		InternalDate: 1577836800000,
+		Payload: &gmail.MessagePart{
+			Parts: []*gmail.MessagePart{
+				{PartId: "1", Filename: "invoice.pdf", Body: &gmail.MessagePartBody{AttachmentId: "1"}},
+				{PartId: "2", Filename: "invoice.pdf", Body: &gmail.MessagePartBody{AttachmentId: "2"}},
+			},
+		},
+	}
+	return &gm, nil
+}
+
+// mockLateFirstAttachment returns the attachments of the messages listed
+// first last, their content naming the message and the part.
+type mockLateFirstAttachment struct {
+	n int
+}
+
+func (a *mockLateFirstAttachment) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	i, _ := strconv.Atoi(msgID)
+	time.Sleep(time.Duration(a.n-i) * time.Millisecond)
+	return &gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString([]byte(msgID + "/" + attachID)),
+	}, nil
+}
+
+func Test_run_shouldNumberAttachmentsWithTheSameNameInTheOrderOfTheMessages(t *testing.T) {
+	const n = 8
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockManyMessages{n: n},
+		cont:    &mockLateFirstContent{n: n},
+		as:      &mockLateFirstAttachment{n: n},
+		limits:  limits{contentWorkers: 4, attachmentWorkers: 4},
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("run() wrote an invalid zip: %v", err)
+	}
+
+	got := make(map[string]string)
+	for _, f := range attachmentFiles(zr) {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("unable to open %v: %v", f.Name, err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		got[f.Name] = string(data)
+	}
+	want := map[string]string{"Jan-01-2020-invoice.pdf": "0/1"}
+	for i := 1; i < 2*n; i++ {
+		name := "Jan-01-2020-invoice (" + strconv.Itoa(i+1) + ").pdf"
+		want[name] = strconv.Itoa(i/2) + "/" + strconv.Itoa(i%2+1)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("run() = %v, want %v", got, want)
+	}
+}
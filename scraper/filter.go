@@ -0,0 +1,254 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// dateLayout is the layout of the after and before dates accepted in a
+// filter. Gmail itself expects dates as yyyy/mm/dd.
+const dateLayout = "2006-01-02"
+
+var extensionPattern = regexp.MustCompile(`^[A-Za-z0-9]+$`)
+
+// filter selects the messages a scrape looks at. It can be sent as a JSON
+// body or as query parameters and is compiled into a Gmail search query.
+type filter struct {
+	From           []string `json:"from,omitempty"`
+	To             string   `json:"to,omitempty"`
+	After          string   `json:"after,omitempty"`
+	Before         string   `json:"before,omitempty"`
+	Label          string   `json:"label,omitempty"`
+	Subject        string   `json:"subject,omitempty"`
+	HasAttachment  bool     `json:"hasAttachment,omitempty"`
+	FileExtensions []string `json:"filename,omitempty"`
+	LargerThan     int64    `json:"largerThan,omitempty"`
+	SmallerThan    int64    `json:"smallerThan,omitempty"`
+}
+
+// filterFromRequest reads a filter from the JSON body of r or, for any other
+// content type, from its query and form parameters. emailThatSentAttach is
+// still accepted as a sender so existing clients keep working.
+func filterFromRequest(r *http.Request) (*filter, error) {
+	f := new(filter)
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(f); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("invalid filter: %v", err)
+		}
+		f.From = formValues(r, "from")
+		f.To = r.Form.Get("to")
+		f.After = r.Form.Get("after")
+		f.Before = r.Form.Get("before")
+		f.Label = r.Form.Get("label")
+		f.Subject = r.Form.Get("subject")
+		f.HasAttachment = r.Form.Get("hasAttachment") == "true"
+		f.FileExtensions = formValues(r, "filename")
+
+		var err error
+		if f.LargerThan, err = formSize(r, "largerThan"); err != nil {
+			return nil, err
+		}
+		if f.SmallerThan, err = formSize(r, "smallerThan"); err != nil {
+			return nil, err
+		}
+	}
+
+	if email := r.FormValue("emailThatSentAttach"); len(email) != 0 {
+		f.From = append(f.From, email)
+	}
+
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// formValues returns every value of key, which may be repeated or hold a
+// comma-separated list.
+func formValues(r *http.Request, key string) []string {
+	var values []string
+	for _, v := range r.Form[key] {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); len(s) != 0 {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+func formSize(r *http.Request, key string) (int64, error) {
+	v := r.Form.Get(key)
+	if len(v) == 0 {
+		return 0, nil
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid filter: %s must be a number of bytes", key)
+	}
+	return size, nil
+}
+
+func (f *filter) validate() error {
+	if f.empty() {
+		return errors.New("invalid filter: at least one search criterion is required")
+	}
+
+	for _, from := range f.From {
+		if len(cleanTerm(from)) == 0 {
+			return errors.New("invalid filter: from contains an empty sender")
+		}
+	}
+	for _, term := range []struct{ name, value string }{
+		{"to", f.To}, {"label", f.Label}, {"subject", f.Subject},
+	} {
+		if len(term.value) != 0 && len(cleanTerm(term.value)) == 0 {
+			return fmt.Errorf("invalid filter: %s can't be empty", term.name)
+		}
+	}
+
+	after, err := parseFilterDate("after", f.After)
+	if err != nil {
+		return err
+	}
+	before, err := parseFilterDate("before", f.Before)
+	if err != nil {
+		return err
+	}
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return errors.New("invalid filter: after must be earlier than before")
+	}
+
+	for _, ext := range f.FileExtensions {
+		if !extensionPattern.MatchString(strings.TrimPrefix(ext, ".")) {
+			return fmt.Errorf("invalid filter: %q is not a file extension", ext)
+		}
+	}
+
+	if f.LargerThan < 0 || f.SmallerThan < 0 {
+		return errors.New("invalid filter: sizes can't be negative")
+	}
+	if f.LargerThan > 0 && f.SmallerThan > 0 && f.LargerThan >= f.SmallerThan {
+		return errors.New("invalid filter: largerThan must be less than smallerThan")
+	}
+
+	return nil
+}
+
+func (f *filter) empty() bool {
+	return len(f.From) == 0 && len(f.To) == 0 && len(f.After) == 0 &&
+		len(f.Before) == 0 && len(f.Label) == 0 && len(f.Subject) == 0 &&
+		!f.HasAttachment && len(f.FileExtensions) == 0 &&
+		f.LargerThan == 0 && f.SmallerThan == 0
+}
+
+func parseFilterDate(name, value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid filter: %s must be a date like %s", name, dateLayout)
+	}
+	return t, nil
+}
+
+// query compiles the filter into a Gmail search query. Criteria are ANDed
+// together; multiple senders or extensions match any of them.
+func (f *filter) query() string {
+	var terms []string
+
+	terms = appendAnyOf(terms, "from", f.From)
+	if len(f.To) != 0 {
+		terms = append(terms, "to:"+quoteTerm(f.To))
+	}
+	if len(f.After) != 0 {
+		terms = append(terms, "after:"+gmailDate(f.After))
+	}
+	if len(f.Before) != 0 {
+		terms = append(terms, "before:"+gmailDate(f.Before))
+	}
+	if len(f.Label) != 0 {
+		terms = append(terms, "label:"+quoteTerm(f.Label))
+	}
+	if len(f.Subject) != 0 {
+		terms = append(terms, "subject:"+quoteTerm(f.Subject))
+	}
+	if f.HasAttachment {
+		terms = append(terms, "has:attachment")
+	}
+
+	extensions := make([]string, len(f.FileExtensions))
+	for i, ext := range f.FileExtensions {
+		extensions[i] = strings.ToLower(strings.TrimPrefix(ext, "."))
+	}
+	terms = appendAnyOf(terms, "filename", extensions)
+
+	if f.LargerThan > 0 {
+		terms = append(terms, "larger:"+strconv.FormatInt(f.LargerThan, 10))
+	}
+	if f.SmallerThan > 0 {
+		terms = append(terms, "smaller:"+strconv.FormatInt(f.SmallerThan, 10))
+	}
+
+	return strings.Join(terms, " ")
+}
+
+// appendAnyOf appends a term matching any of values for operator, grouping
+// them in braces when there is more than one.
+func appendAnyOf(terms []string, operator string, values []string) []string {
+	if len(values) == 0 {
+		return terms
+	}
+
+	alternatives := make([]string, len(values))
+	for i, v := range values {
+		alternatives[i] = operator + ":" + quoteTerm(v)
+	}
+	if len(alternatives) == 1 {
+		return append(terms, alternatives[0])
+	}
+	return append(terms, "{"+strings.Join(alternatives, " ")+"}")
+}
+
+func gmailDate(value string) string {
+	t, _ := time.Parse(dateLayout, value)
+	return t.Format("2006/01/02")
+}
+
+// cleanTerm drops double quotes, which Gmail can't escape, and control
+// characters from a search value.
+func cleanTerm(value string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '"' || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, value))
+}
+
+// quoteTerm makes value safe to use as the argument of a search operator.
+// Values that contain spaces or search syntax are quoted so they are
+// matched literally.
+func quoteTerm(value string) string {
+	value = cleanTerm(value)
+	if strings.ContainsAny(value, " \t(){}") || strings.HasPrefix(value, "-") ||
+		value == "OR" || value == "AND" {
+		return `"` + value + `"`
+	}
+	return value
+}
@@ -0,0 +1,190 @@
+package scraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testFilter = &filter{From: []string{"test@mail.com"}}
+
+func Test_filter_query(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter filter
+		want   string
+	}{
+		{
+			name:   "single sender",
+			filter: filter{From: []string{"test@mail.com"}},
+			want:   "from:test@mail.com",
+		},
+		{
+			name:   "multiple senders match any of them",
+			filter: filter{From: []string{"a@mail.com", "b@mail.com"}},
+			want:   "{from:a@mail.com from:b@mail.com}",
+		},
+		{
+			name: "criteria are combined",
+			filter: filter{
+				From:           []string{"billing@vendor.com"},
+				To:             "me@mail.com",
+				After:          "2019-01-01",
+				Before:         "2019-12-31",
+				Label:          "invoices",
+				Subject:        "receipt",
+				HasAttachment:  true,
+				FileExtensions: []string{".PDF", "docx"},
+				LargerThan:     1000,
+				SmallerThan:    5000000,
+			},
+			want: "from:billing@vendor.com to:me@mail.com after:2019/01/01 before:2019/12/31 " +
+				"label:invoices subject:receipt has:attachment {filename:pdf filename:docx} " +
+				"larger:1000 smaller:5000000",
+		},
+		{
+			name:   "values with spaces are quoted",
+			filter: filter{Subject: "monthly invoice", Label: "My Label"},
+			want:   `label:"My Label" subject:"monthly invoice"`,
+		},
+		{
+			name:   "search syntax is quoted",
+			filter: filter{From: []string{"-spam@mail.com"}, Subject: "(urgent) {now}"},
+			want:   `from:"-spam@mail.com" subject:"(urgent) {now}"`,
+		},
+		{
+			name:   "operators are quoted",
+			filter: filter{Subject: "OR"},
+			want:   `subject:"OR"`,
+		},
+		{
+			name:   "double quotes and control characters are dropped",
+			filter: filter{Subject: "say \"hi\"\n now"},
+			want:   `subject:"say hi now"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.query(); got != tt.want {
+				t.Errorf("query() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_filter_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  filter
+		wantErr string
+	}{
+		{
+			name:    "empty filter",
+			filter:  filter{},
+			wantErr: "invalid filter: at least one search criterion is required",
+		},
+		{
+			name:    "empty sender",
+			filter:  filter{From: []string{`""`}},
+			wantErr: "invalid filter: from contains an empty sender",
+		},
+		{
+			name:    "empty subject",
+			filter:  filter{HasAttachment: true, Subject: " \"\" "},
+			wantErr: "invalid filter: subject can't be empty",
+		},
+		{
+			name:    "bad date",
+			filter:  filter{After: "01/02/2019"},
+			wantErr: "invalid filter: after must be a date like 2006-01-02",
+		},
+		{
+			name:    "dates out of order",
+			filter:  filter{After: "2019-02-01", Before: "2019-01-01"},
+			wantErr: "invalid filter: after must be earlier than before",
+		},
+		{
+			name:    "bad extension",
+			filter:  filter{FileExtensions: []string{"pdf OR x"}},
+			wantErr: `invalid filter: "pdf OR x" is not a file extension`,
+		},
+		{
+			name:    "negative size",
+			filter:  filter{LargerThan: -1},
+			wantErr: "invalid filter: sizes can't be negative",
+		},
+		{
+			name:    "sizes out of order",
+			filter:  filter{LargerThan: 10, SmallerThan: 5},
+			wantErr: "invalid filter: largerThan must be less than smallerThan",
+		},
+		{
+			name:   "valid filter",
+			filter: filter{From: []string{"test@mail.com"}, After: "2019-01-01", FileExtensions: []string{".pdf"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validate() unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validate() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_filterFromRequest_shouldReadQueryParameters(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet,
+		"/download/attachment?from=a@mail.com,b@mail.com&from=c@mail.com&after=2019-01-01"+
+			"&hasAttachment=true&filename=pdf&largerThan=100&emailThatSentAttach=d@mail.com", nil)
+
+	f, err := filterFromRequest(r)
+	if err != nil {
+		t.Fatalf("filterFromRequest() unexpected error: %v", err)
+	}
+
+	want := &filter{
+		From:           []string{"a@mail.com", "b@mail.com", "c@mail.com", "d@mail.com"},
+		After:          "2019-01-01",
+		HasAttachment:  true,
+		FileExtensions: []string{"pdf"},
+		LargerThan:     100,
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("filterFromRequest() = %+v, want %+v", f, want)
+	}
+}
+
+func Test_filterFromRequest_shouldReadJSONBody(t *testing.T) {
+	body := `{"from": ["a@mail.com"], "subject": "invoice", "smallerThan": 2048}`
+	r := httptest.NewRequest(http.MethodPost, "/jobs", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json; charset=utf-8")
+
+	f, err := filterFromRequest(r)
+	if err != nil {
+		t.Fatalf("filterFromRequest() unexpected error: %v", err)
+	}
+
+	want := &filter{From: []string{"a@mail.com"}, Subject: "invoice", SmallerThan: 2048}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("filterFromRequest() = %+v, want %+v", f, want)
+	}
+}
+
+func Test_filterFromRequest_shouldRejectInvalidSizes(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/download/attachment?from=a@mail.com&largerThan=big", nil)
+
+	_, err := filterFromRequest(r)
+	expected := "invalid filter: largerThan must be a number of bytes"
+	if err == nil || err.Error() != expected {
+		t.Errorf("filterFromRequest() = %v, want %v", err, expected)
+	}
+}
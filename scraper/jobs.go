@@ -0,0 +1,399 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/mux"
+)
+
+type jobState string
+
+const (
+	jobQueued    jobState = "queued"
+	jobRunning   jobState = "running"
+	jobSucceeded jobState = "succeeded"
+	jobFailed    jobState = "failed"
+)
+
+const (
+	// jobWorkers is the number of scrape jobs that may run at the same time.
+	jobWorkers = 2
+	// jobQueueSize is the number of jobs that may wait for a worker.
+	jobQueueSize = 100
+	// jobTTL is how long a finished job and its archive are kept.
+	jobTTL = time.Hour
+	// jobSweepInterval is how often the expired jobs are forgotten.
+	jobSweepInterval = 5 * time.Minute
+)
+
+var errJobQueueFull = errors.New("too many scrape jobs are queued, try again later")
+
+var jobs = newJobStore(jobWorkers)
+
+func init() {
+	go jobs.sweepEvery(jobSweepInterval)
+}
+
+// job is a scrape that runs in the background, outside the lifecycle of the
+// request that created it.
+type job struct {
+	mu          sync.Mutex
+	id          string
+	owner       string
+	filter      *filter
+	state       jobState
+	err         string
+	createdAt   time.Time
+	finishedAt  time.Time
+	archivePath string
+	// url links to the archive in the pipeline's sink, if any.
+	url string
+
+	p *pipeline
+}
+
+type jobStatus struct {
+	ID          string      `json:"id"`
+	State       jobState    `json:"state"`
+	Filter      *filter     `json:"filter"`
+	Messages    int64       `json:"messages"`
+	Attachments int64       `json:"attachments"`
+	Format      string      `json:"format"`
+	Directory   string      `json:"directory,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Sync        *syncResult `json:"sync,omitempty"`
+	Failed      int         `json:"failed"`
+	SavedBytes  int64       `json:"deduplicatedBytes"`
+	Error       string      `json:"error,omitempty"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	FinishedAt  *time.Time  `json:"finishedAt,omitempty"`
+}
+
+func newJob(owner string, f *filter, p *pipeline) *job {
+	return &job{
+		id:        uniuri.New(),
+		owner:     owner,
+		filter:    f,
+		state:     jobQueued,
+		createdAt: time.Now(),
+		p:         p,
+	}
+}
+
+func (j *job) status() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobStatus{
+		ID:          j.id,
+		State:       j.state,
+		Filter:      j.filter,
+		Messages:    atomic.LoadInt64(&j.p.messages),
+		Attachments: atomic.LoadInt64(&j.p.attachments),
+		Format:      j.p.archiveFormat().name,
+		Failed:      j.p.failureCount(),
+		SavedBytes:  atomic.LoadInt64(&j.p.savedBytes),
+		URL:         j.url,
+		Sync:        j.p.lastSync(),
+		Error:       j.err,
+		CreatedAt:   j.createdAt,
+	}
+	if j.p.archiveFormat() == directoryFormat && j.state == jobSucceeded {
+		s.Directory = j.archivePath
+	}
+	if !j.finishedAt.IsZero() {
+		finishedAt := j.finishedAt
+		s.FinishedAt = &finishedAt
+	}
+	return s
+}
+
+func (j *job) setState(state jobState) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.state = state
+}
+
+// execute runs the job's pipeline, writing its archive to a temporary file
+// or, with the dir format, its files to a directory of archiveDirectory. Its
+// webhook, if any, is notified once it has finished.
+func (j *job) execute() {
+	j.setState(jobRunning)
+	defer j.notify()
+
+	err := j.writeArchive()
+	if err == nil && j.p.sink != nil {
+		err = j.store()
+	}
+	if err == nil && (j.p.sink != nil || j.p.archiveFormat() == directoryFormat) {
+		// The archive was stored in the sink or its files are on the
+		// server. One kept for download is only delivered once
+		// GetJobArchive has served it whole.
+		j.p.commitSync()
+	}
+	defer j.p.progress.close()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finishedAt = time.Now()
+	if err != nil {
+		j.state = jobFailed
+		j.err = err.Error()
+		return
+	}
+	j.state = jobSucceeded
+}
+
+func (j *job) writeArchive() error {
+	format := j.p.archiveFormat()
+	if format == directoryFormat {
+		return j.writeDirectory()
+	}
+
+	outFile, err := ioutil.TempFile("", "attachments-"+j.id+"-*"+j.p.extension())
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	err = j.p.writeArchive(outFile, func(aw ArchiveWriter) error {
+		return j.p.run(j.filter.query(), aw)
+	})
+	if err != nil {
+		os.Remove(outFile.Name())
+		return err
+	}
+
+	j.mu.Lock()
+	j.archivePath = outFile.Name()
+	j.mu.Unlock()
+	return nil
+}
+
+// store sends the job's archive to the pipeline's sink.
+func (j *job) store() error {
+	archivePath, _ := j.archive()
+	link, err := storeArchive(j.p, archivePath)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	j.url = link
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *job) writeDirectory() error {
+	root := filepath.Join(archiveDirectory, j.id)
+	aw, err := newDirectoryWriter(root)
+	if err != nil {
+		return err
+	}
+	// Closes the last file if the pipeline failed before finishing.
+	defer aw.Close()
+
+	if err := j.p.run(j.filter.query(), aw); err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+
+	j.mu.Lock()
+	j.archivePath = root
+	j.mu.Unlock()
+	return nil
+}
+
+// archive returns the path of the job's archive once it has succeeded.
+func (j *job) archive() (string, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.archivePath, j.state == jobSucceeded
+}
+
+func (j *job) expired(now time.Time) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return !j.finishedAt.IsZero() && now.Sub(j.finishedAt) > jobTTL
+}
+
+// cleanup removes the job's archive from the disk. Directories are left for
+// whoever picks the files up.
+func (j *job) cleanup() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.archivePath != "" && j.p.archiveFormat() != directoryFormat {
+		os.Remove(j.archivePath)
+		j.archivePath = ""
+	}
+}
+
+// jobStore keeps track of scrape jobs and runs them on a fixed number of
+// workers.
+type jobStore struct {
+	mu    sync.Mutex
+	jobs  map[string]*job
+	queue chan *job
+}
+
+func newJobStore(workers int) *jobStore {
+	s := &jobStore{
+		jobs:  make(map[string]*job),
+		queue: make(chan *job, jobQueueSize),
+	}
+	for i := 0; i < workers; i++ {
+		go s.work()
+	}
+	return s
+}
+
+func (s *jobStore) work() {
+	for j := range s.queue {
+		j.execute()
+	}
+}
+
+// enqueue registers j and schedules it to run on the next free worker.
+func (s *jobStore) enqueue(j *job) error {
+	s.sweep(time.Now())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case s.queue <- j:
+		s.jobs[j.id] = j
+		return nil
+	default:
+		return errJobQueueFull
+	}
+}
+
+// get returns the job with id if it belongs to owner.
+func (s *jobStore) get(id, owner string) (*job, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j, ok := s.jobs[id]
+	if !ok || j.owner != owner {
+		return nil, false
+	}
+	return j, true
+}
+
+// sweep forgets jobs that finished more than jobTTL ago.
+func (s *jobStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, j := range s.jobs {
+		if j.expired(now) {
+			j.cleanup()
+			delete(s.jobs, id)
+		}
+	}
+}
+
+func (s *jobStore) sweepEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.sweep(time.Now())
+	}
+}
+
+// CreateJob enqueues a scrape of attachments in mails matching a filter and
+// responds with the job that will run it.
+func CreateJob(w http.ResponseWriter, r *http.Request) {
+	p, claim, err := pipelineFromRequest(r)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	f, err := filterFromRequest(r)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	if err := p.configure(r); err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	j := newJob(claim.RandomID, f, p)
+	if err := jobs.enqueue(j); err != nil {
+		errorResponseWithStatus(w, http.StatusServiceUnavailable, err.Error())
+		return //nolint
+	}
+
+	w.Header().Set("Location", "/jobs/"+j.id)
+	jsonResponse(w, http.StatusAccepted, j.status())
+}
+
+// GetJob reports the state of a scrape job.
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobFromRequest(w, r, claimFromRequest)
+	if !ok {
+		return
+	}
+	jsonResponse(w, http.StatusOK, j.status())
+}
+
+// GetJobArchive downloads the archive of a succeeded scrape job. The sync of
+// the job, if any, moves on once the whole archive was downloaded.
+func GetJobArchive(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobFromRequest(w, r, claimFromRequest)
+	if !ok {
+		return
+	}
+
+	archivePath, ok := j.archive()
+	if !ok {
+		errorResponseWithStatus(w, http.StatusConflict, "job has not succeeded")
+		return //nolint
+	}
+
+	format := j.p.archiveFormat()
+	if format == directoryFormat {
+		errorResponseWithStatus(w, http.StatusConflict, "the job's files are in a directory on the server")
+		return //nolint
+	}
+
+	w.Header().Set("Content-type", j.p.contentType())
+	setResultHeaders(w.Header(), j.p)
+	serveArchive(w, r, j.p, archivePath)
+}
+
+// jobFromRequest returns the job of the request's path, if it belongs to
+// the user claims authenticates.
+func jobFromRequest(
+	w http.ResponseWriter,
+	r *http.Request,
+	claims func(*http.Request) (*oauth.Claims, error),
+) (*job, bool) {
+	claim, err := claims(r)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return nil, false
+	}
+
+	j, ok := jobs.get(mux.Vars(r)["id"], claim.RandomID)
+	if !ok {
+		errorResponseWithStatus(w, http.StatusNotFound, "job not found")
+		return nil, false
+	}
+	return j, true
+}
+
+func jsonResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v) // nolint
+}
@@ -0,0 +1,174 @@
+package scraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"google.golang.org/api/gmail/v1"
+)
+
+func newTestJwtToken(t *testing.T, randomID string) string {
+	claims := &oauth.Claims{
+		RandomID: randomID,
+		StandardClaims: jwt.StandardClaims{
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).
+		SignedString([]byte(os.Getenv("JWT_SECRET_KEY")))
+	if err != nil {
+		t.Fatalf("unable to sign jwt token: %v", err)
+	}
+	return token
+}
+
+func newTestPipeline(ms messageSevice) *pipeline {
+	return &pipeline{
+		service: new(gmail.Service),
+		ms:      ms,
+		cont:    &mockMessageContent{},
+		as:      &mockAttachment{},
+	}
+}
+
+func Test_job_execute_shouldSucceed(t *testing.T) {
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	j.execute()
+	defer j.cleanup()
+
+	status := j.status()
+	if status.State != jobSucceeded {
+		t.Fatalf("execute() state = %v, want %v (%v)", status.State, jobSucceeded, status.Error)
+	}
+	if status.Messages != 5 {
+		t.Errorf("execute() messages = %v, want %v", status.Messages, 5)
+	}
+	if status.FinishedAt == nil {
+		t.Errorf("execute() expected finishedAt to be set")
+	}
+
+	archivePath, ok := j.archive()
+	if !ok {
+		t.Fatalf("archive() expected the archive to be available")
+	}
+	if _, err := os.Stat(archivePath); err != nil {
+		t.Errorf("archive() = %v, expected the file to exist", archivePath)
+	}
+}
+
+func Test_job_execute_shouldFail(t *testing.T) {
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessageWithFetchMessagesError{}))
+	j.execute()
+
+	status := j.status()
+	if status.State != jobFailed {
+		t.Errorf("execute() state = %v, want %v", status.State, jobFailed)
+	}
+	expected := "Unable to retrieve Messages Couldn't fetch messages"
+	if status.Error != expected {
+		t.Errorf("execute() error = %v, want %v", status.Error, expected)
+	}
+	if _, ok := j.archive(); ok {
+		t.Errorf("archive() expected no archive for a failed job")
+	}
+}
+
+func Test_jobStore_get_shouldOnlyReturnJobsOfOwner(t *testing.T) {
+	s := newJobStore(0)
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	if err := s.enqueue(j); err != nil {
+		t.Fatalf("enqueue() unexpected error: %v", err)
+	}
+
+	if _, ok := s.get(j.id, "owner"); !ok {
+		t.Errorf("get() expected the job to be found for its owner")
+	}
+	if _, ok := s.get(j.id, "someone-else"); ok {
+		t.Errorf("get() expected the job to be hidden from other users")
+	}
+}
+
+func Test_jobStore_sweep_shouldForgetExpiredJobs(t *testing.T) {
+	s := newJobStore(0)
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	if err := s.enqueue(j); err != nil {
+		t.Fatalf("enqueue() unexpected error: %v", err)
+	}
+	j.execute()
+	archivePath, _ := j.archive()
+
+	s.sweep(time.Now().Add(jobTTL + time.Minute))
+
+	if _, ok := s.get(j.id, "owner"); ok {
+		t.Errorf("sweep() expected the job to be forgotten")
+	}
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Errorf("sweep() expected %v to be removed", archivePath)
+	}
+}
+
+func Test_jobStore_sweepEvery_shouldRemoveExpiredArchives(t *testing.T) {
+	s := newJobStore(0)
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	if err := s.enqueue(j); err != nil {
+		t.Fatalf("enqueue() unexpected error: %v", err)
+	}
+	j.execute()
+	archivePath, _ := j.archive()
+	j.mu.Lock()
+	j.finishedAt = time.Now().Add(-jobTTL - time.Minute)
+	j.mu.Unlock()
+
+	go s.sweepEvery(time.Millisecond)
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, err := os.Stat(archivePath); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sweepEvery() expected %v to be removed", archivePath)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, ok := s.get(j.id, "owner"); ok {
+		t.Errorf("sweepEvery() expected the job to be forgotten")
+	}
+}
+
+func Test_GetJob_shouldReturnNotFound(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/jobs/unknown", nil)
+	r.Header.Add("Authorization", "Bearer "+newTestJwtToken(t, "owner"))
+	r = mux.SetURLVars(r, map[string]string{"id": "unknown"})
+	w := httptest.NewRecorder()
+
+	GetJob(w, r)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GetJob() = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
+
+func Test_GetJob_shouldReturnJobStatus(t *testing.T) {
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	jobs.mu.Lock()
+	jobs.jobs[j.id] = j
+	jobs.mu.Unlock()
+
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+j.id, nil)
+	r.Header.Add("Authorization", "Bearer "+newTestJwtToken(t, "owner"))
+	r = mux.SetURLVars(r, map[string]string{"id": j.id})
+	w := httptest.NewRecorder()
+
+	GetJob(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("GetJob() = %v, want %v", w.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,271 @@
+package scraper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// unknownValue replaces placeholders a message has no value for, so that no
+// path segment ends up empty.
+const unknownValue = "unknown"
+
+// layoutPresets are the built-in archive layouts. flat is the default and
+// names files the way scrapes always have.
+var layoutPresets = map[string]string{
+	"flat":      "{date}-{filename}",
+	"by-sender": "{sender}/{date}-{filename}",
+	"by-month":  "{yyyy}/{mm}/{date}-{filename}",
+	"by-thread": "{threadId}/{date}-{filename}",
+}
+
+// placeholders lists what a layout can refer to.
+var placeholders = map[string]bool{
+	"sender":    true,
+	"date":      true,
+	"yyyy":      true,
+	"mm":        true,
+	"dd":        true,
+	"subject":   true,
+	"messageId": true,
+	"threadId":  true,
+	"label":     true,
+	"filename":  true,
+	"name":      true,
+	"ext":       true,
+}
+
+// layoutLabels are the system labels worth naming a folder after when a
+// message has no label of the user's own.
+var layoutLabels = []string{"INBOX", "SENT", "DRAFT", "SPAM", "TRASH"}
+
+// layout is a template for the path of an attachment in the archive, like
+// "{sender}/{yyyy}/{mm}/{subject}-{filename}". Slashes make directories.
+type layout struct {
+	tokens []layoutToken
+}
+
+// layoutToken is either literal text or a placeholder.
+type layoutToken struct {
+	text        string
+	placeholder string
+}
+
+var defaultLayout = mustParseLayout(layoutPresets["flat"])
+
+// newLayout returns the preset named name or, when there is none, parses
+// name as a template.
+func newLayout(name string) (*layout, error) {
+	if preset, ok := layoutPresets[name]; ok {
+		return parseLayout(preset)
+	}
+	if !strings.Contains(name, "{") {
+		return nil, fmt.Errorf("layout must be a template or one of %s", strings.Join(layoutPresetNames(), ", "))
+	}
+	return parseLayout(name)
+}
+
+func layoutPresetNames() []string {
+	names := make([]string, 0, len(layoutPresets))
+	for name := range layoutPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mustParseLayout(template string) *layout {
+	l, err := parseLayout(template)
+	if err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func parseLayout(template string) (*layout, error) {
+	if len(template) == 0 {
+		return nil, errors.New("invalid layout: the template is empty")
+	}
+	if strings.HasPrefix(template, "/") || strings.Contains(template, `\`) {
+		return nil, errors.New("invalid layout: the template must be a relative path using /")
+	}
+
+	l := new(layout)
+	rest := template
+	for len(rest) != 0 {
+		open := strings.IndexAny(rest, "{}")
+		if open == -1 {
+			l.tokens = append(l.tokens, layoutToken{text: rest})
+			break
+		}
+		if rest[open] == '}' {
+			return nil, errors.New("invalid layout: unexpected }")
+		}
+		if open != 0 {
+			l.tokens = append(l.tokens, layoutToken{text: rest[:open]})
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end == -1 {
+			return nil, errors.New("invalid layout: missing }")
+		}
+		name := rest[open+1 : open+end]
+		if !placeholders[name] {
+			return nil, fmt.Errorf("invalid layout: unknown placeholder {%s}", name)
+		}
+		l.tokens = append(l.tokens, layoutToken{placeholder: name})
+		rest = rest[open+end+1:]
+	}
+
+	for _, segment := range strings.Split(l.render(func(string) string { return "x" }), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, errors.New("invalid layout: the template has an empty, . or .. directory")
+		}
+	}
+	return l, nil
+}
+
+// uses reports whether the layout refers to placeholder.
+func (l *layout) uses(placeholder string) bool {
+	for _, t := range l.tokens {
+		if t.placeholder == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *layout) render(value func(placeholder string) string) string {
+	var b strings.Builder
+	for _, t := range l.tokens {
+		if len(t.placeholder) == 0 {
+			b.WriteString(t.text)
+			continue
+		}
+		v := value(t.placeholder)
+		if len(v) == 0 {
+			v = unknownValue
+		}
+		// Values come from emails, so they can't add directories.
+		b.WriteString(strings.NewReplacer("/", "_", `\`, "_").Replace(v))
+	}
+	return b.String()
+}
+
+// path returns where the attachment part of msg goes in the archive. Every
+// directory and the file name are sanitized.
+func (l *layout) path(msg *gmail.Message, part *gmail.MessagePart, labelName string) string {
+	tm := time.Unix(0, msg.InternalDate*1e6)
+	fileName := partFileName(part)
+	ext := path.Ext(fileName)
+
+	rendered := l.render(func(placeholder string) string {
+		switch placeholder {
+		case "sender":
+			return senderAddress(header(msg.Payload, "From"))
+		case "date":
+			return tm.Format("Jan-02-2006")
+		case "yyyy":
+			return tm.Format("2006")
+		case "mm":
+			return tm.Format("01")
+		case "dd":
+			return tm.Format("02")
+		case "subject":
+			return header(msg.Payload, "Subject")
+		case "messageId":
+			return msg.Id
+		case "threadId":
+			return msg.ThreadId
+		case "label":
+			return labelName
+		case "filename":
+			return fileName
+		case "name":
+			return strings.TrimSuffix(fileName, ext)
+		case "ext":
+			return strings.TrimPrefix(ext, ".")
+		}
+		return ""
+	})
+
+	segments := strings.Split(rendered, "/")
+	for i, segment := range segments {
+		name, err := sanitizeFileName(segment)
+		if err != nil {
+			name = "_"
+		}
+		segments[i] = name
+	}
+	return strings.Join(segments, "/")
+}
+
+// senderAddress returns the email address of a From header, or the header
+// itself when it can't be parsed.
+func senderAddress(from string) string {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return strings.TrimSpace(from)
+	}
+	return strings.ToLower(addr.Address)
+}
+
+type labelService interface {
+	listLabels(ctx context.Context, service *gmail.Service) (*gmail.ListLabelsResponse, error)
+}
+
+type label struct{}
+
+func (l *label) listLabels(ctx context.Context, service *gmail.Service) (*gmail.ListLabelsResponse, error) {
+	return service.Users.Labels.List(userID).Context(ctx).Do()
+}
+
+// loadLabels fetches the labels of the mailbox when the layout names
+// directories after them.
+func (p *pipeline) loadLabels(ctx context.Context) error {
+	if p.layout == nil || !p.layout.uses("label") {
+		return nil
+	}
+	r, err := p.ls.listLabels(ctx, p.service)
+	if err != nil {
+		return &messageError{msg: "Unable to retrieve Labels", err: err}
+	}
+	p.labels = make(map[string]*gmail.Label, len(r.Labels))
+	for _, l := range r.Labels {
+		p.labels[l.Id] = l
+	}
+	return nil
+}
+
+// labelName picks the label of msg to use in its path: the first label the
+// user created, or else the folder-like system label it is in.
+func (p *pipeline) labelName(msg *gmail.Message) string {
+	for _, id := range msg.LabelIds {
+		if l, ok := p.labels[id]; ok && l.Type == "user" {
+			return l.Name
+		}
+	}
+	for _, name := range layoutLabels {
+		for _, id := range msg.LabelIds {
+			if id == name {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// archivePath returns where the attachment part of msg goes in the archive.
+func (p *pipeline) archivePath(msg *gmail.Message, part *gmail.MessagePart) string {
+	l := p.layout
+	if l == nil {
+		l = defaultLayout
+	}
+	return l.path(msg, part, p.labelName(msg))
+}
@@ -0,0 +1,210 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_newLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		layout  string
+		wantErr bool
+	}{
+		{name: "preset", layout: "by-month"},
+		{name: "template", layout: "{sender}/{yyyy}/{mm}/{subject}-{filename}"},
+		{name: "literal directories", layout: "mail/{label}/{name}.{ext}"},
+		{name: "unknown preset", layout: "by-size", wantErr: true},
+		{name: "unknown placeholder", layout: "{size}-{filename}", wantErr: true},
+		{name: "missing brace", layout: "{sender/{filename}", wantErr: true},
+		{name: "unexpected brace", layout: "sender}/{filename}", wantErr: true},
+		{name: "absolute path", layout: "/{filename}", wantErr: true},
+		{name: "backslashes", layout: `{sender}\{filename}`, wantErr: true},
+		{name: "parent directory", layout: "../{filename}", wantErr: true},
+		{name: "empty directory", layout: "{sender}//{filename}", wantErr: true},
+		{name: "trailing slash", layout: "{sender}/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newLayout(tt.layout)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("newLayout(%q) error = %v, wantErr %v", tt.layout, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_layout_path(t *testing.T) {
+	msg := &gmail.Message{
+		Id:           "16c2",
+		ThreadId:     "thread-16c2",
+		InternalDate: time.Date(2019, 11, 20, 14, 3, 46, 0, time.Local).UnixNano() / 1e6,
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "Billing <Billing@Vendor.com>"},
+				{Name: "Subject", Value: "Invoice 11/2019: paid"},
+			},
+		},
+	}
+	part := &gmail.MessagePart{PartId: "1", Filename: "invoice.pdf"}
+
+	tests := []struct {
+		layout string
+		label  string
+		want   string
+	}{
+		{layout: "flat", want: "Nov-20-2019-invoice.pdf"},
+		{layout: "by-sender", want: "billing@vendor.com/Nov-20-2019-invoice.pdf"},
+		{layout: "by-month", want: "2019/11/Nov-20-2019-invoice.pdf"},
+		{layout: "by-thread", want: "thread-16c2/Nov-20-2019-invoice.pdf"},
+		{
+			layout: "{sender}/{yyyy}/{mm}/{subject}-{filename}",
+			want:   "billing@vendor.com/2019/11/Invoice 11_2019_ paid-invoice.pdf",
+		},
+		{layout: "{messageId}-{dd}-{name}.{ext}", want: "16c2-20-invoice.pdf"},
+		{layout: "{label}/{filename}", label: "Work/Invoices", want: "Work_Invoices/invoice.pdf"},
+		{layout: "{label}/{filename}", want: "unknown/invoice.pdf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.layout, func(t *testing.T) {
+			l, err := newLayout(tt.layout)
+			if err != nil {
+				t.Fatalf("newLayout(%q) unexpected error: %v", tt.layout, err)
+			}
+			if got := l.path(msg, part, tt.label); got != tt.want {
+				t.Errorf("path() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_layout_path_shouldSanitizeValues(t *testing.T) {
+	msg := &gmail.Message{
+		Id: "16c2",
+		Payload: &gmail.MessagePart{
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "Subject", Value: ".."},
+				{Name: "From", Value: "CON"},
+			},
+		},
+	}
+	l, err := newLayout("{subject}/{sender}/{filename}")
+	if err != nil {
+		t.Fatalf("newLayout() unexpected error: %v", err)
+	}
+
+	got := l.path(msg, &gmail.MessagePart{PartId: "2", Filename: "../x.pdf"}, "")
+	if want := "_/_CON/attachment-2"; got != want {
+		t.Errorf("path() = %q, want %q", got, want)
+	}
+}
+
+type mockLabels struct {
+	err error
+}
+
+func (l *mockLabels) listLabels(ctx context.Context, service *gmail.Service) (*gmail.ListLabelsResponse, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	return &gmail.ListLabelsResponse{
+		Labels: []*gmail.Label{
+			{Id: "INBOX", Name: "INBOX", Type: "system"},
+			{Id: "IMPORTANT", Name: "IMPORTANT", Type: "system"},
+			{Id: "Label_1", Name: "Invoices", Type: "user"},
+		},
+	}, nil
+}
+
+func Test_labelName(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ls:      &mockLabels{},
+		layout:  mustParseLayout("{label}/{filename}"),
+	}
+	if err := p.loadLabels(context.Background()); err != nil {
+		t.Fatalf("loadLabels() unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		labelIds []string
+		want     string
+	}{
+		{name: "user label", labelIds: []string{"IMPORTANT", "INBOX", "Label_1"}, want: "Invoices"},
+		{name: "system label", labelIds: []string{"IMPORTANT", "INBOX"}, want: "INBOX"},
+		{name: "no folder-like label", labelIds: []string{"IMPORTANT"}, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.labelName(&gmail.Message{LabelIds: tt.labelIds}); got != tt.want {
+				t.Errorf("labelName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_loadLabels_shouldOnlyFetchLabelsWhenNeeded(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ls:      &mockLabels{err: errors.New("Couldn't list labels")},
+		layout:  mustParseLayout("by-month"),
+	}
+	if err := p.loadLabels(context.Background()); err != nil {
+		t.Errorf("loadLabels() unexpected error: %v", err)
+	}
+
+	p.layout = mustParseLayout("{label}/{filename}")
+	expected := "Unable to retrieve Labels Couldn't list labels"
+	if err := p.loadLabels(context.Background()); err == nil || err.Error() != expected {
+		t.Errorf("loadLabels() = %v, want %v", err, expected)
+	}
+}
+
+func Test_run_shouldUseTheRequestedLayout(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+	}
+	r := httptest.NewRequest("GET", "/download/attachment?layout={messageId}/{filename}", nil)
+	if err := p.configure(r); err != nil {
+		t.Fatalf("configure() unexpected error: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("run() wrote an invalid zip: %v", err)
+	}
+
+	var got []string
+	for _, f := range attachmentFiles(zr) {
+		got = append(got, f.Name)
+	}
+	sort.Strings(got)
+	want := []string{"16c2/16c2.pdf", "41ff9/41ff9.pdf", "41hfi/41hfi.pdf", "fgb/fgb.pdf", "ifgh9/ifgh9.pdf"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("run() wrote %v, want %v", got, want)
+	}
+}
+
+func Test_configure_shouldRejectInvalidLayouts(t *testing.T) {
+	r := httptest.NewRequest("GET", "/download/attachment?layout=by-size", nil)
+	if err := new(pipeline).configure(r); err == nil {
+		t.Errorf("configure() expected an error for an unknown layout")
+	}
+}
@@ -0,0 +1,235 @@
+package scraper
+
+import (
+	"context"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/api/gmail/v1"
+)
+
+// Gmail API quota units used by each call, see
+// https://developers.google.com/gmail/api/v1/reference/quota
+const (
+	listQuotaUnits       = 5
+	getQuotaUnits        = 5
+	attachmentQuotaUnits = 5
+	labelsQuotaUnits     = 1
+	profileQuotaUnits    = 1
+	historyQuotaUnits    = 2
+)
+
+// limits bounds how hard a scrape hits the Gmail API.
+type limits struct {
+	// contentWorkers and attachmentWorkers are the number of messages and
+	// attachments fetched at the same time.
+	contentWorkers    int
+	attachmentWorkers int
+	// quotaPerSecond is the number of Gmail quota units the scrapes of a
+	// user may use every second. Gmail allows 250 per user.
+	quotaPerSecond int
+}
+
+var defaultLimits = limitsFromEnv()
+
+// limitsFromEnv reads the limits from GMAIL_CONTENT_WORKERS,
+// GMAIL_ATTACHMENT_WORKERS and GMAIL_QUOTA_UNITS_PER_SECOND.
+func limitsFromEnv() limits {
+	return limits{
+		contentWorkers:    envInt("GMAIL_CONTENT_WORKERS", 10),
+		attachmentWorkers: envInt("GMAIL_ATTACHMENT_WORKERS", 5),
+		quotaPerSecond:    envInt("GMAIL_QUOTA_UNITS_PER_SECOND", 200),
+	}
+}
+
+func envInt(key string, fallback int) int {
+	v := os.Getenv(key)
+	if len(v) == 0 {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("invalid %s %q, defaulting to %d", key, v, fallback)
+		return fallback
+	}
+	return n
+}
+
+// workers returns n, or 1 when no limit was configured.
+func workers(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// quota is a token bucket of Gmail quota units.
+type quota struct {
+	// used is when units were last drawn, in unix nanoseconds. It comes
+	// first to be 64-bit aligned for the atomic operations.
+	used int64
+	*rate.Limiter
+}
+
+// newQuotaLimiter returns a token bucket holding one second worth of quota
+// units.
+func newQuotaLimiter(quotaPerSecond int) *quota {
+	burst := quotaPerSecond
+	if burst < listQuotaUnits {
+		burst = listQuotaUnits
+	}
+	return &quota{
+		used:    time.Now().UnixNano(),
+		Limiter: rate.NewLimiter(rate.Limit(quotaPerSecond), burst),
+	}
+}
+
+// WaitN blocks until n units are available or ctx is done.
+func (q *quota) WaitN(ctx context.Context, n int) error {
+	atomic.StoreInt64(&q.used, time.Now().UnixNano())
+	return q.Limiter.WaitN(ctx, n)
+}
+
+func (q *quota) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&q.used))
+}
+
+// quotaIdleTime is how long the bucket of a user is kept after it was last
+// drawn from. It is full again long before, so a new one is no different.
+const quotaIdleTime = 10 * time.Minute
+
+// quotas holds the bucket of each mailbox, by address. Gmail counts the
+// quota per mailbox, so every scrape of the same mailbox, be it a request, a
+// job or a schedule and whichever login started it, draws from the same
+// bucket.
+var quotas = newQuotaRegistry()
+
+type quotaRegistry struct {
+	mu     sync.Mutex
+	quotas map[string]*quota
+	swept  time.Time
+	now    func() time.Time
+}
+
+func newQuotaRegistry() *quotaRegistry {
+	return &quotaRegistry{quotas: make(map[string]*quota), now: time.Now}
+}
+
+// get returns the bucket of mailbox, creating it with quotaPerSecond units
+// per second if needed. Idle buckets are dropped at most every
+// quotaIdleTime.
+func (r *quotaRegistry) get(mailbox string, quotaPerSecond int) *quota {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.now()
+	if now.Sub(r.swept) >= quotaIdleTime {
+		for id, q := range r.quotas {
+			if now.Sub(q.idleSince()) >= quotaIdleTime {
+				delete(r.quotas, id)
+			}
+		}
+		r.swept = now
+	}
+	q, ok := r.quotas[mailbox]
+	if !ok {
+		q = newQuotaLimiter(quotaPerSecond)
+		q.used = now.UnixNano()
+		r.quotas[mailbox] = q
+	}
+	return q
+}
+
+// rateLimitedMessages waits for quota before listing messages.
+type rateLimitedMessages struct {
+	next    messageSevice
+	limiter *quota
+}
+
+func (m *rateLimitedMessages) fetchMessages(
+	ctx context.Context, service *gmail.Service,
+	query string) (*gmail.ListMessagesResponse, error) {
+	if err := m.limiter.WaitN(ctx, listQuotaUnits); err != nil {
+		return nil, err
+	}
+	return m.next.fetchMessages(ctx, service, query)
+}
+
+func (m *rateLimitedMessages) fetchNextPage(
+	ctx context.Context, service *gmail.Service,
+	query string,
+	NextPageToken string) (*gmail.ListMessagesResponse, error) {
+	if err := m.limiter.WaitN(ctx, listQuotaUnits); err != nil {
+		return nil, err
+	}
+	return m.next.fetchNextPage(ctx, service, query, NextPageToken)
+}
+
+// rateLimitedContent waits for quota before fetching a message.
+type rateLimitedContent struct {
+	next    content
+	limiter *quota
+}
+
+func (c *rateLimitedContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	if err := c.limiter.WaitN(ctx, getQuotaUnits); err != nil {
+		return nil, err
+	}
+	return c.next.getContent(ctx, service, id)
+}
+
+// rateLimitedAttachments waits for quota before fetching an attachment.
+type rateLimitedAttachments struct {
+	next    attachmentService
+	limiter *quota
+}
+
+func (a *rateLimitedAttachments) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	if err := a.limiter.WaitN(ctx, attachmentQuotaUnits); err != nil {
+		return nil, err
+	}
+	return a.next.fetchAttachment(ctx, service, msgID, attachID)
+}
+
+// rateLimitedLabels waits for quota before listing labels.
+type rateLimitedLabels struct {
+	next    labelService
+	limiter *quota
+}
+
+func (l *rateLimitedLabels) listLabels(ctx context.Context, service *gmail.Service) (*gmail.ListLabelsResponse, error) {
+	if err := l.limiter.WaitN(ctx, labelsQuotaUnits); err != nil {
+		return nil, err
+	}
+	return l.next.listLabels(ctx, service)
+}
+
+// rateLimitedHistory waits for quota before reading the mailbox history.
+type rateLimitedHistory struct {
+	next    historyService
+	limiter *quota
+}
+
+func (h *rateLimitedHistory) getProfile(ctx context.Context, service *gmail.Service) (*gmail.Profile, error) {
+	if err := h.limiter.WaitN(ctx, profileQuotaUnits); err != nil {
+		return nil, err
+	}
+	return h.next.getProfile(ctx, service)
+}
+
+func (h *rateLimitedHistory) listHistory(
+	ctx context.Context, service *gmail.Service,
+	startHistoryID uint64,
+	pageToken string) (*gmail.ListHistoryResponse, error) {
+	if err := h.limiter.WaitN(ctx, historyQuotaUnits); err != nil {
+		return nil, err
+	}
+	return h.next.listHistory(ctx, service, startHistoryID, pageToken)
+}
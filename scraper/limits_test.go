@@ -0,0 +1,166 @@
+package scraper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_envInt(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  int
+	}{
+		{name: "unset", value: "", want: 7},
+		{name: "valid", value: "3", want: 3},
+		{name: "not a number", value: "many", want: 7},
+		{name: "not positive", value: "0", want: 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Setenv("TEST_ENV_INT", tt.value)
+			defer os.Unsetenv("TEST_ENV_INT")
+
+			if got := envInt("TEST_ENV_INT", 7); got != tt.want {
+				t.Errorf("envInt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_quotaRegistry_get_shouldShareTheBucketOfAUser(t *testing.T) {
+	now := time.Now()
+	r := newQuotaRegistry()
+	r.now = func() time.Time { return now }
+
+	q := r.get("user", 10)
+	if got := r.get("user", 10); got != q {
+		t.Errorf("get() returned another bucket for the same user")
+	}
+	if got := r.get("other", 10); got == q {
+		t.Errorf("get() returned the same bucket for another user")
+	}
+
+	// Buckets drawn from recently are kept, idle ones are dropped.
+	atomic.StoreInt64(&q.used, now.Add(quotaIdleTime).UnixNano())
+	now = now.Add(quotaIdleTime)
+	if got := r.get("user", 10); got != q {
+		t.Errorf("get() dropped a bucket in use")
+	}
+	if _, ok := r.quotas["other"]; ok {
+		t.Errorf("get() kept an idle bucket")
+	}
+}
+
+func Test_rateLimitedContent_shouldUseQuota(t *testing.T) {
+	limiter := newQuotaLimiter(getQuotaUnits)
+	c := &rateLimitedContent{next: &mockMessageContent{}, limiter: limiter}
+
+	if _, err := c.getContent(context.Background(), new(gmail.Service), "16c2"); err != nil {
+		t.Fatalf("getContent() unexpected error: %v", err)
+	}
+
+	if limiter.AllowN(time.Now(), getQuotaUnits) {
+		t.Errorf("getContent() expected the quota units to be used")
+	}
+}
+
+type mockConcurrentContent struct {
+	mu      sync.Mutex
+	running int
+	max     int
+}
+
+func (m *mockConcurrentContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	m.mu.Lock()
+	m.running++
+	if m.running > m.max {
+		m.max = m.running
+	}
+	m.mu.Unlock()
+
+	time.Sleep(5 * time.Millisecond)
+
+	m.mu.Lock()
+	m.running--
+	m.mu.Unlock()
+	return &gmail.Message{Id: id, Payload: &gmail.MessagePart{}}, nil
+}
+
+func Test_getMessageContent_shouldBoundConcurrency(t *testing.T) {
+	ids := make(chan string, 20)
+	for i := 0; i < 20; i++ {
+		ids <- strconv.Itoa(i)
+	}
+	close(ids)
+
+	mc := &mockConcurrentContent{}
+	p := &pipeline{
+		service: new(gmail.Service),
+		cont:    mc,
+		limits:  limits{contentWorkers: 3},
+	}
+
+	msgs, _ := p.getMessageContent(context.Background(), ids)
+	count := 0
+	for range msgs {
+		count++
+	}
+
+	if count != 20 {
+		t.Errorf("getMessageContent() = %v messages, want %v", count, 20)
+	}
+	if mc.max > 3 {
+		t.Errorf("getMessageContent() ran %v fetches at once, want at most %v", mc.max, 3)
+	}
+}
+
+func Test_pipelines_shouldShareTheBucketOfAMailbox(t *testing.T) {
+	defer func(t oauth.TokenStore, s oauth.SecretStore) { oauth.Tokens, oauth.Secrets = t, s }(oauth.Tokens, oauth.Secrets)
+	defer func(m *mailboxCache) { mailboxes = m }(mailboxes)
+	useTestTokens(t, "login", "schedule-1")
+	mailboxes = newMailboxCache()
+	reads := 0
+	mailboxes.profile = func(ctx context.Context, service *gmail.Service) (*gmail.Profile, error) {
+		reads++
+		return &gmail.Profile{EmailAddress: "a@mail.com"}, nil
+	}
+	limiterOf := func(p *pipeline) *quota {
+		return p.ms.(*retryingMessages).next.(*rateLimitedMessages).limiter
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/scrape", nil)
+	r.Header.Set("Authorization", "Bearer "+newTestJwtToken(t, "login"))
+	requested, _, err := pipelineFromRequest(r)
+	if err != nil {
+		t.Fatalf("pipelineFromRequest() unexpected error: %v", err)
+	}
+	if _, _, err := pipelineFromRequest(r); err != nil {
+		t.Fatalf("pipelineFromRequest() unexpected error: %v", err)
+	}
+	scheduled, err := scheduledPipeline(&credentials{Email: "a@mail.com", UserID: "schedule-1"})
+	if err != nil {
+		t.Fatalf("scheduledPipeline() unexpected error: %v", err)
+	}
+
+	if limiterOf(requested) != limiterOf(scheduled) {
+		t.Errorf("a request and a schedule of the same mailbox draw from different buckets")
+	}
+	if other := newPipeline(new(gmail.Service), "b@mail.com"); limiterOf(other) == limiterOf(requested) {
+		t.Errorf("newPipeline() shares the bucket of another mailbox")
+	}
+	if reads != 1 {
+		t.Errorf("pipelineFromRequest() read the profile %v times, want %v", reads, 1)
+	}
+}
@@ -0,0 +1,156 @@
+package scraper
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the files describing the content of an archive.
+const (
+	manifestCSVFileName  = "manifest.csv"
+	manifestJSONFileName = "manifest.json"
+)
+
+var manifestCSVHeader = []string{
+	"path", "filename", "message_id", "thread_id", "from", "subject",
+	"date", "mime_type", "size", "sha256",
+}
+
+// manifestEntry describes a file of an archive and the email it came from.
+type manifestEntry struct {
+	Path      string    `json:"path"`
+	Filename  string    `json:"filename"`
+	MessageID string    `json:"messageId"`
+	ThreadID  string    `json:"threadId"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Date      time.Time `json:"date"`
+	MimeType  string    `json:"mimeType"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+
+	// Duplicates lists the other emails that sent the same content when
+	// the archive is deduplicated.
+	Duplicates []manifestEntry `json:"duplicates,omitempty"`
+}
+
+// manifest collects the entries of an archive and gives each of them a path
+// of its own. When deduplicating, an attachment whose content was already
+// archived is only recorded as a duplicate of the first one. Attachments are
+// added in the order of their messages, so the same ones are numbered on
+// every scrape.
+type manifest struct {
+	dedup   bool
+	entries []manifestEntry
+	byHash  map[string]int
+	names   fileNames
+}
+
+func newManifest(dedup bool) *manifest {
+	return &manifest{
+		dedup:  dedup,
+		byHash: make(map[string]int),
+		names:  newFileNames(manifestCSVFileName, manifestJSONFileName, failuresFileName),
+	}
+}
+
+// add records an attachment with the given content and returns the path to
+// archive it under, or reports that it is a duplicate that doesn't need to be
+// archived again.
+func (m *manifest) add(attach *attachment, decoded []byte) (path string, duplicate bool) {
+	e := newManifestEntry(attach, decoded)
+	if i, ok := m.byHash[e.SHA256]; ok && m.dedup {
+		e.Path = m.entries[i].Path
+		m.entries[i].Duplicates = append(m.entries[i].Duplicates, e)
+		return e.Path, true
+	}
+
+	e.Path = m.names.unique(attach.fileName)
+	m.byHash[e.SHA256] = len(m.entries)
+	m.entries = append(m.entries, e)
+	return e.Path, false
+}
+
+func newManifestEntry(attach *attachment, decoded []byte) manifestEntry {
+	sum := sha256.Sum256(decoded)
+	return manifestEntry{
+		Path:      attach.fileName,
+		Filename:  attach.info.Filename,
+		MessageID: attach.info.MessageID,
+		ThreadID:  attach.info.ThreadID,
+		From:      attach.info.From,
+		Subject:   attach.info.Subject,
+		Date:      attach.info.Date,
+		MimeType:  attach.info.MimeType,
+		Size:      int64(len(decoded)),
+		SHA256:    hex.EncodeToString(sum[:]),
+	}
+}
+
+func (e manifestEntry) csvRecord() []string {
+	return []string{
+		csvText(e.Path),
+		csvText(e.Filename),
+		e.MessageID,
+		e.ThreadID,
+		csvText(e.From),
+		csvText(e.Subject),
+		e.Date.Format(time.RFC3339),
+		e.MimeType,
+		strconv.FormatInt(e.Size, 10),
+		e.SHA256,
+	}
+}
+
+// csvText keeps spreadsheets from evaluating text taken from emails, like a
+// subject starting with "=", as a formula.
+func csvText(s string) string {
+	if len(s) != 0 && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+	return s
+}
+
+// write adds manifest.csv and manifest.json to the archive. In the CSV,
+// duplicates get a row of their own pointing to the archived file.
+func (m *manifest) write(aw ArchiveWriter) error {
+	f, err := aw.Create(manifestCSVFileName)
+	if err != nil {
+		return err
+	}
+	cw := csv.NewWriter(f)
+	if err := cw.Write(manifestCSVHeader); err != nil {
+		return err
+	}
+	for _, e := range m.entries {
+		if err := cw.Write(e.csvRecord()); err != nil {
+			return err
+		}
+		for _, d := range e.Duplicates {
+			if err := cw.Write(d.csvRecord()); err != nil {
+				return err
+			}
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+
+	entries := m.entries
+	if entries == nil {
+		entries = []manifestEntry{}
+	}
+	f, err = aw.Create(manifestJSONFileName)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(entries)
+}
@@ -0,0 +1,219 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// attachmentFiles returns the files of an archive that hold attachments.
+func attachmentFiles(zr *zip.Reader) []*zip.File {
+	var files []*zip.File
+	for _, f := range zr.File {
+		switch f.Name {
+		case manifestCSVFileName, manifestJSONFileName, failuresFileName:
+		default:
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func openArchiveFile(t *testing.T, zr *zip.Reader, name string) *zip.File {
+	for _, f := range zr.File {
+		if f.Name == name {
+			return f
+		}
+	}
+	t.Fatalf("archive has no %v", name)
+	return nil
+}
+
+func Test_run_shouldWriteManifests(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessageWithFetchNextPageError{},
+		cont:    &mockMessageContentWithMetadata{},
+		as:      &mockAttachmentWithData{},
+		onError: skipOnError,
+	}
+
+	var buf bytes.Buffer
+	if err := p.run("from:billing@vendor.com", newZipWriter(&buf)); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("run() wrote an invalid zip: %v", err)
+	}
+
+	want := manifestEntry{
+		Path:      "Nov-20-2019-16c2.pdf",
+		Filename:  "16c2.pdf",
+		MessageID: "16c2",
+		ThreadID:  "thread-16c2",
+		From:      "Billing <billing@vendor.com>",
+		Subject:   "Invoice 16c2",
+		Date:      time.Date(2019, 11, 20, 14, 3, 46, 0, time.UTC),
+		MimeType:  "application/pdf",
+		Size:      int64(len("attachment of 16c2")),
+		SHA256:    "e58389ff5772c89e9238125a01029f45b27667d28ff64162d4d416ab81639024",
+	}
+
+	rc, err := openArchiveFile(t, zr, manifestJSONFileName).Open()
+	if err != nil {
+		t.Fatalf("unable to open %v: %v", manifestJSONFileName, err)
+	}
+	defer rc.Close()
+	var entries []manifestEntry
+	if err := json.NewDecoder(rc).Decode(&entries); err != nil {
+		t.Fatalf("invalid %v: %v", manifestJSONFileName, err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("%v has %v entries, want %v", manifestJSONFileName, len(entries), 1)
+	}
+	if !reflect.DeepEqual(entries[0], want) {
+		t.Errorf("%v = %+v, want %+v", manifestJSONFileName, entries[0], want)
+	}
+
+	rc, err = openArchiveFile(t, zr, manifestCSVFileName).Open()
+	if err != nil {
+		t.Fatalf("unable to open %v: %v", manifestCSVFileName, err)
+	}
+	defer rc.Close()
+	records, err := csv.NewReader(rc).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid %v: %v", manifestCSVFileName, err)
+	}
+	if !reflect.DeepEqual(records, [][]string{manifestCSVHeader, want.csvRecord()}) {
+		t.Errorf("%v = %v, want %v", manifestCSVFileName, records, [][]string{manifestCSVHeader, want.csvRecord()})
+	}
+}
+
+func Test_newManifestEntry_shouldHashTheContent(t *testing.T) {
+	e := newManifestEntry(&attachment{fileName: "a.txt"}, []byte("hello"))
+
+	want := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if e.SHA256 != want {
+		t.Errorf("newManifestEntry() sha256 = %v, want %v", e.SHA256, want)
+	}
+	if e.Size != 5 {
+		t.Errorf("newManifestEntry() size = %v, want %v", e.Size, 5)
+	}
+}
+
+func Test_csvText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{value: "Invoice", want: "Invoice"},
+		{value: "=HYPERLINK(\"x\")", want: "'=HYPERLINK(\"x\")"},
+		{value: "+1", want: "'+1"},
+		{value: "-1", want: "'-1"},
+		{value: "@SUM(A1)", want: "'@SUM(A1)"},
+		{value: "", want: ""},
+	}
+	for _, tt := range tests {
+		if got := csvText(tt.value); got != tt.want {
+			t.Errorf("csvText(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+type mockAttachmentWithSameData struct {
+}
+
+func (a *mockAttachmentWithSameData) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	attachment := gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString([]byte("the same invoice")),
+	}
+	return &attachment, nil
+}
+
+func Test_run_shouldDeduplicateAttachments(t *testing.T) {
+	tests := []struct {
+		name       string
+		dedup      bool
+		files      int
+		savedBytes int64
+		duplicates int
+	}{
+		{name: "disabled", dedup: false, files: 5, savedBytes: 0, duplicates: 0},
+		{name: "enabled", dedup: true, files: 1, savedBytes: 4 * int64(len("the same invoice")), duplicates: 4},
+	}
+	for _, tt := range tests {
+		p := &pipeline{
+			service: new(gmail.Service),
+			ms:      &mockMessage{},
+			cont:    &mockMessageContentWithAttachment{},
+			as:      &mockAttachmentWithSameData{},
+			dedup:   tt.dedup,
+		}
+
+		var buf bytes.Buffer
+		if err := p.run("from:test@mail.com", newZipWriter(&buf)); err != nil {
+			t.Fatalf("%v: run() unexpected error: %v", tt.name, err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("%v: run() wrote an invalid zip: %v", tt.name, err)
+		}
+
+		if files := attachmentFiles(zr); len(files) != tt.files {
+			t.Errorf("%v: run() wrote %v files, want %v", tt.name, len(files), tt.files)
+		}
+		if p.savedBytes != tt.savedBytes {
+			t.Errorf("%v: run() saved %v bytes, want %v", tt.name, p.savedBytes, tt.savedBytes)
+		}
+
+		rc, err := openArchiveFile(t, zr, manifestJSONFileName).Open()
+		if err != nil {
+			t.Fatalf("%v: unable to open %v: %v", tt.name, manifestJSONFileName, err)
+		}
+		var entries []manifestEntry
+		err = json.NewDecoder(rc).Decode(&entries)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%v: invalid %v: %v", tt.name, manifestJSONFileName, err)
+		}
+		duplicates := 0
+		for _, e := range entries {
+			for _, d := range e.Duplicates {
+				if d.Path != e.Path || d.SHA256 != e.SHA256 || d.MessageID == e.MessageID {
+					t.Errorf("%v: duplicate %+v doesn't reference %+v", tt.name, d, e)
+				}
+			}
+			duplicates += len(e.Duplicates)
+		}
+		if len(entries)+duplicates != 5 {
+			t.Errorf("%v: %v lists %v messages, want %v", tt.name, manifestJSONFileName, len(entries)+duplicates, 5)
+		}
+		if duplicates != tt.duplicates {
+			t.Errorf("%v: %v lists %v duplicates, want %v", tt.name, manifestJSONFileName, duplicates, tt.duplicates)
+		}
+
+		rc, err = openArchiveFile(t, zr, manifestCSVFileName).Open()
+		if err != nil {
+			t.Fatalf("%v: unable to open %v: %v", tt.name, manifestCSVFileName, err)
+		}
+		records, err := csv.NewReader(rc).ReadAll()
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%v: invalid %v: %v", tt.name, manifestCSVFileName, err)
+		}
+		if len(records) != 6 {
+			t.Errorf("%v: %v has %v rows, want %v", tt.name, manifestCSVFileName, len(records), 6)
+		}
+	}
+}
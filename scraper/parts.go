@@ -0,0 +1,63 @@
+package scraper
+
+import (
+	"context"
+	"mime"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// attachmentParts walks the MIME tree rooted at part and returns every part
+// that carries an attachment, however deeply it is nested. The root counts
+// too, since the payload of a single-part message can be the attachment.
+func attachmentParts(part *gmail.MessagePart) []*gmail.MessagePart {
+	if part == nil {
+		return nil
+	}
+
+	var parts []*gmail.MessagePart
+	if isAttachment(part) {
+		parts = append(parts, part)
+	}
+	for _, child := range part.Parts {
+		parts = append(parts, attachmentParts(child)...)
+	}
+	return parts
+}
+
+func isAttachment(part *gmail.MessagePart) bool {
+	if len(part.Filename) != 0 {
+		return true
+	}
+	return part.Body != nil && len(part.Body.AttachmentId) != 0
+}
+
+// partFileName returns the sanitized filename of part, making one up from
+// its part ID and MIME type when the message doesn't name it or names it
+// unsafely.
+func partFileName(part *gmail.MessagePart) string {
+	if name, err := sanitizeFileName(part.Filename); err == nil {
+		return name
+	}
+
+	name := "attachment"
+	if len(part.PartId) != 0 {
+		name += "-" + part.PartId
+	}
+	if exts, err := mime.ExtensionsByType(part.MimeType); err == nil && len(exts) != 0 {
+		name += exts[0]
+	}
+	return name
+}
+
+// partBody returns the body of an attachment part. Small attachments have
+// their data inline in the part and don't need to be fetched.
+func (p *pipeline) partBody(ctx context.Context, msgID string, part *gmail.MessagePart) (*gmail.MessagePartBody, error) {
+	if part.Body == nil {
+		return &gmail.MessagePartBody{}, nil
+	}
+	if len(part.Body.AttachmentId) == 0 {
+		return part.Body, nil
+	}
+	return p.as.fetchAttachment(ctx, p.service, msgID, part.Body.AttachmentId)
+}
@@ -0,0 +1,156 @@
+package scraper
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_attachmentParts(t *testing.T) {
+	pdf := &gmail.MessagePart{
+		PartId:   "0.1",
+		Filename: "invoice.pdf",
+		Body:     &gmail.MessagePartBody{AttachmentId: "pdfId"},
+	}
+	image := &gmail.MessagePart{
+		PartId:   "1.0.1",
+		MimeType: "image/png",
+		Body:     &gmail.MessagePartBody{AttachmentId: "imageId"},
+	}
+	forwarded := &gmail.MessagePart{
+		PartId:   "1.1",
+		Filename: "forwarded.txt",
+		Body:     &gmail.MessagePartBody{Data: "aW5saW5l"},
+	}
+	text := &gmail.MessagePart{
+		PartId:   "0.0",
+		MimeType: "text/plain",
+		Body:     &gmail.MessagePartBody{Data: "aGVsbG8="},
+	}
+
+	tests := []struct {
+		name    string
+		payload *gmail.MessagePart
+		want    []*gmail.MessagePart
+	}{
+		{
+			name:    "nil payload",
+			payload: nil,
+			want:    nil,
+		},
+		{
+			name: "single-part message whose payload is the attachment",
+			payload: &gmail.MessagePart{
+				Filename: "scan.pdf",
+				Body:     &gmail.MessagePartBody{AttachmentId: "scanId"},
+			},
+			want: []*gmail.MessagePart{{
+				Filename: "scan.pdf",
+				Body:     &gmail.MessagePartBody{AttachmentId: "scanId"},
+			}},
+		},
+		{
+			name: "nested multipart trees",
+			payload: &gmail.MessagePart{
+				MimeType: "multipart/mixed",
+				Parts: []*gmail.MessagePart{
+					{
+						MimeType: "multipart/alternative",
+						Parts:    []*gmail.MessagePart{text, pdf},
+					},
+					{
+						MimeType: "message/rfc822",
+						Parts: []*gmail.MessagePart{
+							{
+								MimeType: "multipart/related",
+								Parts:    []*gmail.MessagePart{image},
+							},
+							forwarded,
+						},
+					},
+				},
+			},
+			want: []*gmail.MessagePart{pdf, image, forwarded},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := attachmentParts(tt.payload)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("attachmentParts() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_partFileName(t *testing.T) {
+	tests := []struct {
+		name string
+		part *gmail.MessagePart
+		want string
+	}{
+		{
+			name: "named part",
+			part: &gmail.MessagePart{PartId: "1", Filename: "invoice.pdf", MimeType: "application/pdf"},
+			want: "invoice.pdf",
+		},
+		{
+			name: "unnamed part with a known MIME type",
+			part: &gmail.MessagePart{PartId: "1.2", MimeType: "application/pdf"},
+			want: "attachment-1.2.pdf",
+		},
+		{
+			name: "unnamed part with an unknown MIME type",
+			part: &gmail.MessagePart{PartId: "3", MimeType: "application/x-unknown-type"},
+			want: "attachment-3",
+		},
+		{
+			name: "part named with a path",
+			part: &gmail.MessagePart{PartId: "4", Filename: "scans/invoice.pdf", MimeType: "application/pdf"},
+			want: "scans_invoice.pdf",
+		},
+		{
+			name: "part named unsafely",
+			part: &gmail.MessagePart{PartId: "5", Filename: "../../invoice.pdf", MimeType: "application/pdf"},
+			want: "attachment-5.pdf",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := partFileName(tt.part); got != tt.want {
+				t.Errorf("partFileName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_getAttachment_shouldUseInlineDataWithoutFetching(t *testing.T) {
+	msgsCh := make(chan *gmail.Message, 1)
+	msgsCh <- &gmail.Message{
+		Id: "msgIdhere",
+		Payload: &gmail.MessagePart{
+			Filename: "small.txt",
+			Body: &gmail.MessagePartBody{
+				Data: "aW5saW5l",
+				Size: 6,
+			},
+		},
+	}
+	close(msgsCh)
+
+	p := &pipeline{service: new(gmail.Service), as: &mockAttachmentWithFetchError{}}
+	atts, errs := p.getAttachment(context.Background(), msgsCh)
+
+	var got []*attachment
+	for a := range atts {
+		got = append(got, a)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("getAttachment() unexpected error: %v", <-errs)
+	}
+	if len(got) != 1 || got[0].data != "aW5saW5l" {
+		t.Errorf("getAttachment() = %v, want the inline data", got)
+	}
+}
@@ -0,0 +1,130 @@
+package scraper
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// attachmentInfo describes an attachment without its content.
+type attachmentInfo struct {
+	MessageID    string    `json:"messageId"`
+	ThreadID     string    `json:"threadId"`
+	PartID       string    `json:"partId"`
+	AttachmentID string    `json:"attachmentId,omitempty"`
+	From         string    `json:"from"`
+	Subject      string    `json:"subject"`
+	Date         time.Time `json:"date"`
+	Filename     string    `json:"filename"`
+	MimeType     string    `json:"mimeType"`
+	Size         int64     `json:"size"`
+}
+
+type previewResponse struct {
+	Count       int              `json:"count"`
+	TotalSize   int64            `json:"totalSize"`
+	Attachments []attachmentInfo `json:"attachments"`
+}
+
+// Preview lists the attachments a scrape with the same filter would
+// download. Only message listings and metadata are fetched, never the
+// attachment bodies.
+func Preview(w http.ResponseWriter, r *http.Request) {
+	p, _, err := pipelineFromRequest(r)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	f, err := filterFromRequest(r)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	infos, err := p.preview(f.query())
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	res := previewResponse{Count: len(infos), Attachments: infos}
+	for _, info := range infos {
+		res.TotalSize += info.Size
+	}
+	jsonResponse(w, http.StatusOK, res)
+}
+
+// preview runs the listing and message content stages for query and
+// describes every attachment found, oldest first.
+func (p *pipeline) preview(query string) ([]attachmentInfo, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.abort = cancel
+
+	messagesChannel, getIDsErr := p.getIDs(ctx, query)
+	if len(getIDsErr) != 0 {
+		return nil, <-getIDsErr
+	}
+	messageContentChannel, getMsgCErr := p.getMessageContent(ctx, messagesChannel)
+
+	infos := []attachmentInfo{}
+	for msgContent := range messageContentChannel {
+		if msgContent == nil {
+			continue
+		}
+		for _, part := range attachmentParts(msgContent.Payload) {
+			infos = append(infos, describePart(msgContent, part))
+		}
+	}
+	if len(getMsgCErr) != 0 {
+		return nil, <-getMsgCErr
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].Date.Equal(infos[j].Date) {
+			return infos[i].Date.Before(infos[j].Date)
+		}
+		if infos[i].MessageID != infos[j].MessageID {
+			return infos[i].MessageID < infos[j].MessageID
+		}
+		return infos[i].PartID < infos[j].PartID
+	})
+	return infos, nil
+}
+
+// describePart returns the metadata of an attachment part of msg.
+func describePart(msg *gmail.Message, part *gmail.MessagePart) attachmentInfo {
+	info := attachmentInfo{
+		MessageID: msg.Id,
+		ThreadID:  msg.ThreadId,
+		PartID:    part.PartId,
+		From:      header(msg.Payload, "From"),
+		Subject:   header(msg.Payload, "Subject"),
+		Date:      time.Unix(0, msg.InternalDate*1e6).UTC(),
+		Filename:  partFileName(part),
+		MimeType:  part.MimeType,
+	}
+	if part.Body != nil {
+		info.AttachmentID = part.Body.AttachmentId
+		info.Size = part.Body.Size
+	}
+	return info
+}
+
+// header returns the value of the named header of part.
+func header(part *gmail.MessagePart, name string) string {
+	if part == nil {
+		return ""
+	}
+	for _, h := range part.Headers {
+		if strings.EqualFold(h.Name, name) {
+			return h.Value
+		}
+	}
+	return ""
+}
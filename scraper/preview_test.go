@@ -0,0 +1,86 @@
+package scraper
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+type mockMessageContentWithMetadata struct {
+}
+
+func (m *mockMessageContentWithMetadata) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	layout := "01/02/2006 3:04:05 PM"
+	t, _ := time.Parse(layout, "11/20/2019 2:03:46 PM")
+	gm := gmail.Message{
+		Id:           id,
+		ThreadId:     "thread-" + id,
+		InternalDate: t.UnixNano() / 1e6,
+		Payload: &gmail.MessagePart{
+			MimeType: "multipart/mixed",
+			Headers: []*gmail.MessagePartHeader{
+				{Name: "From", Value: "Billing <billing@vendor.com>"},
+				{Name: "subject", Value: "Invoice " + id},
+			},
+			Parts: []*gmail.MessagePart{
+				{PartId: "0", MimeType: "text/plain", Body: &gmail.MessagePartBody{Data: "aGk="}},
+				{
+					PartId:   "1",
+					Filename: id + ".pdf",
+					MimeType: "application/pdf",
+					Body:     &gmail.MessagePartBody{AttachmentId: "attach-" + id, Size: 2048},
+				},
+			},
+		},
+	}
+	return &gm, nil
+}
+
+func Test_preview_shouldDescribeAttachments(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithMetadata{},
+	}
+
+	infos, err := p.preview("from:billing@vendor.com")
+	if err != nil {
+		t.Fatalf("preview() unexpected error: %v", err)
+	}
+	if len(infos) != 5 {
+		t.Fatalf("preview() returned %v attachments, want %v", len(infos), 5)
+	}
+
+	want := attachmentInfo{
+		MessageID:    "16c2",
+		ThreadID:     "thread-16c2",
+		PartID:       "1",
+		AttachmentID: "attach-16c2",
+		From:         "Billing <billing@vendor.com>",
+		Subject:      "Invoice 16c2",
+		Date:         time.Date(2019, 11, 20, 14, 3, 46, 0, time.UTC),
+		Filename:     "16c2.pdf",
+		MimeType:     "application/pdf",
+		Size:         2048,
+	}
+	if infos[0] != want {
+		t.Errorf("preview() = %+v, want %+v", infos[0], want)
+	}
+}
+
+func Test_preview_shouldReturnListingErrors(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessageWithFetchMessagesError{},
+		cont:    &mockMessageContentWithMetadata{},
+	}
+
+	_, err := p.preview("from:billing@vendor.com")
+	expected := "Unable to retrieve Messages Couldn't fetch messages"
+	if err == nil || err.Error() != expected {
+		t.Errorf("preview() = %v, want %v", err, expected)
+	}
+}
@@ -0,0 +1,170 @@
+package scraper
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+)
+
+type eventType string
+
+const (
+	eventMessagesListed       eventType = "messages_listed"
+	eventMessageFetched       eventType = "message_fetched"
+	eventAttachmentDownloaded eventType = "attachment_downloaded"
+	eventArchiveFinalized     eventType = "archive_finalized"
+	eventError                eventType = "error"
+)
+
+// eventStreamClaim decodes the JWT of a request for an event stream. The
+// browser's EventSource can't set headers, so it may send the JWT as the
+// access_token query parameter instead. No other endpoint accepts it there,
+// where it would end up in logs and browser history.
+func eventStreamClaim(r *http.Request) (*oauth.Claims, error) {
+	if len(r.Header.Get("Authorization")) == 0 {
+		if token := r.URL.Query().Get("access_token"); len(token) != 0 {
+			return oauth.DecodeJwtToken(token)
+		}
+	}
+	return claimFromRequest(r)
+}
+
+// keepAliveInterval is how often a comment is sent on an idle event stream
+// so that proxies in between don't close the connection.
+const keepAliveInterval = 15 * time.Second
+
+// progressEvent describes something that happened in one of the pipeline
+// stages.
+type progressEvent struct {
+	Type      eventType `json:"type"`
+	MessageID string    `json:"messageId,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	Count     int64     `json:"count,omitempty"`
+	Stage     stage     `json:"stage,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// progress records the events published by a pipeline so that any number of
+// subscribers, including late ones, can follow them. A nil *progress
+// discards everything published to it.
+type progress struct {
+	mu      sync.Mutex
+	events  []progressEvent
+	closed  bool
+	changed chan struct{}
+}
+
+func newProgress() *progress {
+	return &progress{changed: make(chan struct{})}
+}
+
+func (p *progress) publish(e progressEvent) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.events = append(p.events, e)
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// close marks the end of the events. Subscribers are woken up one last time.
+func (p *progress) close() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.changed)
+}
+
+// since returns the events published after the first n ones, a channel that
+// is closed when more are published and whether no more will be.
+func (p *progress) since(n int) ([]progressEvent, <-chan struct{}, bool) {
+	if p == nil {
+		return nil, nil, true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n > len(p.events) {
+		n = len(p.events)
+	}
+	events := make([]progressEvent, len(p.events)-n)
+	copy(events, p.events[n:])
+	return events, p.changed, p.closed
+}
+
+// GetJobEvents streams the progress of a scrape job as server-sent events.
+// Clients that reconnect with a Last-Event-ID header resume after that event.
+func GetJobEvents(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobFromRequest(w, r, eventStreamClaim)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		errorResponseWithStatus(w, http.StatusInternalServerError, "streaming is not supported")
+		return //nolint
+	}
+
+	next := 0
+	if lastID, err := strconv.Atoi(r.Header.Get("Last-Event-ID")); err == nil {
+		next = lastID + 1
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		events, changed, closed := j.p.progress.since(next)
+		for _, e := range events {
+			if err := writeEvent(w, next, e); err != nil {
+				return
+			}
+			next++
+		}
+		flusher.Flush()
+		if closed {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n") // nolint
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, id int, e progressEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, e.Type, data)
+	return err
+}
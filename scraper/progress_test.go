@@ -0,0 +1,135 @@
+package scraper
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func Test_progress_since_shouldReturnNewEvents(t *testing.T) {
+	p := newProgress()
+	p.publish(progressEvent{Type: eventMessagesListed, Count: 2})
+	_, changed, _ := p.since(1)
+	p.publish(progressEvent{Type: eventMessageFetched, MessageID: "16c2"})
+
+	select {
+	case <-changed:
+	default:
+		t.Errorf("publish() expected subscribers to be notified")
+	}
+
+	events, _, closed := p.since(1)
+	if len(events) != 1 || events[0].MessageID != "16c2" {
+		t.Errorf("since() = %v, want the message_fetched event", events)
+	}
+	if closed {
+		t.Errorf("since() expected progress to still be open")
+	}
+}
+
+func Test_progress_close_shouldIgnoreLaterEvents(t *testing.T) {
+	p := newProgress()
+	p.close()
+	p.publish(progressEvent{Type: eventError})
+
+	events, _, closed := p.since(0)
+	if len(events) != 0 {
+		t.Errorf("since() = %v, want no events", events)
+	}
+	if !closed {
+		t.Errorf("since() expected progress to be closed")
+	}
+}
+
+func Test_progress_shouldDiscardEventsWhenNil(t *testing.T) {
+	var p *progress
+	p.publish(progressEvent{Type: eventError})
+	p.close()
+
+	if _, _, closed := p.since(0); !closed {
+		t.Errorf("since() expected a nil progress to be closed")
+	}
+}
+
+func Test_GetJobEvents_shouldStreamJobProgress(t *testing.T) {
+	p := newTestPipeline(&mockMessage{})
+	p.progress = newProgress()
+	j := newJob("owner", testFilter, p)
+	jobs.mu.Lock()
+	jobs.jobs[j.id] = j
+	jobs.mu.Unlock()
+	j.execute()
+	defer j.cleanup()
+
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+j.id+"/events?access_token="+newTestJwtToken(t, "owner"), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": j.id})
+	w := httptest.NewRecorder()
+
+	GetJobEvents(w, r)
+
+	if contentType := w.Header().Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("GetJobEvents() content type = %v, want %v", contentType, "text/event-stream")
+	}
+	body := w.Body.String()
+	for _, expected := range []string{
+		"id: 0\nevent: messages_listed\ndata: {\"type\":\"messages_listed\",\"count\":5}\n\n",
+		"event: message_fetched\n",
+		"event: archive_finalized\n",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("GetJobEvents() = %q, expected it to contain %q", body, expected)
+		}
+	}
+}
+
+func Test_GetJobEvents_shouldResumeAfterLastEventID(t *testing.T) {
+	p := newTestPipeline(&mockMessage{})
+	p.progress = newProgress()
+	j := newJob("owner", testFilter, p)
+	jobs.mu.Lock()
+	jobs.jobs[j.id] = j
+	jobs.mu.Unlock()
+	j.execute()
+	defer j.cleanup()
+
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+j.id+"/events", nil)
+	r.Header.Add("Authorization", "Bearer "+newTestJwtToken(t, "owner"))
+	r.Header.Add("Last-Event-ID", "0")
+	r = mux.SetURLVars(r, map[string]string{"id": j.id})
+	w := httptest.NewRecorder()
+
+	GetJobEvents(w, r)
+
+	body := w.Body.String()
+	if strings.Contains(body, "event: messages_listed") {
+		t.Errorf("GetJobEvents() = %q, expected events up to Last-Event-ID to be skipped", body)
+	}
+	if !strings.HasPrefix(body, "id: 1\n") {
+		t.Errorf("GetJobEvents() = %q, expected to resume at id 1", body)
+	}
+}
+
+func Test_GetJob_shouldRefuseTheTokenInTheQuery(t *testing.T) {
+	j := newJob("owner", testFilter, newTestPipeline(&mockMessage{}))
+	jobs.mu.Lock()
+	jobs.jobs[j.id] = j
+	jobs.mu.Unlock()
+	defer func() {
+		jobs.mu.Lock()
+		delete(jobs.jobs, j.id)
+		jobs.mu.Unlock()
+	}()
+
+	r := httptest.NewRequest(http.MethodGet, "/jobs/"+j.id+"?access_token="+newTestJwtToken(t, "owner"), nil)
+	r = mux.SetURLVars(r, map[string]string{"id": j.id})
+	w := httptest.NewRecorder()
+
+	GetJob(w, r)
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("GetJob() = %v, want %v", w.Code, http.StatusUnauthorized)
+	}
+}
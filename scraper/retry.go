@@ -0,0 +1,226 @@
+package scraper
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// retryableReasons are the Gmail error reasons worth retrying whatever the
+// status code, as rate limit errors are sometimes sent as a 403.
+var retryableReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"backendError":          true,
+}
+
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// retryPolicy retries transient Gmail errors with jittered exponential
+// backoff.
+type retryPolicy struct {
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	// sleep waits for the given delay, or fails with the error of ctx if
+	// it's done first.
+	sleep func(ctx context.Context, d time.Duration) error
+	// retryable decides which errors are transient, isRetryable when it is
+	// nil.
+	retryable func(error) bool
+}
+
+var defaultRetryPolicy = retryPolicy{
+	maxAttempts: envInt("GMAIL_MAX_ATTEMPTS", 5),
+	baseDelay:   500 * time.Millisecond,
+	maxDelay:    32 * time.Second,
+	sleep:       sleepContext,
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isRetryable reports whether err is a transient error: a rate limit, a
+// Gmail server error or a network timeout.
+func isRetryable(err error) bool {
+	if apiErr, ok := err.(*googleapi.Error); ok {
+		if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500 {
+			return true
+		}
+		for _, item := range apiErr.Errors {
+			if retryableReasons[item.Reason] {
+				return true
+			}
+		}
+		return false
+	}
+	if netErr, ok := err.(net.Error); ok {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// do calls call until it succeeds, fails with an error that isn't
+// retryable, runs out of attempts or ctx is done. The last error is
+// returned.
+func (rp retryPolicy) do(ctx context.Context, call func() error) error {
+	retryable := rp.retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || !retryable(err) || attempt >= rp.maxAttempts {
+			return err
+		}
+		if sleepErr := rp.sleep(ctx, rp.delay(attempt, err)); sleepErr != nil {
+			return err
+		}
+	}
+}
+
+// delay returns how long to wait after the given failed attempt. Gmail's
+// Retry-After header is honoured, otherwise a random delay up to an
+// exponentially growing cap is used so that workers don't retry in lockstep.
+func (rp retryPolicy) delay(attempt int, err error) time.Duration {
+	if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Header != nil {
+		if seconds, err := strconv.Atoi(apiErr.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	backoff := rp.maxDelay
+	if shift := uint(attempt - 1); shift < 32 && rp.baseDelay<<shift < rp.maxDelay {
+		backoff = rp.baseDelay << shift
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(backoff))) + 1
+}
+
+// retryingMessages retries transient errors when listing messages.
+type retryingMessages struct {
+	next   messageSevice
+	policy retryPolicy
+}
+
+func (m *retryingMessages) fetchMessages(
+	ctx context.Context, service *gmail.Service,
+	query string) (*gmail.ListMessagesResponse, error) {
+	var r *gmail.ListMessagesResponse
+	err := m.policy.do(ctx, func() (err error) {
+		r, err = m.next.fetchMessages(ctx, service, query)
+		return err
+	})
+	return r, err
+}
+
+func (m *retryingMessages) fetchNextPage(
+	ctx context.Context, service *gmail.Service,
+	query string,
+	NextPageToken string) (*gmail.ListMessagesResponse, error) {
+	var r *gmail.ListMessagesResponse
+	err := m.policy.do(ctx, func() (err error) {
+		r, err = m.next.fetchNextPage(ctx, service, query, NextPageToken)
+		return err
+	})
+	return r, err
+}
+
+// retryingContent retries transient errors when fetching a message.
+type retryingContent struct {
+	next   content
+	policy retryPolicy
+}
+
+func (c *retryingContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	var msg *gmail.Message
+	err := c.policy.do(ctx, func() (err error) {
+		msg, err = c.next.getContent(ctx, service, id)
+		return err
+	})
+	return msg, err
+}
+
+// retryingAttachments retries transient errors when fetching an attachment.
+type retryingAttachments struct {
+	next   attachmentService
+	policy retryPolicy
+}
+
+func (a *retryingAttachments) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	var body *gmail.MessagePartBody
+	err := a.policy.do(ctx, func() (err error) {
+		body, err = a.next.fetchAttachment(ctx, service, msgID, attachID)
+		return err
+	})
+	return body, err
+}
+
+// retryingLabels retries transient errors when listing labels.
+type retryingLabels struct {
+	next   labelService
+	policy retryPolicy
+}
+
+func (l *retryingLabels) listLabels(ctx context.Context, service *gmail.Service) (*gmail.ListLabelsResponse, error) {
+	var r *gmail.ListLabelsResponse
+	err := l.policy.do(ctx, func() (err error) {
+		r, err = l.next.listLabels(ctx, service)
+		return err
+	})
+	return r, err
+}
+
+// retryingHistory retries transient errors when reading the mailbox history.
+type retryingHistory struct {
+	next   historyService
+	policy retryPolicy
+}
+
+func (h *retryingHistory) getProfile(ctx context.Context, service *gmail.Service) (*gmail.Profile, error) {
+	var r *gmail.Profile
+	err := h.policy.do(ctx, func() (err error) {
+		r, err = h.next.getProfile(ctx, service)
+		return err
+	})
+	return r, err
+}
+
+func (h *retryingHistory) listHistory(
+	ctx context.Context, service *gmail.Service,
+	startHistoryID uint64,
+	pageToken string) (*gmail.ListHistoryResponse, error) {
+	var r *gmail.ListHistoryResponse
+	err := h.policy.do(ctx, func() (err error) {
+		r, err = h.next.listHistory(ctx, service, startHistoryID, pageToken)
+		return err
+	})
+	return r, err
+}
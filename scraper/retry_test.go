@@ -0,0 +1,239 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "too many requests", err: &googleapi.Error{Code: 429}, want: true},
+		{name: "server error", err: &googleapi.Error{Code: 503}, want: true},
+		{
+			name: "rate limit sent as forbidden",
+			err: &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{
+				{Reason: "userRateLimitExceeded"},
+			}},
+			want: true,
+		},
+		{
+			name: "backend error",
+			err:  &googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "backendError"}}},
+			want: true,
+		},
+		{name: "not found", err: &googleapi.Error{Code: 404}, want: false},
+		{
+			name: "forbidden",
+			err:  &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}},
+			want: false,
+		},
+		{name: "network timeout", err: timeoutError{}, want: true},
+		{name: "other error", err: errors.New("boom"), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestRetryPolicy(delays *[]time.Duration) retryPolicy {
+	return retryPolicy{
+		maxAttempts: 4,
+		baseDelay:   100 * time.Millisecond,
+		maxDelay:    time.Second,
+		sleep: func(ctx context.Context, d time.Duration) error {
+			*delays = append(*delays, d)
+			return nil
+		},
+	}
+}
+
+func Test_retryPolicy_delay(t *testing.T) {
+	rp := retryPolicy{baseDelay: 100 * time.Millisecond, maxDelay: time.Second}
+	err := &googleapi.Error{Code: 503}
+
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond,
+		800 * time.Millisecond, time.Second, time.Second,
+	} {
+		if d := rp.delay(attempt+1, err); d <= 0 || d > max {
+			t.Errorf("delay(%d) = %v, want it within (0, %v]", attempt+1, d, max)
+		}
+	}
+
+	retryAfter := &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": []string{"7"}}}
+	if d := rp.delay(1, retryAfter); d != 7*time.Second {
+		t.Errorf("delay() = %v, want %v", d, 7*time.Second)
+	}
+}
+
+type mockFlakyContent struct {
+	calls    int
+	failures int
+	err      error
+}
+
+func (m *mockFlakyContent) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	m.calls++
+	if m.calls <= m.failures {
+		return nil, m.err
+	}
+	return &gmail.Message{Id: id, Payload: &gmail.MessagePart{}}, nil
+}
+
+func Test_retryingContent_shouldRetryTransientErrors(t *testing.T) {
+	var delays []time.Duration
+	mc := &mockFlakyContent{failures: 2, err: &googleapi.Error{Code: 429}}
+	c := &retryingContent{next: mc, policy: newTestRetryPolicy(&delays)}
+
+	msg, err := c.getContent(context.Background(), new(gmail.Service), "16c2")
+	if err != nil {
+		t.Fatalf("getContent() unexpected error: %v", err)
+	}
+	if msg.Id != "16c2" {
+		t.Errorf("getContent() = %v, want %v", msg.Id, "16c2")
+	}
+	if mc.calls != 3 || len(delays) != 2 {
+		t.Errorf("getContent() made %v calls and %v waits, want 3 and 2", mc.calls, len(delays))
+	}
+}
+
+func Test_retryingContent_shouldGiveUpAfterMaxAttempts(t *testing.T) {
+	var delays []time.Duration
+	mc := &mockFlakyContent{failures: 10, err: &googleapi.Error{Code: 500}}
+	c := &retryingContent{next: mc, policy: newTestRetryPolicy(&delays)}
+
+	_, err := c.getContent(context.Background(), new(gmail.Service), "16c2")
+	if err == nil {
+		t.Fatalf("getContent() expected an error")
+	}
+	if mc.calls != 4 {
+		t.Errorf("getContent() made %v calls, want %v", mc.calls, 4)
+	}
+}
+
+func Test_retryingContent_shouldNotRetryPermanentErrors(t *testing.T) {
+	var delays []time.Duration
+	mc := &mockFlakyContent{failures: 1, err: &googleapi.Error{Code: 404}}
+	c := &retryingContent{next: mc, policy: newTestRetryPolicy(&delays)}
+
+	_, err := c.getContent(context.Background(), new(gmail.Service), "16c2")
+	if err == nil {
+		t.Fatalf("getContent() expected an error")
+	}
+	if mc.calls != 1 || len(delays) != 0 {
+		t.Errorf("getContent() made %v calls, want %v", mc.calls, 1)
+	}
+}
+
+type mockFlakyMessage struct {
+	mockMessage
+	calls int
+}
+
+func (m *mockFlakyMessage) fetchMessages(
+	ctx context.Context, service *gmail.Service,
+	query string) (*gmail.ListMessagesResponse, error) {
+	m.calls++
+	if m.calls == 1 {
+		return nil, &googleapi.Error{Code: 503}
+	}
+	return m.mockMessage.fetchMessages(ctx, service, query)
+}
+
+func Test_retryingMessages_shouldRetryTransientErrors(t *testing.T) {
+	var delays []time.Duration
+	ms := &mockFlakyMessage{}
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &retryingMessages{next: ms, policy: newTestRetryPolicy(&delays)},
+	}
+
+	ids, errs := p.getIDs(context.Background(), "from:test@mail.com")
+	if len(errs) != 0 {
+		t.Fatalf("getIDs() unexpected error: %v", <-errs)
+	}
+	count := 0
+	for range ids {
+		count++
+	}
+	if count != 5 {
+		t.Errorf("getIDs() = %v ids, want %v", count, 5)
+	}
+}
+
+type mockAttachmentWithPermanentError struct {
+}
+
+func (a *mockAttachmentWithPermanentError) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	if msgID == "fgb" {
+		return nil, &googleapi.Error{Code: 404, Message: "Requested entity was not found."}
+	}
+	return &gmail.MessagePartBody{Data: "aGk="}, nil
+}
+
+func Test_run_shouldFailOnPermanentErrors(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithPermanentError{},
+	}
+
+	err := p.run("from:test@mail.com", newZipWriter(new(bytes.Buffer)))
+	if err == nil {
+		t.Errorf("run() expected the permanent error to abort the scrape")
+	}
+}
+
+func Test_run_shouldSkipPermanentErrorsWhenAsked(t *testing.T) {
+	p := &pipeline{
+		service:  new(gmail.Service),
+		ms:       &mockMessage{},
+		cont:     &mockMessageContentWithAttachment{},
+		as:       &mockAttachmentWithPermanentError{},
+		progress: newProgress(),
+		onError:  skipOnError,
+	}
+
+	if err := p.run("from:test@mail.com", newZipWriter(new(bytes.Buffer))); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	if p.attachments != 4 {
+		t.Errorf("run() saved %v attachments, want %v", p.attachments, 4)
+	}
+
+	events, _, _ := p.progress.since(0)
+	skipped := 0
+	for _, e := range events {
+		if e.Type == eventError && e.MessageID == "fgb" {
+			skipped++
+		}
+	}
+	if skipped != 1 {
+		t.Errorf("run() reported %v skipped attachments, want %v", skipped, 1)
+	}
+}
@@ -0,0 +1,472 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+	"github.com/dchest/uniuri"
+	"github.com/gorilla/mux"
+	"github.com/robfig/cron/v3"
+)
+
+// scheduleOptions are the per-request options a schedule may save, see
+// pipeline.configure. Passphrases can't be saved, so scheduled archives can
+// only be encrypted to a publicKey. The webhookSecret is kept in
+// oauth.Secrets instead.
+var scheduleOptions = []string{
+	"onError", "format", "dedup", "layout", "sync", "sink", "encrypt", "publicKey",
+	"webhook",
+}
+
+var schedules = newScheduler(os.Getenv("SCHEDULES_FILE"), scheduledPipeline)
+
+// credentials let a schedule scrape the mailbox of its owner while they are
+// offline.
+type credentials struct {
+	Email string `json:"email"`
+	// UserID is who the oauth tokens are stored for in oauth.Tokens. A
+	// schedule has its own copy of the tokens of its owner, so that it
+	// outlives their login.
+	UserID string `json:"userId"`
+	// Login is the user logged in who created the schedule. Their Google
+	// grant is the one the tokens were copied from.
+	Login string `json:"login,omitempty"`
+}
+
+// credentialsFromRequest reads the user who sent r and the address of their
+// mailbox.
+var credentialsFromRequest = func(r *http.Request) (*credentials, error) {
+	claim, err := claimFromRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	service, err := oauth.GetGmailService(claim.RandomID)
+	if err != nil {
+		return nil, err
+	}
+
+	mailbox, err := mailboxes.of(r.Context(), service, claim.RandomID)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{Email: mailbox, UserID: claim.RandomID}, nil
+}
+
+// SchedulesOf counts the schedules created by the user logged in as userID.
+// They run with the Google grant of the user, which logging out would
+// revoke.
+func SchedulesOf(userID string) (int, error) {
+	return schedules.createdBy(userID), nil
+}
+
+// scheduledPipeline builds the pipeline of a scheduled scrape.
+func scheduledPipeline(c *credentials) (*pipeline, error) {
+	service, err := oauth.GetGmailService(c.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeline(service, c.Email), nil
+}
+
+// schedule is a saved scrape that runs on a cron schedule.
+type schedule struct {
+	ID          string            `json:"id"`
+	Cron        string            `json:"cron"`
+	Filter      *filter           `json:"filter"`
+	Options     map[string]string `json:"options,omitempty"`
+	CreatedAt   time.Time         `json:"createdAt"`
+	LastRun     *jobStatus        `json:"lastRun,omitempty"`
+	Credentials credentials       `json:"credentials"`
+}
+
+// scheduleStatus is what the owner of a schedule gets to see of it.
+type scheduleStatus struct {
+	ID        string            `json:"id"`
+	Cron      string            `json:"cron"`
+	Filter    *filter           `json:"filter"`
+	Options   map[string]string `json:"options,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	NextRun   *time.Time        `json:"nextRun,omitempty"`
+	LastRun   *jobStatus        `json:"lastRun,omitempty"`
+}
+
+// request rebuilds a request holding the options of the schedule and the
+// secret of its webhook, for pipeline.configure.
+func (s *schedule) request() *http.Request {
+	query := url.Values{}
+	for key, value := range s.Options {
+		query.Set(key, value)
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/?"+query.Encode(), nil)
+	if _, ok := s.Options["webhook"]; ok {
+		secret, err := oauth.Secrets.Get(s.Credentials.UserID)
+		if err != nil {
+			log.Printf("unable to read the webhook secret of schedule %s: %v", s.ID, err)
+		}
+		r.Header.Set(webhookSecretHeader, string(secret))
+	}
+	return r
+}
+
+// scheduler runs saved scrapes when their cron schedule is due. Schedules
+// are saved to a JSON file when it has a path, and only kept in memory
+// otherwise. The oauth tokens of the schedules are kept in oauth.Tokens and
+// the secrets of their webhooks in oauth.Secrets.
+type scheduler struct {
+	mu        sync.Mutex
+	path      string
+	schedules map[string]*schedule
+	entries   map[string]cron.EntryID
+	cron      *cron.Cron
+	// pipeline builds the pipeline a run scrapes with.
+	pipeline func(*credentials) (*pipeline, error)
+}
+
+func newScheduler(path string, pipeline func(*credentials) (*pipeline, error)) *scheduler {
+	s := &scheduler{
+		path:      path,
+		schedules: make(map[string]*schedule),
+		entries:   make(map[string]cron.EntryID),
+		cron:      cron.New(cron.WithChain(cron.SkipIfStillRunning(cron.DefaultLogger))),
+		pipeline:  pipeline,
+	}
+	if err := s.load(); err != nil {
+		log.Printf("unable to load the schedules %s: %v", path, err)
+	}
+	s.cron.Start()
+	return s
+}
+
+func (s *scheduler) load() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []*schedule
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return err
+	}
+	for _, sc := range saved {
+		if err := s.start(sc); err != nil {
+			log.Printf("unable to start schedule %s: %v", sc.ID, err)
+		}
+	}
+	return nil
+}
+
+// save writes every schedule to the file of the scheduler. It must be
+// called with s.mu held.
+func (s *scheduler) save() error {
+	if len(s.path) == 0 {
+		return nil
+	}
+	saved := make([]*schedule, 0, len(s.schedules))
+	for _, sc := range s.schedules {
+		saved = append(saved, sc)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].CreatedAt.Before(saved[j].CreatedAt) })
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// start registers sc with the cron runner.
+func (s *scheduler) start(sc *schedule) error {
+	id := sc.ID
+	entry, err := s.cron.AddFunc(sc.Cron, func() { s.run(id) })
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[id] = sc
+	s.entries[id] = entry
+	return nil
+}
+
+// add validates and saves sc, and starts running it.
+func (s *scheduler) add(sc *schedule) error {
+	if _, err := cron.ParseStandard(sc.Cron); err != nil {
+		return fmt.Errorf("invalid cron schedule: %v", err)
+	}
+	if err := sc.Filter.validate(); err != nil {
+		return err
+	}
+	p := &pipeline{}
+	if err := p.configure(sc.request()); err != nil {
+		return err
+	}
+	if p.sink == nil && p.archiveFormat() != directoryFormat {
+		return errors.New("a scheduled scrape must be sent to a sink or use the dir format")
+	}
+
+	if err := s.start(sc); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.save(); err != nil {
+		s.cron.Remove(s.entries[sc.ID])
+		delete(s.schedules, sc.ID)
+		delete(s.entries, sc.ID)
+		return err
+	}
+	return nil
+}
+
+// remove stops and forgets the schedule with id and its secrets if it
+// belongs to owner.
+func (s *scheduler) remove(id, owner string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.schedules[id]
+	if !ok || sc.Credentials.Email != owner {
+		return false, nil
+	}
+	s.cron.Remove(s.entries[id])
+	delete(s.schedules, id)
+	delete(s.entries, id)
+	if err := oauth.Tokens.Delete(sc.Credentials.UserID); err != nil {
+		log.Printf("unable to delete the tokens of schedule %s: %v", id, err)
+	}
+	if err := oauth.Secrets.Delete(sc.Credentials.UserID); err != nil {
+		log.Printf("unable to delete the webhook secret of schedule %s: %v", id, err)
+	}
+	return true, s.save()
+}
+
+// list returns the schedules of owner, oldest first.
+func (s *scheduler) list(owner string) []scheduleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := []scheduleStatus{}
+	for _, sc := range s.schedules {
+		if sc.Credentials.Email == owner {
+			statuses = append(statuses, s.status(sc))
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].CreatedAt.Before(statuses[j].CreatedAt) })
+	return statuses
+}
+
+// createdBy counts the schedules created by the user logged in as login.
+func (s *scheduler) createdBy(login string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, sc := range s.schedules {
+		if sc.Credentials.Login == login {
+			n++
+		}
+	}
+	return n
+}
+
+// get returns the status of the schedule with id if it belongs to owner.
+func (s *scheduler) get(id, owner string) (scheduleStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc, ok := s.schedules[id]
+	if !ok || sc.Credentials.Email != owner {
+		return scheduleStatus{}, false
+	}
+	return s.status(sc), true
+}
+
+// status must be called with s.mu held.
+func (s *scheduler) status(sc *schedule) scheduleStatus {
+	status := scheduleStatus{
+		ID:        sc.ID,
+		Cron:      sc.Cron,
+		Filter:    sc.Filter,
+		Options:   sc.Options,
+		CreatedAt: sc.CreatedAt,
+		LastRun:   sc.LastRun,
+	}
+	if next := s.cron.Entry(s.entries[sc.ID]).Next; !next.IsZero() {
+		status.NextRun = &next
+	}
+	return status
+}
+
+// run scrapes the schedule with id as a job, which stores its archive in
+// the schedule's sink, and records the outcome.
+func (s *scheduler) run(id string) {
+	s.mu.Lock()
+	sc, ok := s.schedules[id]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	c := sc.Credentials
+	f := sc.Filter
+	r := sc.request()
+	s.mu.Unlock()
+
+	p, err := s.pipeline(&c)
+	if err != nil {
+		log.Printf("unable to run schedule %s: %v", id, err)
+		return
+	}
+	if err := p.configure(r); err != nil {
+		log.Printf("unable to configure schedule %s: %v", id, err)
+		return
+	}
+	j := newJob(c.Email, f, p)
+	j.execute()
+	status := j.status()
+	j.cleanup()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc, ok := s.schedules[id]; ok {
+		sc.LastRun = &status
+		if err := s.save(); err != nil {
+			log.Printf("unable to save the schedules: %v", err)
+		}
+	}
+}
+
+// CreateSchedule saves a scrape that runs on a cron schedule, like
+// {"cron": "0 8 * * MON", "filter": {"from": ["billing@vendor.com"]},
+// "options": {"sink": "s3", "sync": "true"}}.
+func CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	c, err := credentialsFromRequest(r)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return //nolint
+	}
+	token, err := oauth.Tokens.Get(c.UserID)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return //nolint
+	}
+	if len(token.RefreshToken) == 0 {
+		errorResponse(w, "offline access is required to schedule scrapes, please log in again")
+		return //nolint
+	}
+
+	var body struct {
+		Cron    string            `json:"cron"`
+		Filter  *filter           `json:"filter"`
+		Options map[string]string `json:"options"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		errorResponse(w, "invalid schedule: "+err.Error())
+		return //nolint
+	}
+	if body.Filter == nil {
+		body.Filter = new(filter)
+	}
+	options := make(map[string]string)
+	for _, key := range scheduleOptions {
+		if value, ok := body.Options[key]; ok {
+			options[key] = value
+		}
+	}
+	var webhookSecret string
+	if rawURL, ok := options["webhook"]; ok {
+		webhookSecret = r.Header.Get(webhookSecretHeader)
+		if len(webhookSecret) == 0 {
+			webhookSecret = body.Options["webhookSecret"]
+		}
+		if _, err := newWebhook(rawURL, webhookSecret); err != nil {
+			errorResponse(w, err.Error())
+			return //nolint
+		}
+	}
+
+	id := uniuri.NewLen(16)
+	sc := &schedule{
+		ID:          id,
+		Cron:        body.Cron,
+		Filter:      body.Filter,
+		Options:     options,
+		CreatedAt:   time.Now(),
+		Credentials: credentials{Email: c.Email, UserID: "schedule-" + id, Login: c.UserID},
+	}
+	// The copy never expires, it is deleted along with the schedule.
+	if err := oauth.Tokens.Put(sc.Credentials.UserID, token, time.Time{}); err != nil {
+		errorResponseWithStatus(w, http.StatusInternalServerError, "Unable to store the tokens "+err.Error())
+		return //nolint
+	}
+	if len(webhookSecret) != 0 {
+		if err := oauth.Secrets.Put(sc.Credentials.UserID, []byte(webhookSecret)); err != nil {
+			oauth.Tokens.Delete(sc.Credentials.UserID) // nolint
+			errorResponseWithStatus(w, http.StatusInternalServerError, "Unable to store the webhook secret "+err.Error())
+			return //nolint
+		}
+	}
+	if err := schedules.add(sc); err != nil {
+		oauth.Tokens.Delete(sc.Credentials.UserID)  // nolint
+		oauth.Secrets.Delete(sc.Credentials.UserID) // nolint
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	status, _ := schedules.get(sc.ID, c.Email)
+	w.Header().Set("Location", "/schedules/"+sc.ID)
+	jsonResponse(w, http.StatusCreated, status)
+}
+
+// ListSchedules responds with the schedules of the user.
+func ListSchedules(w http.ResponseWriter, r *http.Request) {
+	c, err := credentialsFromRequest(r)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return //nolint
+	}
+	jsonResponse(w, http.StatusOK, schedules.list(c.Email))
+}
+
+// GetSchedule reports a schedule of the user and how its last run went.
+func GetSchedule(w http.ResponseWriter, r *http.Request) {
+	c, err := credentialsFromRequest(r)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return //nolint
+	}
+	status, ok := schedules.get(mux.Vars(r)["id"], c.Email)
+	if !ok {
+		errorResponseWithStatus(w, http.StatusNotFound, "schedule not found")
+		return //nolint
+	}
+	jsonResponse(w, http.StatusOK, status)
+}
+
+// DeleteSchedule stops a schedule of the user.
+func DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	c, err := credentialsFromRequest(r)
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusUnauthorized, err.Error())
+		return //nolint
+	}
+	ok, err := schedules.remove(mux.Vars(r)["id"], c.Email)
+	if !ok {
+		errorResponseWithStatus(w, http.StatusNotFound, "schedule not found")
+		return //nolint
+	}
+	if err != nil {
+		errorResponseWithStatus(w, http.StatusInternalServerError, "Unable to save the schedules "+err.Error())
+		return //nolint
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
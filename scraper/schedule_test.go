@@ -0,0 +1,364 @@
+package scraper
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/collinewait/ika-gmail-scraper/oauth"
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+func newTestScheduler(t *testing.T, path string) (*scheduler, *mockSink) {
+	sink := &mockSink{}
+	sinks = map[string]Sink{"test": sink}
+	s := newScheduler(path, func(c *credentials) (*pipeline, error) {
+		if token, err := oauth.Tokens.Get(c.UserID); err != nil || token.RefreshToken != "refresh" {
+			t.Errorf("pipeline() tokens of %v = %v, %v, want the refresh token", c, token, err)
+		}
+		return &pipeline{
+			service: new(gmail.Service),
+			ms:      &mockMessage{},
+			cont:    &mockMessageContentWithAttachment{},
+			as:      &mockAttachmentWithData{},
+		}, nil
+	})
+	return s, sink
+}
+
+// useTestTokens replaces oauth.Tokens and oauth.Secrets with empty stores,
+// and stores tokens with a refresh token for userIDs.
+func useTestTokens(t *testing.T, userIDs ...string) {
+	tokens, err := oauth.NewMemoryTokenStore(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewMemoryTokenStore() unexpected error: %v", err)
+	}
+	for _, id := range userIDs {
+		tokens.Put(id, &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}, time.Time{}) // nolint
+	}
+	secrets, err := oauth.NewMemorySecretStore(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewMemorySecretStore() unexpected error: %v", err)
+	}
+	oauth.Tokens = tokens
+	oauth.Secrets = secrets
+}
+
+func newTestSchedule(owner string, options map[string]string) *schedule {
+	return &schedule{
+		ID:          "schedule-" + owner,
+		Cron:        "0 8 * * MON",
+		Filter:      &filter{From: []string{"billing@vendor.com"}},
+		Options:     options,
+		Credentials: credentials{Email: owner, UserID: "schedule-" + owner, Login: "login-" + owner},
+	}
+}
+
+func Test_scheduler_add(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	s, _ := newTestScheduler(t, "")
+	defer s.cron.Stop()
+
+	tests := []struct {
+		name    string
+		cron    string
+		options map[string]string
+		wantErr bool
+	}{
+		{name: "weekly to a sink", cron: "0 8 * * MON", options: map[string]string{"sink": "test"}},
+		{name: "descriptor", cron: "@daily", options: map[string]string{"sink": "test", "sync": "true"}},
+		{name: "invalid cron", cron: "every monday", options: map[string]string{"sink": "test"}, wantErr: true},
+		{name: "seconds field", cron: "0 0 8 * * MON", options: map[string]string{"sink": "test"}, wantErr: true},
+		{name: "without a sink", cron: "@daily", wantErr: true},
+		{name: "unknown sink", cron: "@daily", options: map[string]string{"sink": "s3"}, wantErr: true},
+		{name: "passphrase encryption", cron: "@daily", options: map[string]string{"sink": "test", "encrypt": "aes"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newTestSchedule("test@mail.com", tt.options)
+			sc.ID = tt.name
+			sc.Cron = tt.cron
+			err := s.add(sc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("add() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			_, ok := s.get(sc.ID, "test@mail.com")
+			if ok == tt.wantErr {
+				t.Errorf("get() = %v after add() error %v", ok, err)
+			}
+		})
+	}
+}
+
+func Test_scheduler_run_shouldStoreTheArchiveAndPersistTheOutcome(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	dir, err := ioutil.TempDir("", "schedule-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedules.json")
+
+	defer func(s oauth.TokenStore) { oauth.Tokens = s }(oauth.Tokens)
+	defer func(s oauth.SecretStore) { oauth.Secrets = s }(oauth.Secrets)
+	s, sink := newTestScheduler(t, path)
+	defer s.cron.Stop()
+	sc := newTestSchedule("test@mail.com", map[string]string{"sink": "test"})
+	useTestTokens(t, sc.Credentials.UserID)
+	if err := s.add(sc); err != nil {
+		t.Fatalf("add() unexpected error: %v", err)
+	}
+
+	s.run(sc.ID)
+
+	status, _ := s.get(sc.ID, "test@mail.com")
+	if status.LastRun == nil || status.LastRun.State != jobSucceeded {
+		t.Fatalf("run() last run = %+v, want a succeeded run", status.LastRun)
+	}
+	if len(sink.names) != 1 || status.LastRun.URL != "https://sink.example.com/"+sink.names[0] {
+		t.Errorf("run() url = %v, stored %v", status.LastRun.URL, sink.names)
+	}
+	if status.NextRun == nil {
+		t.Errorf("get() expected the next run")
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("run() didn't save the schedules: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("schedules file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	reloaded, _ := newTestScheduler(t, path)
+	defer reloaded.cron.Stop()
+	got, ok := reloaded.get(sc.ID, "test@mail.com")
+	if !ok || got.LastRun == nil || got.LastRun.URL != status.LastRun.URL {
+		t.Errorf("reloaded schedule = %+v, want the saved one", got)
+	}
+	if c := reloaded.schedules[sc.ID].Credentials; c != sc.Credentials {
+		t.Errorf("reloaded credentials = %v, want %v", c, sc.Credentials)
+	}
+	if b, _ := ioutil.ReadFile(path); strings.Contains(string(b), "refresh") {
+		t.Errorf("schedules file shouldn't hold the tokens")
+	}
+}
+
+func Test_scheduleHandlers_shouldOnlyManageSchedulesOfTheUser(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	defer func(s *scheduler) { schedules = s }(schedules)
+	defer func(f func(*http.Request) (*credentials, error)) { credentialsFromRequest = f }(credentialsFromRequest)
+	defer func(s oauth.TokenStore) { oauth.Tokens = s }(oauth.Tokens)
+	defer func(s oauth.SecretStore) { oauth.Secrets = s }(oauth.Secrets)
+
+	s, _ := newTestScheduler(t, "")
+	defer s.cron.Stop()
+	schedules = s
+	useTestTokens(t, "a@mail.com", "b@mail.com")
+	credentialsFromRequest = func(r *http.Request) (*credentials, error) {
+		email := r.Header.Get("X-Test-User")
+		if len(email) == 0 {
+			return nil, errors.New("Bearer token not in proper format")
+		}
+		return &credentials{Email: email, UserID: email}, nil
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/schedules", CreateSchedule).Methods(http.MethodPost)
+	router.HandleFunc("/schedules", ListSchedules).Methods(http.MethodGet)
+	router.HandleFunc("/schedules/{id}", GetSchedule).Methods(http.MethodGet)
+	router.HandleFunc("/schedules/{id}", DeleteSchedule).Methods(http.MethodDelete)
+	serve := func(method, target, user, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(user) != 0 {
+			r.Header.Set("X-Test-User", user)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodPost, "/schedules", "a@mail.com",
+		`{"cron": "0 8 * * MON", "filter": {"from": ["billing@vendor.com"]}, "options": {"sink": "test", "passphrase": "ignored"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("CreateSchedule() = %v, want %v (%v)", w.Code, http.StatusCreated, w.Body)
+	}
+	var created scheduleStatus
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatalf("CreateSchedule() sent invalid JSON: %v", err)
+	}
+	if _, ok := created.Options["passphrase"]; ok || created.Options["sink"] != "test" {
+		t.Errorf("CreateSchedule() options = %v, want only the sink", created.Options)
+	}
+	if strings.Contains(serve(http.MethodGet, "/schedules/"+created.ID, "a@mail.com", "").Body.String(), "schedule-") {
+		t.Errorf("GetSchedule() shouldn't send the credentials")
+	}
+	if _, err := oauth.Tokens.Get("schedule-" + created.ID); err != nil {
+		t.Errorf("CreateSchedule() didn't store the tokens of the schedule: %v", err)
+	}
+	if n, _ := SchedulesOf("a@mail.com"); n != 1 {
+		t.Errorf("SchedulesOf() = %v after CreateSchedule(), want %v", n, 1)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		user   string
+		body   string
+		want   int
+	}{
+		{name: "unauthenticated", method: http.MethodGet, target: "/schedules", want: http.StatusUnauthorized},
+		{name: "invalid body", method: http.MethodPost, target: "/schedules", user: "a@mail.com", body: "{", want: http.StatusBadRequest},
+		{name: "schedule of another user", method: http.MethodGet, target: "/schedules/" + created.ID, user: "b@mail.com", want: http.StatusNotFound},
+		{name: "delete schedule of another user", method: http.MethodDelete, target: "/schedules/" + created.ID, user: "b@mail.com", want: http.StatusNotFound},
+		{name: "delete own schedule", method: http.MethodDelete, target: "/schedules/" + created.ID, user: "a@mail.com", want: http.StatusNoContent},
+		{name: "deleted schedule", method: http.MethodGet, target: "/schedules/" + created.ID, user: "a@mail.com", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(tt.method, tt.target, tt.user, tt.body); w.Code != tt.want {
+				t.Errorf("%v %v = %v, want %v", tt.method, tt.target, w.Code, tt.want)
+			}
+		})
+	}
+	if _, err := oauth.Tokens.Get("schedule-" + created.ID); err != oauth.ErrTokenNotFound {
+		t.Errorf("DeleteSchedule() kept the tokens of the schedule: %v", err)
+	}
+	if n, _ := SchedulesOf("a@mail.com"); n != 0 {
+		t.Errorf("SchedulesOf() = %v after DeleteSchedule(), want %v", n, 0)
+	}
+}
+
+func Test_ListSchedules_shouldListSchedulesOfTheUser(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	defer func(s *scheduler) { schedules = s }(schedules)
+	defer func(f func(*http.Request) (*credentials, error)) { credentialsFromRequest = f }(credentialsFromRequest)
+
+	s, _ := newTestScheduler(t, "")
+	defer s.cron.Stop()
+	schedules = s
+	credentialsFromRequest = func(r *http.Request) (*credentials, error) {
+		return &credentials{Email: "a@mail.com"}, nil
+	}
+	for _, owner := range []string{"a@mail.com", "b@mail.com"} {
+		if err := s.add(newTestSchedule(owner, map[string]string{"sink": "test"})); err != nil {
+			t.Fatalf("add() unexpected error: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ListSchedules(w, httptest.NewRequest(http.MethodGet, "/schedules", nil))
+
+	var got []scheduleStatus
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("ListSchedules() sent invalid JSON: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "schedule-a@mail.com" {
+		t.Errorf("ListSchedules() = %+v, want the schedule of a@mail.com", got)
+	}
+}
+
+func Test_SchedulesOf_shouldCountSchedulesOfTheLogin(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	defer func(s *scheduler) { schedules = s }(schedules)
+
+	s, _ := newTestScheduler(t, "")
+	defer s.cron.Stop()
+	schedules = s
+	for _, owner := range []string{"a@mail.com", "b@mail.com"} {
+		if err := s.add(newTestSchedule(owner, map[string]string{"sink": "test"})); err != nil {
+			t.Fatalf("add() unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		login string
+		want  int
+	}{
+		{login: "login-a@mail.com", want: 1},
+		{login: "pseudo-random", want: 0},
+	}
+	for _, tt := range tests {
+		if got, err := SchedulesOf(tt.login); err != nil || got != tt.want {
+			t.Errorf("SchedulesOf(%v) = %v, %v, want %v", tt.login, got, err, tt.want)
+		}
+	}
+}
+
+func Test_CreateSchedule_shouldKeepTheWebhookSecretOutOfTheOptions(t *testing.T) {
+	defer func(s map[string]Sink) { sinks = s }(sinks)
+	defer func(s *scheduler) { schedules = s }(schedules)
+	defer func(f func(*http.Request) (*credentials, error)) { credentialsFromRequest = f }(credentialsFromRequest)
+	defer func(s oauth.TokenStore) { oauth.Tokens = s }(oauth.Tokens)
+	defer func(s oauth.SecretStore) { oauth.Secrets = s }(oauth.Secrets)
+	dir, err := ioutil.TempDir("", "schedule-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "schedules.json")
+
+	s, _ := newTestScheduler(t, path)
+	defer s.cron.Stop()
+	schedules = s
+	useTestTokens(t, "a@mail.com")
+	credentialsFromRequest = func(r *http.Request) (*credentials, error) {
+		return &credentials{Email: "a@mail.com", UserID: "a@mail.com"}, nil
+	}
+
+	tests := []struct {
+		name    string
+		webhook string
+		want    int
+	}{
+		{name: "public webhook", webhook: "https://hooks.example.com/scrapes", want: http.StatusCreated},
+		{name: "private webhook", webhook: "https://192.168.1.1/scrapes", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"cron": "@daily", "filter": {"from": ["billing@vendor.com"]}, "options": {"sink": "test", "webhook": "` + tt.webhook +
+				`", "webhookSecret": "` + testWebhookSecret + `"}}`
+			w := httptest.NewRecorder()
+			CreateSchedule(w, httptest.NewRequest(http.MethodPost, "/schedules", strings.NewReader(body)))
+			if w.Code != tt.want {
+				t.Fatalf("CreateSchedule() = %v, want %v (%v)", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+			if strings.Contains(w.Body.String(), testWebhookSecret) {
+				t.Errorf("CreateSchedule() sent the webhook secret back: %v", w.Body)
+			}
+			if b, _ := ioutil.ReadFile(path); strings.Contains(string(b), testWebhookSecret) {
+				t.Errorf("schedules file shouldn't hold the webhook secret")
+			}
+
+			var created scheduleStatus
+			json.NewDecoder(w.Body).Decode(&created) // nolint
+			s.mu.Lock()
+			r := s.schedules[created.ID].request()
+			s.mu.Unlock()
+			h, err := webhookFromRequest(r)
+			if err != nil || h == nil || string(h.secret) != testWebhookSecret {
+				t.Errorf("request() webhook = %+v, %v, want the secret", h, err)
+			}
+
+			if ok, _ := s.remove(created.ID, "a@mail.com"); !ok {
+				t.Fatalf("remove() didn't remove the schedule")
+			}
+			if _, err := oauth.Secrets.Get("schedule-" + created.ID); err != oauth.ErrSecretNotFound {
+				t.Errorf("remove() kept the webhook secret: %v", err)
+			}
+		})
+	}
+}
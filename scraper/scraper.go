@@ -1,15 +1,19 @@
 package scraper
 
 import (
-	"archive/zip"
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
-	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/collinewait/ika-gmail-scraper/oauth"
@@ -18,80 +22,246 @@ import (
 
 const userID = "me"
 
-// create fileAddress based on current time
-var fileAddress string
-
-// Scrape will extract attachments contained in mails sent by a specific email.
+// Scrape will extract attachments contained in mails matching a filter.
+// It reports no progress while it runs: clients showing progress create a
+// job instead and follow its events.
 func Scrape(w http.ResponseWriter, r *http.Request) {
-	emailThatSentAttach := r.FormValue("emailThatSentAttach")
-	fileAddress = "attachments" + strconv.FormatInt(time.Now().Unix(), 10) + ".zip"
-	defer os.Remove(fileAddress)
-
-	token, err := extractToken(r)
-	if err != nil {
-		fmt.Println(err.Error())
-	}
-	claim, err := oauth.DecodeJwtToken(token)
+	p, _, err := pipelineFromRequest(r)
 	if err != nil {
 		errorResponse(w, err.Error())
 		return //nolint
 	}
 
-	oauthTkn, oauthRtkn, expiry, err := oauth.RetrieveTokensFromSession(r, claim.RandomID)
+	f, err := filterFromRequest(r)
 	if err != nil {
 		errorResponse(w, err.Error())
 		return //nolint
 	}
 
-	service := oauth.GetGmailService(oauthTkn, oauthRtkn, expiry)
-
-	var ms messageSevice
-	var cont content
-	var as attachmentService
-
-	ms = &message{}
-	cont = &messageContent{}
-	as = &attachment{}
+	if err := p.configure(r); err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+	sendArchive(w, r, p, func(aw ArchiveWriter) error {
+		return p.run(f.query(), aw)
+	})
+}
 
-	attachErrChannel := make(chan *messageError, 1)
-	doneChannel := make(chan bool)
-	messagesChannel, getIDsErr := getIDs(service, emailThatSentAttach, ms)
-	if len(getIDsErr) != 0 {
-		err := <-getIDsErr
-		msg := err.msg + " " + err.err.Error()
-		errorResponse(w, msg)
+// sendArchive responds with the archive that p produces through write.
+// With stream=true the archive is written to the response while it is being
+// built instead of being buffered in a temporary file first. When p has a
+// sink, the archive is stored there and a link to it is sent instead.
+func sendArchive(
+	w http.ResponseWriter,
+	r *http.Request,
+	p *pipeline,
+	write func(ArchiveWriter) error,
+) {
+	format := p.archiveFormat()
+	if format.newWriter == nil {
+		errorResponse(w, "the "+format.name+" format is only available for jobs")
 		return //nolint
 	}
-	messageContentChannel, getMsgCErr := getMessageContent(messagesChannel, service, cont)
-	if len(getMsgCErr) != 0 {
-		err := <-getMsgCErr
-		msg := err.msg + " " + err.err.Error()
-		errorResponse(w, msg)
+	if p.webhook != nil {
+		errorResponse(w, "webhooks are only available for jobs")
 		return //nolint
 	}
-	attachmentChannel, getAttachErr := getAttachment(messageContentChannel, service, as)
-	if len(getAttachErr) != 0 {
-		err := <-getAttachErr
-		msg := err.msg + " " + err.err.Error()
-		errorResponse(w, msg)
+	if r.FormValue("stream") == "true" {
+		if p.sink != nil {
+			errorResponse(w, "an archive sent to a sink can't be streamed")
+			return //nolint
+		}
+		streamArchive(w, p, write)
+		return
+	}
+
+	outFile, err := ioutil.TempFile("", "attachments-*"+p.extension())
+	if err != nil {
+		errorResponse(w, "Unable to create a file "+err.Error())
 		return //nolint
 	}
+	defer os.Remove(outFile.Name())
 
-	go saveAttachment(attachmentChannel, attachErrChannel, doneChannel)
-	for err := range attachErrChannel {
+	err = p.writeArchive(outFile, write)
+	outFile.Close()
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	if p.sink != nil {
+		link, err := storeArchive(p, outFile.Name())
 		if err != nil {
-			msg := err.msg + " " + err.err.Error()
-			errorResponse(w, msg)
+			errorResponseWithStatus(w, http.StatusBadGateway, err.Error())
 			return //nolint
 		}
+		p.commitSync()
+		setResultHeaders(w.Header(), p)
+		jsonResponse(w, http.StatusOK, storedArchive{
+			URL:         link,
+			Failed:      p.failureCount(),
+			SavedBytes:  atomic.LoadInt64(&p.savedBytes),
+			Attachments: atomic.LoadInt64(&p.attachments),
+		})
+		return
 	}
 
-	<-doneChannel
+	w.Header().Set("Content-type", p.contentType())
+	setResultHeaders(w.Header(), p)
+	serveArchive(w, r, p, outFile.Name())
+}
+
+// serveArchive sends the archive at path to w, and commits the sync that
+// produced it once the whole of it was sent.
+func serveArchive(w http.ResponseWriter, r *http.Request, p *pipeline, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		errorResponse(w, "Unable to read the archive "+err.Error())
+		return //nolint
+	}
+	cw := &countingResponseWriter{ResponseWriter: w}
+	http.ServeFile(cw, r, path)
+	if cw.status == http.StatusOK && cw.written == info.Size() {
+		p.commitSync()
+	}
+}
+
+// countingResponseWriter records the status and the number of body bytes
+// written to a response.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (c *countingResponseWriter) WriteHeader(status int) {
+	c.status = status
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *countingResponseWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	n, err := c.ResponseWriter.Write(b)
+	c.written += int64(n)
+	return n, err
+}
+
+// Headers reporting the outcome of a scrape along with its archive.
+const (
+	failedItemsHeader = "X-Failed-Items"
+	savedBytesHeader  = "X-Deduplicated-Bytes"
+	syncModeHeader    = "X-Sync-Mode"
+	historyIDHeader   = "X-Sync-History-Id"
+)
+
+var resultHeaders = []string{failedItemsHeader, savedBytesHeader, syncModeHeader, historyIDHeader}
+
+// setResultHeaders reports how many items were left out of the archive of p,
+// how many bytes deduplication saved and, for a sync, how it ran.
+func setResultHeaders(h http.Header, p *pipeline) {
+	h.Set(failedItemsHeader, strconv.Itoa(p.failureCount()))
+	h.Set(savedBytesHeader, strconv.FormatInt(atomic.LoadInt64(&p.savedBytes), 10))
+	setSyncHeaders(h, p)
+}
+
+// gmailServiceFromRequest authenticates r using its bearer token and builds
+// a gmail service from the oauth tokens stored for its user.
+func gmailServiceFromRequest(r *http.Request) (*gmail.Service, *oauth.Claims, error) {
+	claim, err := claimFromRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	service, err := oauth.GetGmailService(claim.RandomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return service, claim, nil
+}
+
+// pipelineFromRequest builds a pipeline scraping the mailbox of the user
+// who sent r.
+func pipelineFromRequest(r *http.Request) (*pipeline, *oauth.Claims, error) {
+	service, claim, err := gmailServiceFromRequest(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	mailbox, err := mailboxes.of(r.Context(), service, claim.RandomID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newPipeline(service, mailbox), claim, nil
+}
+
+// mailboxTTL is how long the address of the mailbox of a login is kept.
+// It outlives most logins, after which it is read again if need be.
+const mailboxTTL = time.Hour
+
+// mailboxes keeps the address of the mailbox of each login, so that the
+// profile isn't read on every request.
+var mailboxes = newMailboxCache()
+
+type mailboxCache struct {
+	mu      sync.Mutex
+	entries map[string]mailboxEntry
+	now     func() time.Time
+	// profile reads the profile of the mailbox of service.
+	profile func(ctx context.Context, service *gmail.Service) (*gmail.Profile, error)
+}
+
+type mailboxEntry struct {
+	address string
+	readAt  time.Time
+}
+
+func newMailboxCache() *mailboxCache {
+	hs := &retryingHistory{next: &history{}, policy: defaultRetryPolicy}
+	return &mailboxCache{
+		entries: make(map[string]mailboxEntry),
+		now:     time.Now,
+		profile: hs.getProfile,
+	}
+}
 
-	w.Header().Set("Content-type", "application/zip")
-	http.ServeFile(w, r, fileAddress)
+// of returns the address of the mailbox of the user logged in as userID,
+// reading it from the profile the first time.
+func (c *mailboxCache) of(ctx context.Context, service *gmail.Service, userID string) (string, error) {
+	c.mu.Lock()
+	now := c.now()
+	for id, e := range c.entries {
+		if now.Sub(e.readAt) >= mailboxTTL {
+			delete(c.entries, id)
+		}
+	}
+	e, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok {
+		return e.address, nil
+	}
+
+	profile, err := c.profile(ctx, service)
+	if err != nil {
+		return "", &messageError{msg: "Unable to retrieve the Profile", err: err}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[userID] = mailboxEntry{address: profile.EmailAddress, readAt: now}
+	return profile.EmailAddress, nil
+}
+
+// claimFromRequest decodes the JWT sent as a bearer token in r.
+func claimFromRequest(r *http.Request) (*oauth.Claims, error) {
+	token, err := extractToken(r)
+	if err != nil {
+		log.Printf("unable to read the bearer token: %v", err)
+	}
+	return oauth.DecodeJwtToken(token)
 }
 
+// extractToken reads the bearer token from the Authorization header.
 func extractToken(r *http.Request) (string, error) {
 	reqToken := r.Header.Get("Authorization")
 	splitToken := strings.Split(reqToken, "Bearer")
@@ -104,236 +274,685 @@ func extractToken(r *http.Request) (string, error) {
 }
 
 func errorResponse(w http.ResponseWriter, message string) {
+	errorResponseWithStatus(w, http.StatusBadRequest, message)
+}
+
+func errorResponseWithStatus(w http.ResponseWriter, status int, message string) {
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusBadRequest)
-	errMsg := fmt.Sprintf(`{"error": "%s"}`, message)
-	w.Write([]byte(errMsg)) // nolint
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message}) // nolint
 }
 
 type messageSevice interface {
-	fetchMessages(service *gmail.Service,
+	fetchMessages(ctx context.Context, service *gmail.Service,
 		query string) (*gmail.ListMessagesResponse, error)
-	fetchNextPage(service *gmail.Service,
+	fetchNextPage(ctx context.Context, service *gmail.Service,
 		query string,
 		NextPageToken string) (*gmail.ListMessagesResponse, error)
 }
 type content interface {
 	getContent(
-		service *gmail.Service, id string) (*gmail.Message, error)
+		ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error)
 }
 type attachmentService interface {
 	fetchAttachment(
-		service *gmail.Service,
+		ctx context.Context, service *gmail.Service,
 		msgID string, attachID string) (*gmail.MessagePartBody, error)
 }
 
+// errorPolicy decides what happens when a message or an attachment can't be
+// fetched, once any retries have been exhausted. Listing errors are always
+// fatal.
+type errorPolicy int
+
+const (
+	// failOnError aborts the whole scrape.
+	failOnError errorPolicy = iota
+	// skipOnError leaves the message or attachment out of the archive and
+	// lists it in an errors.json file instead, on a best effort basis.
+	skipOnError
+)
+
+// pipeline runs the getIDs → getMessageContent → getAttachment →
+// saveAttachment stages of a single scrape. It does not depend on an HTTP
+// request so it can also be run in the background by a job.
+type pipeline struct {
+	// messages, attachments and savedBytes are updated atomically while
+	// the pipeline runs so they can be read for progress reporting.
+	messages    int64
+	attachments int64
+	savedBytes  int64
+
+	service  *gmail.Service
+	ms       messageSevice
+	cont     content
+	as       attachmentService
+	ls       labelService
+	hs       historyService
+	progress *progress
+	limits   limits
+	onError  errorPolicy
+	// dedup stores attachments with the same content only once.
+	dedup bool
+	// format is the kind of archive produced, zip when it is nil. The
+	// archive is encrypted as it is written when encryption isn't nil.
+	format     *archiveFormat
+	encryption *encryption
+	// sink stores the archive and a link to it is sent instead, when it
+	// isn't nil.
+	sink Sink
+	// webhook is notified when a job running the pipeline finishes.
+	webhook *webhook
+	// layout decides the path of each attachment in the archive, the flat
+	// preset is used when it is nil. labels maps label IDs to the labels it
+	// may refer to.
+	layout *layout
+	labels map[string]*gmail.Label
+	// syncing only scrapes the messages added since the last sync of the
+	// same query, synced reports how it went once it's done. nextSync is
+	// saved by commitSync once the archive is delivered.
+	syncing  bool
+	synced   *syncResult
+	nextSync *syncState
+
+	// failures lists the items skipped under skipOnError.
+	mu       sync.Mutex
+	failures []failure
+	// abort stops every stage of the scrape in progress, once one of them
+	// has failed for good.
+	abort context.CancelFunc
+
+	// selection restricts the attachments that are saved. Every attachment
+	// is saved when it is nil.
+	selection selection
+}
+
+// newPipeline builds a pipeline drawing from the Gmail quota of mailbox, the
+// address of the mailbox service reads.
+func newPipeline(service *gmail.Service, mailbox string) *pipeline {
+	limiter := quotas.get(mailbox, defaultLimits.quotaPerSecond)
+	return &pipeline{
+		service: service,
+		ms: &retryingMessages{
+			next:   &rateLimitedMessages{next: &message{}, limiter: limiter},
+			policy: defaultRetryPolicy,
+		},
+		cont: &retryingContent{
+			next:   &rateLimitedContent{next: &messageContent{}, limiter: limiter},
+			policy: defaultRetryPolicy,
+		},
+		as: &retryingAttachments{
+			next:   &rateLimitedAttachments{next: &attachment{}, limiter: limiter},
+			policy: defaultRetryPolicy,
+		},
+		ls: &retryingLabels{
+			next:   &rateLimitedLabels{next: &label{}, limiter: limiter},
+			policy: defaultRetryPolicy,
+		},
+		hs: &retryingHistory{
+			next:   &rateLimitedHistory{next: &history{}, limiter: limiter},
+			policy: defaultRetryPolicy,
+		},
+		progress: newProgress(),
+		limits:   defaultLimits,
+	}
+}
+
+// configure applies the per-request options of r to the pipeline.
+func (p *pipeline) configure(r *http.Request) error {
+	switch r.FormValue("onError") {
+	case "", "fail":
+		p.onError = failOnError
+	case "skip":
+		p.onError = skipOnError
+	default:
+		return errors.New("onError must be either fail or skip")
+	}
+	format, err := formatFromRequest(r)
+	if err != nil {
+		return err
+	}
+	p.format = format
+	if p.encryption, err = encryptionFromRequest(r, format); err != nil {
+		return err
+	}
+	if p.sink, err = sinkFromRequest(r); err != nil {
+		return err
+	}
+	if p.sink != nil && format == directoryFormat {
+		return errors.New("the dir format can't be sent to a sink")
+	}
+	if p.webhook, err = webhookFromRequest(r); err != nil {
+		return err
+	}
+	p.dedup = r.FormValue("dedup") == "true"
+	p.syncing = r.FormValue("sync") == "true"
+	if name := r.FormValue("layout"); len(name) != 0 {
+		l, err := newLayout(name)
+		if err != nil {
+			return err
+		}
+		p.layout = l
+	}
+	return nil
+}
+
+// archiveFormat returns the kind of archive the pipeline produces.
+func (p *pipeline) archiveFormat() *archiveFormat {
+	if p.format == nil {
+		return zipFormat
+	}
+	return p.format
+}
+
+// contentType returns the content type of the archive the pipeline produces.
+func (p *pipeline) contentType() string {
+	return p.encryption.contentType(p.archiveFormat())
+}
+
+// extension returns the file extension of the archive the pipeline produces.
+func (p *pipeline) extension() string {
+	return p.encryption.extension(p.archiveFormat())
+}
+
+// writeArchive writes the archive that write produces to w, in the format
+// and with the encryption of the pipeline.
+func (p *pipeline) writeArchive(w io.Writer, write func(ArchiveWriter) error) error {
+	aw, err := p.encryption.newWriter(w, p.archiveFormat())
+	if err != nil {
+		return &messageError{msg: "Unable to create the archive", err: err}
+	}
+	return write(aw)
+}
+
+// run scrapes attachments in mails matching the Gmail search query and adds
+// them to aw. When syncing, only the mails added since the last sync are
+// scraped.
+func (p *pipeline) run(query string, aw ArchiveWriter) error {
+	if p.syncing {
+		return p.runSync(query, aw)
+	}
+	return p.archive(aw, func(ctx context.Context) (<-chan string, <-chan *messageError) {
+		return p.getIDs(ctx, query)
+	})
+}
+
+// archive runs the stages on the message IDs produced by list and adds the
+// attachments to aw. Failures are also published as error events.
+func (p *pipeline) archive(
+	aw ArchiveWriter,
+	list func(context.Context) (<-chan string, <-chan *messageError),
+) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p.abort = cancel
+
+	err := p.loadLabels(ctx)
+	if err == nil {
+		err = p.runStages(ctx, aw, list)
+	}
+	if err != nil {
+		p.progress.publish(progressEvent{Type: eventError, Error: err.Error()})
+	}
+	return err
+}
+
+// runStages stops the stages through ctx when the archive can't be
+// written, and the stages stop on their own first fatal error. Either way
+// nothing more is fetched from Gmail.
+func (p *pipeline) runStages(
+	ctx context.Context,
+	aw ArchiveWriter,
+	list func(context.Context) (<-chan string, <-chan *messageError),
+) error {
+	attachErrChannel := make(chan *messageError, 1)
+	doneChannel := make(chan bool, 1)
+	messagesChannel, getIDsErr := list(ctx)
+	if len(getIDsErr) != 0 {
+		return <-getIDsErr
+	}
+	messageContentChannel, getMsgCErr := p.getMessageContent(ctx, messagesChannel)
+	attachmentChannel, getAttachErr := p.getAttachment(ctx, messageContentChannel)
+
+	go p.saveAttachment(ctx, aw, attachmentChannel, attachErrChannel, doneChannel)
+	for err := range attachErrChannel {
+		if err != nil {
+			p.stop()
+			return err
+		}
+	}
+
+	<-doneChannel
+
+	// The fetching stages are done once every attachment has been saved,
+	// so their error channels have been closed.
+	if err, ok := <-getMsgCErr; ok {
+		return err
+	}
+	if err, ok := <-getAttachErr; ok {
+		return err
+	}
+	return ctx.Err()
+}
+
+// stop aborts the scrape in progress, if any.
+func (p *pipeline) stop() {
+	if p.abort != nil {
+		p.abort()
+	}
+}
+
 type message struct{}
 type messageContent struct{}
 type messageError struct {
 	err error
 	msg string
 }
+
+func (e *messageError) Error() string {
+	return e.msg + " " + e.err.Error()
+}
+
 type attachment struct {
 	data     string
 	fileName string
+	info     attachmentInfo
 }
 
 func (m *message) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
-	r, err := service.Users.Messages.List(userID).Q(query).Do()
+	r, err := service.Users.Messages.List(userID).Q(query).Context(ctx).Do()
 	return r, err
 }
 
 func (m *message) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 	r, err := service.Users.Messages.List(userID).Q(query).
-		PageToken(NextPageToken).Do()
+		PageToken(NextPageToken).Context(ctx).Do()
 	return r, err
 }
 
-func getIDs(service *gmail.Service,
-	email string,
-	m messageSevice) (<-chan string, <-chan *messageError) {
-	errs := new(messageError)
+func (p *pipeline) getIDs(ctx context.Context, query string) (<-chan string, <-chan *messageError) {
+	return p.getIDsIn(ctx, query, nil)
+}
+
+// getIDsIn lists the messages matching query, keeping only those in only
+// unless it is nil.
+func (p *pipeline) getIDsIn(ctx context.Context, query string, only map[string]bool) (<-chan string, <-chan *messageError) {
 	errorsCh := make(chan *messageError, 1)
 	defer close(errorsCh)
-	query := fmt.Sprintf("from:%s", email)
 
 	msgs := []*gmail.Message{}
 
-	r, err := m.fetchMessages(service, query)
+	r, err := p.ms.fetchMessages(ctx, p.service, query)
 	if err != nil {
 		msg := "Unable to retrieve Messages"
-		populateErrorChan(errs, msg, err, errorsCh)
+		populateErrorChan(msg, err, errorsCh)
 		return nil, errorsCh
 	}
 	msgs = append(msgs, r.Messages...)
 
 	for len(r.NextPageToken) != 0 {
-		r, err = m.fetchNextPage(service, query, r.NextPageToken)
+		next, err := p.ms.fetchNextPage(ctx, p.service, query, r.NextPageToken)
 		if err != nil {
 			msg := "Unable to retrieve Messages on the next page"
-			populateErrorChan(errs, msg, err, errorsCh)
+			if p.onError == skipOnError {
+				// Carry on with the messages listed so far.
+				p.recordFailure(msg, err, stageList, "", "")
+				break
+			}
+			populateErrorChan(msg, err, errorsCh)
 			return nil, errorsCh
 		}
+		r = next
 		msgs = append(msgs, r.Messages...)
 	}
 
-	if len(r.Messages) == 0 {
-		fmt.Println("No messages found.")
+	if only != nil {
+		kept := msgs[:0]
+		for _, msg := range msgs {
+			if only[msg.Id] {
+				kept = append(kept, msg)
+			}
+		}
+		msgs = kept
 	}
+	return p.sendIDs(ctx, msgs), nil
+}
 
-	ids := make(chan string)
-
-	var wg sync.WaitGroup
-	for _, msg := range msgs {
-		wg.Add(1)
-		go func(msg *gmail.Message) {
-			defer wg.Done()
-			ids <- msg.Id
-		}(msg)
-	}
+// sendIDs publishes how many messages were listed and sends their IDs to the
+// next stage, until ctx is done.
+func (p *pipeline) sendIDs(ctx context.Context, msgs []*gmail.Message) <-chan string {
+	atomic.StoreInt64(&p.messages, int64(len(msgs)))
+	p.progress.publish(progressEvent{Type: eventMessagesListed, Count: int64(len(msgs))})
 
+	ids := make(chan string)
 	go func() {
-		wg.Wait()
-		close(ids)
+		defer close(ids)
+		for _, msg := range msgs {
+			select {
+			case ids <- msg.Id:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
-
-	return ids, nil
+	return ids
 }
 
 func (mc *messageContent) getContent(
-	service *gmail.Service, id string) (*gmail.Message, error) {
-	return service.Users.Messages.Get(userID, id).Do()
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	return service.Users.Messages.Get(userID, id).Context(ctx).Do()
+}
+
+// contentSlot receives the content of message id once a worker has fetched
+// it. It is closed without a value when the message couldn't be fetched.
+type contentSlot struct {
+	id  string
+	msg chan *gmail.Message
 }
 
-func getMessageContent(
-	ids <-chan string,
-	service *gmail.Service,
-	c content) (<-chan *gmail.Message, <-chan *messageError) {
+// getMessageContent fetches the messages listed on ids with a bounded number
+// of workers, until ctx is done. The messages are sent on in the order they
+// were listed, whichever worker finishes first.
+func (p *pipeline) getMessageContent(
+	ctx context.Context,
+	ids <-chan string) (<-chan *gmail.Message, <-chan *messageError) {
 	msgCh := make(chan *gmail.Message)
-	errs := new(messageError)
 	errorsCh := make(chan *messageError, 1)
+	n := workers(p.limits.contentWorkers)
+	queue := make(chan contentSlot)
+	// pending keeps the slots in order, at most n ahead of the one being
+	// sent on.
+	pending := make(chan contentSlot, n)
+	go func() {
+		defer close(queue)
+		defer close(pending)
+		for id := range ids {
+			slot := contentSlot{id: id, msg: make(chan *gmail.Message, 1)}
+			select {
+			case pending <- slot:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case queue <- slot:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
 	var wg sync.WaitGroup
-	for id := range ids {
-		fmt.Println("Getting MessageContent....")
+	for i := 0; i < n; i++ {
 		wg.Add(1)
-		go func(id string) {
+		go func() {
 			defer wg.Done()
-			msgContent, err := c.getContent(service, id)
-			if err != nil {
-				msg := "Unable to retrieve Message Contents"
-				populateErrorChan(errs, msg, err, errorsCh)
-				close(errorsCh)
+			for slot := range queue {
+				p.fetchContent(ctx, slot, errorsCh)
 			}
-			msgCh <- msgContent
-		}(id)
+		}()
 	}
 	go func() {
 		wg.Wait()
-		close(msgCh)
+		close(errorsCh)
+	}()
+	go func() {
+		defer close(msgCh)
+		for slot := range pending {
+			var msgContent *gmail.Message
+			select {
+			case msgContent = <-slot.msg:
+			case <-ctx.Done():
+				return
+			}
+			if msgContent == nil {
+				continue
+			}
+			select {
+			case msgCh <- msgContent:
+			case <-ctx.Done():
+				return
+			}
+		}
 	}()
 	return msgCh, errorsCh
 }
 
+func (p *pipeline) fetchContent(ctx context.Context, slot contentSlot, errorsCh chan *messageError) {
+	defer close(slot.msg)
+	if ctx.Err() != nil {
+		return
+	}
+	msgContent, err := p.cont.getContent(ctx, p.service, slot.id)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		msg := "Unable to retrieve Message Contents"
+		p.fail(msg, err, stageContent, slot.id, "", errorsCh)
+		return
+	}
+	p.progress.publish(progressEvent{Type: eventMessageFetched, MessageID: slot.id})
+	slot.msg <- msgContent
+}
+
 func (a *attachment) fetchAttachment(
-	service *gmail.Service, msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	ctx context.Context, service *gmail.Service, msgID string, attachID string) (*gmail.MessagePartBody, error) {
 	return service.Users.Messages.Attachments.
-		Get(userID, msgID, attachID).Do()
+		Get(userID, msgID, attachID).Context(ctx).Do()
+}
+
+// attachmentSlot receives the attachments of msgContent once a worker has
+// fetched them.
+type attachmentSlot struct {
+	msgContent  *gmail.Message
+	attachments chan []*attachment
 }
 
-func getAttachment(
+// getAttachment fetches the attachments of the messages on msgContentCh with
+// a bounded number of workers, until ctx is done. The attachments are sent
+// on in the order of their messages then of their parts, so that they are
+// named the same way whichever worker finishes first.
+func (p *pipeline) getAttachment(
+	ctx context.Context,
 	msgContentCh <-chan *gmail.Message,
-	service *gmail.Service,
-	as attachmentService,
 ) (<-chan *attachment, <-chan *messageError) {
-	var wg sync.WaitGroup
 	attachCh := make(chan *attachment)
-	errs := new(messageError)
 	errorsCh := make(chan *messageError, 1)
+	n := workers(p.limits.attachmentWorkers)
+	queue := make(chan attachmentSlot)
+	// pending keeps the slots in order, at most n ahead of the one being
+	// sent on.
+	pending := make(chan attachmentSlot, n)
+	go func() {
+		defer close(queue)
+		defer close(pending)
+		for msgContent := range msgContentCh {
+			slot := attachmentSlot{msgContent: msgContent, attachments: make(chan []*attachment, 1)}
+			select {
+			case pending <- slot:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case queue <- slot:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
 
-	for msgContent := range msgContentCh {
-		fmt.Println("Getting attachment....")
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
 		wg.Add(1)
-		go func(msgContent *gmail.Message) {
+		go func() {
 			defer wg.Done()
-			attach := new(attachment)
-			tm := time.Unix(0, msgContent.InternalDate*1e6)
-			for _, part := range msgContent.Payload.Parts {
-				if len(part.Filename) != 0 {
-					newFileName := tm.Format("Jan-02-2006") + "-" + part.Filename
-					msgPartBody, err := as.fetchAttachment(service, msgContent.Id, part.Body.AttachmentId)
-					if err != nil {
-						msg := "Unable to retrieve Attachment"
-						populateErrorChan(errs, msg, err, errorsCh)
-						close(errorsCh)
-					}
-					attach.data = msgPartBody.Data
-					attach.fileName = newFileName
-					attachCh <- attach
+			for slot := range queue {
+				if ctx.Err() != nil {
+					close(slot.attachments)
+					continue
 				}
+				slot.attachments <- p.getMessageAttachments(ctx, slot.msgContent, errorsCh)
+				close(slot.attachments)
 			}
-		}(msgContent)
+		}()
 	}
 	go func() {
 		wg.Wait()
-		close(attachCh)
+		close(errorsCh)
+	}()
+	go func() {
+		defer close(attachCh)
+		for slot := range pending {
+			var attachments []*attachment
+			select {
+			case attachments = <-slot.attachments:
+			case <-ctx.Done():
+				return
+			}
+			for _, attach := range attachments {
+				select {
+				case attachCh <- attach:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
 	}()
 
 	return attachCh, errorsCh
 }
 
-func saveAttachment(
+// getMessageAttachments fetches the selected parts of msgContent, in the
+// order of the message.
+func (p *pipeline) getMessageAttachments(
+	ctx context.Context,
+	msgContent *gmail.Message,
+	errorsCh chan *messageError,
+) []*attachment {
+	parts, err := p.selection.parts(msgContent)
+	if err != nil {
+		msg := "Unable to find the selected Attachment"
+		p.fail(msg, err, stageAttachment, msgContent.Id, "", errorsCh)
+		return nil
+	}
+	var attachments []*attachment
+	for _, part := range parts {
+		if ctx.Err() != nil {
+			return nil
+		}
+		newFileName := p.archivePath(msgContent, part)
+		msgPartBody, err := p.partBody(ctx, msgContent.Id, part)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			msg := "Unable to retrieve Attachment"
+			p.fail(msg, err, stageAttachment, msgContent.Id, newFileName, errorsCh)
+			continue
+		}
+		p.progress.publish(progressEvent{
+			Type:      eventAttachmentDownloaded,
+			MessageID: msgContent.Id,
+			Filename:  newFileName,
+			Size:      msgPartBody.Size,
+		})
+		attachments = append(attachments, &attachment{
+			data:     msgPartBody.Data,
+			fileName: newFileName,
+			info:     describePart(msgContent, part),
+		})
+	}
+	return attachments
+}
+
+// saveAttachment adds the attachments on attachCh to aw, then finalizes the
+// archive unless a stage failed for good and ctx was cancelled: an
+// unfinished archive mustn't look complete.
+func (p *pipeline) saveAttachment(
+	ctx context.Context,
+	aw ArchiveWriter,
 	attachCh <-chan *attachment,
 	attachErrCh chan *messageError,
 	doneCh chan bool,
 ) {
 
-	errs := new(messageError)
-	outFile, err := os.Create(fileAddress)
-	if err != nil {
-		msg := "Unable to create a file"
-		populateErrorChan(errs, msg, err, attachErrCh)
-		return
-	}
-	defer outFile.Close()
-
-	zw := zip.NewWriter(outFile)
+	m := newManifest(p.dedup)
 
 	for attach := range attachCh {
-		fmt.Println("Saving attachment....")
-		decoded, _ := base64.URLEncoding.DecodeString(attach.data)
-		f, err := zw.Create(attach.fileName)
+		decoded, err := base64.URLEncoding.DecodeString(attach.data)
+		if err != nil {
+			msg := "Unable to decode the attachment"
+			p.fail(msg, err, stageSave, attach.info.MessageID, attach.fileName, attachErrCh)
+			if p.onError == skipOnError {
+				continue
+			}
+			return // nolint
+		}
+		path, duplicate := m.add(attach, decoded)
+		if duplicate {
+			atomic.AddInt64(&p.savedBytes, int64(len(decoded)))
+			continue
+		}
+		f, err := aw.Create(path)
 		if err != nil {
 			msg := "Unable to create a zip writer"
-			populateErrorChan(errs, msg, err, attachErrCh)
+			populateErrorChan(msg, err, attachErrCh)
 			return // nolint
 		}
 		if _, err := f.Write(decoded); err != nil {
 			msg := "Unable to write a file to the disk"
-			populateErrorChan(errs, msg, err, attachErrCh)
+			populateErrorChan(msg, err, attachErrCh)
+			return // nolint
 		}
+		atomic.AddInt64(&p.attachments, 1)
+	}
+
+	if ctx.Err() != nil {
+		close(attachErrCh)
+		doneCh <- true
+		return
+	}
+
+	if err := m.write(aw); err != nil {
+		msg := "Unable to write the manifest"
+		populateErrorChan(msg, err, attachErrCh)
+		return // nolint
 	}
 
-	if err := zw.Close(); err != nil {
+	if err := p.writeFailures(aw); err != nil {
+		msg := "Unable to write the error manifest"
+		populateErrorChan(msg, err, attachErrCh)
+		return // nolint
+	}
+
+	if err := aw.Close(); err != nil {
 		msg := "failed to close zip writer."
-		populateErrorChan(errs, msg, err, attachErrCh)
+		populateErrorChan(msg, err, attachErrCh)
+	} else {
+		p.progress.publish(progressEvent{
+			Type:  eventArchiveFinalized,
+			Count: atomic.LoadInt64(&p.attachments),
+		})
 	}
 
 	close(attachErrCh)
 	doneCh <- true
 }
 
+// populateErrorChan reports an error on errorsCh. Only the first error of a
+// stage is kept, so workers never block on reporting.
 func populateErrorChan(
-	msgErr *messageError,
 	msg string,
 	err error,
 	errorsCh chan *messageError,
 ) {
-	msgErr.msg = msg
-	msgErr.err = err
-	errorsCh <- msgErr
+	select {
+	case errorsCh <- &messageError{msg: msg, err: err}:
+	default:
+	}
 }
@@ -1,6 +1,7 @@
 package scraper
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
@@ -40,11 +41,20 @@ func Test_extractToken_shouldReturnError(t *testing.T) {
 	}
 }
 
+func Test_extractToken_shouldIgnoreTheQuery(t *testing.T) {
+
+	r := httptest.NewRequest(http.MethodGet, "/urlhere?access_token=sometokenhere", nil)
+
+	if _, err := extractToken(r); err == nil {
+		t.Errorf("extractToken() expected an error for a token in the query")
+	}
+}
+
 type mockMessageSevice interface {
 	fetchMessages(
-		service *gmail.Service,
+		ctx context.Context, service *gmail.Service,
 		query string) (*gmail.ListMessagesResponse, error)
-	fetchNextPage(service *gmail.Service,
+	fetchNextPage(ctx context.Context, service *gmail.Service,
 		query string,
 		NextPageToken string) (*gmail.ListMessagesResponse, error)
 }
@@ -53,7 +63,7 @@ type mockMessage struct {
 }
 
 func (m *mockMessage) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
 	gm := []*gmail.Message{
 		{Id: "16c2"},
@@ -69,7 +79,7 @@ func (m *mockMessage) fetchMessages(
 	return &r, nil
 }
 func (m *mockMessage) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 	r := gmail.ListMessagesResponse{
@@ -94,7 +104,7 @@ func Test_getIDsCanReturnIDsWithoutNextPageToken(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			cgot, _ := getIDs(service, testmail, ms)
+			cgot, _ := (&pipeline{service: service, ms: ms}).getIDs(context.Background(), "from:"+testmail)
 			var got []string
 
 			for i := range cgot {
@@ -115,7 +125,7 @@ type mockMessageWithNextPage struct {
 }
 
 func (m *mockMessageWithNextPage) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
 	gm := []*gmail.Message{
 		{Id: "16c2"},
@@ -133,7 +143,7 @@ func (m *mockMessageWithNextPage) fetchMessages(
 }
 
 func (m *mockMessageWithNextPage) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 	gm := []*gmail.Message{
@@ -162,7 +172,7 @@ func Test_getIDsCanReturnIDsWithNextPageToken(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			cgot, _ := getIDs(service, testmail, ms)
+			cgot, _ := (&pipeline{service: service, ms: ms}).getIDs(context.Background(), "from:"+testmail)
 			var got []string
 
 			for i := range cgot {
@@ -183,7 +193,7 @@ type mockMessageWithFetchMessagesError struct {
 }
 
 func (m *mockMessageWithFetchMessagesError) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
 	r := gmail.ListMessagesResponse{
 		Messages: []*gmail.Message{},
@@ -192,7 +202,7 @@ func (m *mockMessageWithFetchMessagesError) fetchMessages(
 }
 
 func (m *mockMessageWithFetchMessagesError) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 
@@ -207,7 +217,7 @@ func Test_getIDsShouldReturnErrorsReturnedByFetchMessages(t *testing.T) {
 	testmail := "test@mail.com"
 	var ms mockMessageSevice = &mockMessageWithFetchMessagesError{}
 
-	_, err := getIDs(service, testmail, ms)
+	_, err := (&pipeline{service: service, ms: ms}).getIDs(context.Background(), "from:"+testmail)
 	expected := "Unable to retrieve Messages"
 	for e := range err {
 		if e.msg != expected {
@@ -221,7 +231,7 @@ type mockMessageWithFetchNextPageError struct {
 }
 
 func (m *mockMessageWithFetchNextPageError) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
 	r := gmail.ListMessagesResponse{
 		Messages:      []*gmail.Message{{Id: "16c2"}},
@@ -231,7 +241,7 @@ func (m *mockMessageWithFetchNextPageError) fetchMessages(
 }
 
 func (m *mockMessageWithFetchNextPageError) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 
@@ -246,7 +256,7 @@ func Test_getIDsShouldReturnErrorsReturnedByFetchNextPage(t *testing.T) {
 	testmail := "test@mail.com"
 	var ms mockMessageSevice = &mockMessageWithFetchNextPageError{}
 
-	_, err := getIDs(service, testmail, ms)
+	_, err := (&pipeline{service: service, ms: ms}).getIDs(context.Background(), "from:"+testmail)
 	expected := "Unable to retrieve Messages on the next page"
 	for e := range err {
 		if e.msg != expected {
@@ -260,7 +270,7 @@ type mockMessageWithoutMessages struct {
 }
 
 func (m *mockMessageWithoutMessages) fetchMessages(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string) (*gmail.ListMessagesResponse, error) {
 	r := gmail.ListMessagesResponse{
 		Messages: []*gmail.Message{},
@@ -269,7 +279,7 @@ func (m *mockMessageWithoutMessages) fetchMessages(
 }
 
 func (m *mockMessageWithoutMessages) fetchNextPage(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	query string,
 	NextPageToken string) (*gmail.ListMessagesResponse, error) {
 
@@ -284,7 +294,7 @@ func Test_getIDsWithoutMessages(t *testing.T) {
 	testmail := "test@mail.com"
 	var ms mockMessageSevice = &mockMessageWithoutMessages{}
 
-	msgs, _ := getIDs(service, testmail, ms)
+	msgs, _ := (&pipeline{service: service, ms: ms}).getIDs(context.Background(), "from:"+testmail)
 	if len(msgs) != 0 {
 		t.Errorf("getIDs() = %v, want %v", len(msgs), 0)
 	}
@@ -295,7 +305,7 @@ type mockMessageContent struct {
 
 type mockContent interface {
 	getContent(
-		service *gmail.Service, id string) (*gmail.Message, error)
+		ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error)
 }
 
 func generateIds() <-chan string {
@@ -310,7 +320,7 @@ func generateIds() <-chan string {
 }
 
 func (m *mockMessageContent) getContent(
-	service *gmail.Service, id string) (*gmail.Message, error) {
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
 	gm := gmail.Message{
 		Payload: &gmail.MessagePart{
 			Filename: "somename.pdf",
@@ -325,7 +335,7 @@ func Test_getMessageContent(t *testing.T) {
 	msgCh := generateIds()
 	filename := "somename.pdf"
 
-	msgs, _ := getMessageContent(msgCh, service, mc)
+	msgs, _ := (&pipeline{service: service, cont: mc}).getMessageContent(context.Background(), msgCh)
 
 	for m := range msgs {
 		if m.Payload.Filename != filename {
@@ -338,7 +348,7 @@ type mockMessageContentWithGetContentError struct {
 }
 
 func (m *mockMessageContentWithGetContentError) getContent(
-	service *gmail.Service, id string) (*gmail.Message, error) {
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
 	gm := gmail.Message{
 		Payload: &gmail.MessagePart{
 			Filename: "",
@@ -352,7 +362,7 @@ func Test_getMessageContentWithGetContentError(t *testing.T) {
 	var mc mockContent = &mockMessageContentWithGetContentError{}
 	msgCh := generateIds()
 
-	_, err := getMessageContent(msgCh, service, mc)
+	_, err := (&pipeline{service: service, cont: mc}).getMessageContent(context.Background(), msgCh)
 
 	expected := "Unable to retrieve Message Contents"
 	for e := range err {
@@ -367,7 +377,7 @@ type mockAttachment struct {
 
 type mockAttachmentService interface {
 	fetchAttachment(
-		service *gmail.Service,
+		ctx context.Context, service *gmail.Service,
 		msgID string, attachID string) (*gmail.MessagePartBody, error)
 }
 
@@ -400,7 +410,7 @@ func generateMsgsContents() <-chan *gmail.Message {
 }
 
 func (a *mockAttachment) fetchAttachment(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	msgID string, attachID string) (*gmail.MessagePartBody, error) {
 	attachment := gmail.MessagePartBody{
 		Data: "some attachment Data Here",
@@ -415,7 +425,7 @@ func Test_getAttachment(t *testing.T) {
 	msgContents := generateMsgsContents()
 	data := "some attachment Data Here"
 
-	atts, _ := getAttachment(msgContents, service, as)
+	atts, _ := (&pipeline{service: service, as: as}).getAttachment(context.Background(), msgContents)
 
 	for a := range atts {
 		if a.data != data {
@@ -428,7 +438,7 @@ type mockAttachmentWithFetchError struct {
 }
 
 func (a *mockAttachmentWithFetchError) fetchAttachment(
-	service *gmail.Service,
+	ctx context.Context, service *gmail.Service,
 	msgID string, attachID string) (*gmail.MessagePartBody, error) {
 	attachment := gmail.MessagePartBody{}
 
@@ -440,7 +450,7 @@ func Test_getAttachmentWithFetchError(t *testing.T) {
 	var as mockAttachmentService = &mockAttachmentWithFetchError{}
 	msgContents := generateMsgsContents()
 
-	_, err := getAttachment(msgContents, service, as)
+	_, err := (&pipeline{service: service, as: as}).getAttachment(context.Background(), msgContents)
 
 	expected := "Unable to retrieve Attachment"
 	for e := range err {
@@ -0,0 +1,137 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// maxSelectedAttachments bounds the size of a single selection request.
+const maxSelectedAttachments = 1000
+
+// selectedAttachment picks one attachment of a message, as listed by the
+// preview endpoint. PartID is preferred because Gmail doesn't keep attachment
+// IDs stable between requests.
+type selectedAttachment struct {
+	MessageID    string `json:"messageId"`
+	AttachmentID string `json:"attachmentId,omitempty"`
+	PartID       string `json:"partId,omitempty"`
+}
+
+type selectionRequest struct {
+	Attachments []selectedAttachment `json:"attachments"`
+}
+
+// selection holds the chosen attachments keyed by message ID.
+type selection map[string][]selectedAttachment
+
+func newSelection(attachments []selectedAttachment) (selection, error) {
+	if len(attachments) == 0 {
+		return nil, errors.New("invalid selection: no attachments were selected")
+	}
+	if len(attachments) > maxSelectedAttachments {
+		return nil, fmt.Errorf("invalid selection: at most %d attachments can be selected", maxSelectedAttachments)
+	}
+
+	s := make(selection)
+	for _, a := range attachments {
+		if len(a.MessageID) == 0 {
+			return nil, errors.New("invalid selection: messageId is required")
+		}
+		if len(a.AttachmentID) == 0 && len(a.PartID) == 0 {
+			return nil, fmt.Errorf("invalid selection: attachmentId or partId is required for message %s", a.MessageID)
+		}
+		s[a.MessageID] = append(s[a.MessageID], a)
+	}
+	return s, nil
+}
+
+// ids lists the IDs of the messages holding the selected attachments, in
+// the same way getIDs lists the messages matching a query.
+func (s selection) ids(context.Context) (<-chan string, <-chan *messageError) {
+	ids := make(chan string, len(s))
+	for id := range s {
+		ids <- id
+	}
+	close(ids)
+	return ids, nil
+}
+
+// parts returns the attachment parts of msg that were selected, or all of
+// them when s is nil.
+func (s selection) parts(msg *gmail.Message) ([]*gmail.MessagePart, error) {
+	all := attachmentParts(msg.Payload)
+	if s == nil {
+		return all, nil
+	}
+
+	var parts []*gmail.MessagePart
+	for _, a := range s[msg.Id] {
+		part := a.find(all)
+		if part == nil && len(a.PartID) != 0 {
+			return nil, fmt.Errorf("message %s has no attachment part %s", msg.Id, a.PartID)
+		}
+		if part == nil {
+			// The attachment ID may have changed since it was listed. It can
+			// still be fetched, only its name is unknown.
+			part = &gmail.MessagePart{
+				Body: &gmail.MessagePartBody{AttachmentId: a.AttachmentID},
+			}
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func (a selectedAttachment) find(parts []*gmail.MessagePart) *gmail.MessagePart {
+	for _, part := range parts {
+		if len(a.PartID) != 0 {
+			if part.PartId == a.PartID {
+				return part
+			}
+			continue
+		}
+		if part.Body != nil && part.Body.AttachmentId == a.AttachmentID {
+			return part
+		}
+	}
+	return nil
+}
+
+// ScrapeSelection zips only the attachments listed in the JSON body, as
+// pairs of messageId and attachmentId or partId.
+func ScrapeSelection(w http.ResponseWriter, r *http.Request) {
+	p, _, err := pipelineFromRequest(r)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	var req selectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		errorResponse(w, "invalid selection: "+err.Error())
+		return //nolint
+	}
+	s, err := newSelection(req.Attachments)
+	if err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	if err := p.configure(r); err != nil {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+	if p.syncing {
+		errorResponse(w, "a selection can't be synced")
+		return //nolint
+	}
+	p.selection = s
+	sendArchive(w, r, p, func(aw ArchiveWriter) error {
+		return p.archive(aw, s.ids)
+	})
+}
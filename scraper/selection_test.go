@@ -0,0 +1,123 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+func Test_newSelection_shouldValidateAttachments(t *testing.T) {
+	tests := []struct {
+		name        string
+		attachments []selectedAttachment
+		wantErr     string
+	}{
+		{
+			name:    "no attachments",
+			wantErr: "invalid selection: no attachments were selected",
+		},
+		{
+			name:        "missing message ID",
+			attachments: []selectedAttachment{{PartID: "1"}},
+			wantErr:     "invalid selection: messageId is required",
+		},
+		{
+			name:        "missing attachment and part IDs",
+			attachments: []selectedAttachment{{MessageID: "16c2"}},
+			wantErr:     "invalid selection: attachmentId or partId is required for message 16c2",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newSelection(tt.attachments)
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("newSelection() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_selection_parts(t *testing.T) {
+	pdf := &gmail.MessagePart{PartId: "1", Filename: "a.pdf", Body: &gmail.MessagePartBody{AttachmentId: "pdfId"}}
+	png := &gmail.MessagePart{PartId: "2", Filename: "b.png", Body: &gmail.MessagePartBody{AttachmentId: "pngId"}}
+	msg := &gmail.Message{Id: "16c2", Payload: &gmail.MessagePart{Parts: []*gmail.MessagePart{pdf, png}}}
+
+	tests := []struct {
+		name      string
+		selection selection
+		want      []*gmail.MessagePart
+		wantErr   bool
+	}{
+		{
+			name: "nil selection keeps every attachment",
+			want: []*gmail.MessagePart{pdf, png},
+		},
+		{
+			name:      "select by part ID",
+			selection: selection{"16c2": {{MessageID: "16c2", PartID: "2"}}},
+			want:      []*gmail.MessagePart{png},
+		},
+		{
+			name:      "select by attachment ID",
+			selection: selection{"16c2": {{MessageID: "16c2", AttachmentID: "pdfId"}}},
+			want:      []*gmail.MessagePart{pdf},
+		},
+		{
+			name:      "unknown attachment ID is still fetched",
+			selection: selection{"16c2": {{MessageID: "16c2", AttachmentID: "newId"}}},
+			want:      []*gmail.MessagePart{{Body: &gmail.MessagePartBody{AttachmentId: "newId"}}},
+		},
+		{
+			name:      "unknown part ID",
+			selection: selection{"16c2": {{MessageID: "16c2", PartID: "9"}}},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.selection.parts(msg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("parts() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i].PartId != tt.want[i].PartId || got[i].Body.AttachmentId != tt.want[i].Body.AttachmentId {
+					t.Errorf("parts()[%d] = %+v, want %+v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func Test_archive_shouldOnlySaveSelectedAttachments(t *testing.T) {
+	s, err := newSelection([]selectedAttachment{
+		{MessageID: "16c2", PartID: "1"},
+		{MessageID: "fgb", PartID: "1"},
+	})
+	if err != nil {
+		t.Fatalf("newSelection() unexpected error: %v", err)
+	}
+	p := &pipeline{
+		service:   new(gmail.Service),
+		cont:      &mockMessageContentWithMetadata{},
+		as:        &mockAttachmentWithData{},
+		selection: s,
+	}
+
+	var buf bytes.Buffer
+	if err := p.archive(newZipWriter(&buf), s.ids); err != nil {
+		t.Fatalf("archive() unexpected error: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("archive() wrote an invalid zip: %v", err)
+	}
+	if files := attachmentFiles(zr); len(files) != 2 {
+		t.Errorf("archive() wrote %v files, want %v", len(files), 2)
+	}
+}
@@ -0,0 +1,357 @@
+package scraper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Sink stores finished archives somewhere that outlives the server, and
+// returns a link to download them.
+type Sink interface {
+	Store(name string, r io.ReadSeeker, size int64, contentType string) (string, error)
+}
+
+// sinkClient uploads archives to the S3 and WebDAV sinks. An upload that
+// hangs would hold a job worker, so it gives up after SINK_TIMEOUT_SECONDS.
+var sinkClient = &http.Client{
+	Timeout: time.Duration(envInt("SINK_TIMEOUT_SECONDS", 10*60)) * time.Second,
+}
+
+// sinks are the sinks configured on this server, by name.
+var sinks = sinksFromEnv()
+
+// sinksFromEnv configures a sink for each of SINK_LOCAL_DIRECTORY, S3_BUCKET
+// and WEBDAV_URL that is set.
+func sinksFromEnv() map[string]Sink {
+	s := make(map[string]Sink)
+	if dir := os.Getenv("SINK_LOCAL_DIRECTORY"); len(dir) != 0 {
+		baseURL := os.Getenv("SINK_LOCAL_BASE_URL")
+		// Links to the archives must be usable by the clients of the
+		// server, which can't open a path on its disk.
+		if len(baseURL) == 0 {
+			log.Fatal("SINK_LOCAL_BASE_URL must be set along with SINK_LOCAL_DIRECTORY")
+		}
+		s["local"] = &localSink{dir: dir, baseURL: baseURL}
+	}
+	if bucket := os.Getenv("S3_BUCKET"); len(bucket) != 0 {
+		region := os.Getenv("S3_REGION")
+		if len(region) == 0 {
+			region = "us-east-1"
+		}
+		endpoint := os.Getenv("S3_ENDPOINT")
+		if len(endpoint) == 0 {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		s["s3"] = &s3Sink{
+			endpoint:        strings.TrimSuffix(endpoint, "/"),
+			region:          region,
+			bucket:          bucket,
+			accessKeyID:     os.Getenv("S3_ACCESS_KEY_ID"),
+			secretAccessKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			expiry:          time.Duration(envInt("S3_LINK_EXPIRY_SECONDS", 24*60*60)) * time.Second,
+			client:          sinkClient,
+			now:             time.Now,
+		}
+	}
+	if u := os.Getenv("WEBDAV_URL"); len(u) != 0 {
+		s["webdav"] = &webDAVSink{
+			url:      strings.TrimSuffix(u, "/"),
+			username: os.Getenv("WEBDAV_USERNAME"),
+			password: os.Getenv("WEBDAV_PASSWORD"),
+			client:   sinkClient,
+		}
+	}
+	return s
+}
+
+// sinkFromRequest returns the sink named by the sink parameter of r, if any.
+func sinkFromRequest(r *http.Request) (Sink, error) {
+	name := r.FormValue("sink")
+	if len(name) == 0 {
+		return nil, nil
+	}
+	s, ok := sinks[name]
+	if !ok {
+		return nil, fmt.Errorf("the %s sink isn't configured on this server", name)
+	}
+	return s, nil
+}
+
+// storedArchive is the response to a scrape whose archive went to a sink.
+type storedArchive struct {
+	URL         string `json:"url"`
+	Failed      int    `json:"failed"`
+	SavedBytes  int64  `json:"deduplicatedBytes"`
+	Attachments int64  `json:"attachments"`
+}
+
+// storeArchive stores the archive of p found at path in its sink, under a
+// name that can't be guessed.
+func storeArchive(p *pipeline, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	name := "attachments-" + time.Now().UTC().Format("20060102-150405") + "-" + uniuri.NewLen(24) + p.extension()
+	link, err := p.sink.Store(name, f, info.Size(), p.contentType())
+	if err != nil {
+		return "", &messageError{msg: "Unable to store the archive", err: err}
+	}
+	return link, nil
+}
+
+// localSink copies archives to a directory, typically a mounted volume
+// served at baseURL.
+type localSink struct {
+	dir     string
+	baseURL string
+}
+
+func (s *localSink) Store(name string, r io.ReadSeeker, size int64, contentType string) (string, error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.dir, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	return strings.TrimSuffix(s.baseURL, "/") + "/" + url.PathEscape(name), nil
+}
+
+// s3Sink uploads archives to an S3-compatible object storage, like AWS S3
+// or MinIO, using path-style URLs. Links are pre-signed and expire.
+type s3Sink struct {
+	endpoint        string
+	region          string
+	bucket          string
+	accessKeyID     string
+	secretAccessKey string
+	expiry          time.Duration
+	client          *http.Client
+	now             func() time.Time
+}
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	sigV4Service   = "s3"
+	amzDateLayout  = "20060102T150405Z"
+)
+
+func (s *s3Sink) objectURL(name string) (*url.URL, error) {
+	return url.Parse(s.endpoint + "/" + url.PathEscape(s.bucket) + "/" + url.PathEscape(name))
+}
+
+func (s *s3Sink) Store(name string, r io.ReadSeeker, size int64, contentType string) (string, error) {
+	u, err := s.objectURL(name)
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, u.String(), r)
+	if err != nil {
+		return "", err
+	}
+	setContentLength(req, size)
+	req.Header.Set("Content-Type", contentType)
+	s.sign(req, hex.EncodeToString(h.Sum(nil)), s.now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("s3 responded with %s", res.Status)
+	}
+
+	return s.presign(http.MethodGet, u, s.now(), s.expiry), nil
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3Sink) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateLayout)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	signedHeaders, canonicalHeaders := canonicalHeaders(headers)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope, signature := s.signature(now, canonicalRequest)
+
+	req.Header.Set("Authorization", sigV4Algorithm+
+		" Credential="+s.accessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+signature)
+}
+
+// presign returns u with query parameters authenticating a request for
+// expiry, see
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (s *s3Sink) presign(method string, u *url.URL, now time.Time, expiry time.Duration) string {
+	scope := s.scope(now)
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", sigV4Algorithm)
+	query.Set("X-Amz-Credential", s.accessKeyID+"/"+scope)
+	query.Set("X-Amz-Date", now.UTC().Format(amzDateLayout))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expiry/time.Second)))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(map[string]string{"host": u.Host})
+	canonicalRequest := strings.Join([]string{
+		method,
+		u.EscapedPath(),
+		canonicalQuery(query),
+		canonicalHeaders,
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	_, signature := s.signature(now, canonicalRequest)
+
+	presigned := *u
+	presigned.RawQuery = canonicalQuery(query) + "&X-Amz-Signature=" + signature
+	return presigned.String()
+}
+
+func (s *s3Sink) scope(now time.Time) string {
+	return now.UTC().Format("20060102") + "/" + s.region + "/" + sigV4Service + "/aws4_request"
+}
+
+// signature signs canonicalRequest and returns its credential scope along
+// with the signature.
+func (s *s3Sink) signature(now time.Time, canonicalRequest string) (string, string) {
+	scope := s.scope(now)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		now.UTC().Format(amzDateLayout),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), now.UTC().Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, sigV4Service)
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data)) // nolint
+	return h.Sum(nil)
+}
+
+// canonicalHeaders returns the signed headers list and the canonical headers
+// block of headers, whose names must be lower case.
+func canonicalHeaders(headers map[string]string) (string, string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+// canonicalQuery encodes query the way SigV4 expects, with spaces as %20.
+func canonicalQuery(query url.Values) string {
+	return strings.Replace(query.Encode(), "+", "%20", -1)
+}
+
+// setContentLength sets the length of the body of req, which can't be sent
+// chunked to object storages.
+func setContentLength(req *http.Request, size int64) {
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+}
+
+// webDAVSink uploads archives to a WebDAV collection, like a Nextcloud
+// folder. Links point to the uploaded file and need the server's own
+// authentication to be downloaded.
+type webDAVSink struct {
+	url      string
+	username string
+	password string
+	client   *http.Client
+}
+
+func (s *webDAVSink) Store(name string, r io.ReadSeeker, size int64, contentType string) (string, error) {
+	link := s.url + "/" + url.PathEscape(name)
+	req, err := http.NewRequest(http.MethodPut, link, r)
+	if err != nil {
+		return "", err
+	}
+	setContentLength(req, size)
+	req.Header.Set("Content-Type", contentType)
+	if len(s.username) != 0 {
+		req.SetBasicAuth(s.username, s.password)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated, http.StatusNoContent, http.StatusOK:
+		return link, nil
+	}
+	return "", errors.New("webdav responded with " + res.Status)
+}
@@ -0,0 +1,48 @@
+package scraper
+
+import (
+	"net/http"
+	"strings"
+)
+
+// archiveResponseWriter writes an archive straight to an HTTP response. The
+// status and headers are only sent along with the first byte of the archive,
+// so errors that happen before then can still be reported as JSON. The
+// outcome of the scrape is only known at the end and is sent in trailers.
+type archiveResponseWriter struct {
+	w       http.ResponseWriter
+	p       *pipeline
+	started bool
+}
+
+func (a *archiveResponseWriter) Write(b []byte) (int, error) {
+	if !a.started {
+		a.started = true
+		a.w.Header().Set("Content-type", a.p.contentType())
+		a.w.Header().Set("Content-Disposition", `attachment; filename="attachments`+a.p.extension()+`"`)
+		a.w.Header().Set("Trailer", strings.Join(resultHeaders, ", "))
+		a.w.WriteHeader(http.StatusOK)
+	}
+	return a.w.Write(b)
+}
+
+// streamArchive sends the archive that p produces through write to w with
+// chunked transfer encoding as it is produced, so neither memory nor disk
+// grow with its size.
+func streamArchive(w http.ResponseWriter, p *pipeline, write func(ArchiveWriter) error) {
+	aw := &archiveResponseWriter{w: w, p: p}
+	err := p.writeArchive(aw, write)
+	if err == nil {
+		p.commitSync()
+		setResultHeaders(w.Header(), p)
+		return
+	}
+	if !aw.started {
+		errorResponse(w, err.Error())
+		return //nolint
+	}
+
+	// Part of the archive has already been sent. Abort the connection so the
+	// client sees a failed download instead of a truncated zip.
+	panic(http.ErrAbortHandler)
+}
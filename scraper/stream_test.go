@@ -0,0 +1,92 @@
+package scraper
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+type mockMessageContentWithAttachment struct {
+}
+
+func (m *mockMessageContentWithAttachment) getContent(
+	ctx context.Context, service *gmail.Service, id string) (*gmail.Message, error) {
+	gm := gmail.Message{
+		Id: id,
+		Payload: &gmail.MessagePart{
+			Parts: []*gmail.MessagePart{
+				{
+					Filename: id + ".pdf",
+					Body: &gmail.MessagePartBody{
+						AttachmentId: "attachmentId",
+					},
+				},
+			},
+		},
+	}
+	return &gm, nil
+}
+
+type mockAttachmentWithData struct {
+}
+
+func (a *mockAttachmentWithData) fetchAttachment(
+	ctx context.Context, service *gmail.Service,
+	msgID string, attachID string) (*gmail.MessagePartBody, error) {
+	attachment := gmail.MessagePartBody{
+		Data: base64.URLEncoding.EncodeToString([]byte("attachment of " + msgID)),
+	}
+	return &attachment, nil
+}
+
+func Test_streamArchive_shouldWriteZipToResponse(t *testing.T) {
+	p := &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+	}
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("streamArchive() = %v, want %v", w.Code, http.StatusOK)
+	}
+	if contentType := w.Header().Get("Content-type"); contentType != "application/zip" {
+		t.Errorf("streamArchive() content type = %v, want %v", contentType, "application/zip")
+	}
+
+	body := w.Body.Bytes()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("streamArchive() wrote an invalid zip: %v", err)
+	}
+	if files := attachmentFiles(zr); len(files) != 5 {
+		t.Errorf("streamArchive() wrote %v files, want %v", len(files), 5)
+	}
+}
+
+func Test_streamArchive_shouldReportErrorsBeforeTheArchiveStarts(t *testing.T) {
+	p := newTestPipeline(&mockMessageWithFetchMessagesError{})
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("streamArchive() = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("streamArchive() content type = %v, want %v", contentType, "application/json")
+	}
+}
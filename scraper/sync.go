@@ -0,0 +1,263 @@
+package scraper
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Ways a sync scrape can run.
+const (
+	// syncFull scrapes every matching message, the first time a query is
+	// synced or when its history has expired.
+	syncFull = "full"
+	// syncIncremental only scrapes the matching messages added since the
+	// last sync.
+	syncIncremental = "incremental"
+)
+
+// syncResult reports how a sync scrape ran and the mailbox history ID the
+// next one will start from, if any.
+type syncResult struct {
+	Mode      string `json:"mode"`
+	HistoryID uint64 `json:"historyId,omitempty,string"`
+}
+
+// syncState is where the syncs of a user and query stopped.
+type syncState struct {
+	user      string
+	query     string
+	historyID uint64
+}
+
+type historyService interface {
+	getProfile(ctx context.Context, service *gmail.Service) (*gmail.Profile, error)
+	listHistory(
+		ctx context.Context, service *gmail.Service,
+		startHistoryID uint64,
+		pageToken string) (*gmail.ListHistoryResponse, error)
+}
+
+type history struct{}
+
+func (h *history) getProfile(ctx context.Context, service *gmail.Service) (*gmail.Profile, error) {
+	return service.Users.GetProfile(userID).Context(ctx).Do()
+}
+
+func (h *history) listHistory(
+	ctx context.Context, service *gmail.Service,
+	startHistoryID uint64,
+	pageToken string) (*gmail.ListHistoryResponse, error) {
+	call := service.Users.History.List(userID).
+		StartHistoryId(startHistoryID).
+		HistoryTypes("messageAdded")
+	if len(pageToken) != 0 {
+		call = call.PageToken(pageToken)
+	}
+	return call.Context(ctx).Do()
+}
+
+// syncStates remembers where the syncs of every user and query stopped.
+var syncStates = newSyncStore(os.Getenv("SYNC_STATE_FILE"))
+
+// syncStore maps a user and a query to the history ID their last sync
+// started from. It is saved to a JSON file when it has a path, and only
+// kept in memory otherwise.
+type syncStore struct {
+	mu     sync.Mutex
+	path   string
+	states map[string]uint64
+}
+
+func newSyncStore(path string) *syncStore {
+	s := &syncStore{path: path, states: make(map[string]uint64)}
+	if len(path) == 0 {
+		return s
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("unable to read the sync state %s: %v", path, err)
+		}
+		return s
+	}
+	if err := json.Unmarshal(b, &s.states); err != nil {
+		log.Printf("invalid sync state %s: %v", path, err)
+	}
+	return s
+}
+
+func syncKey(user, query string) string {
+	return user + "\n" + query
+}
+
+func (s *syncStore) get(user, query string) (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id, ok := s.states[syncKey(user, query)]
+	return id, ok
+}
+
+// set records historyID for user and query, and saves the store.
+func (s *syncStore) set(user, query string, historyID uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.states[syncKey(user, query)] = historyID
+	if len(s.path) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(s.states)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// writeFileAtomic replaces the file at path with b. A new file is written,
+// synced and renamed over the old one, so a crash never leaves a truncated
+// file behind.
+func writeFileAtomic(path string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// runSync scrapes the messages matching query that were added since the
+// last sync of the same query by the same user, or all of them the first
+// time. The mailbox history ID is read before listing anything, so messages
+// that arrive during the scrape are picked up by the next sync.
+func (p *pipeline) runSync(query string, aw ArchiveWriter) error {
+	ctx := context.Background()
+	profile, err := p.hs.getProfile(ctx, p.service)
+	if err != nil {
+		err = &messageError{msg: "Unable to retrieve the Profile", err: err}
+		p.progress.publish(progressEvent{Type: eventError, Error: err.Error()})
+		return err
+	}
+
+	result := &syncResult{Mode: syncFull, HistoryID: profile.HistoryId}
+	var added map[string]bool
+	start, ok := syncStates.get(profile.EmailAddress, query)
+	if ok {
+		added, err = p.addedMessages(ctx, start)
+		if err != nil {
+			p.progress.publish(progressEvent{Type: eventError, Error: err.Error()})
+			return err
+		}
+		if added != nil {
+			result.Mode = syncIncremental
+		}
+	}
+
+	err = p.archive(aw, func(ctx context.Context) (<-chan string, <-chan *messageError) {
+		if result.Mode == syncIncremental && len(added) == 0 {
+			// Nothing was added, there is no need to list the query.
+			return p.sendIDs(ctx, nil), nil
+		}
+		return p.getIDsIn(ctx, query, added)
+	})
+	if err != nil {
+		return err
+	}
+
+	var next *syncState
+	if p.failureCount() != 0 {
+		// Items skipped under onError=skip would be lost for good if the
+		// sync moved on, so the next one starts from the same point.
+		result.HistoryID = start
+	} else {
+		next = &syncState{user: profile.EmailAddress, query: query, historyID: result.HistoryID}
+	}
+	p.mu.Lock()
+	p.synced = result
+	p.nextSync = next
+	p.mu.Unlock()
+	return nil
+}
+
+// commitSync moves the sync of the pipeline on to where it stopped. It is
+// only called once the archive was delivered, so the messages of an archive
+// that got lost are scraped again by the next sync.
+func (p *pipeline) commitSync() {
+	p.mu.Lock()
+	next := p.nextSync
+	p.nextSync = nil
+	p.mu.Unlock()
+	if next == nil {
+		return
+	}
+	if err := syncStates.set(next.user, next.query, next.historyID); err != nil {
+		log.Printf("unable to save the sync state: %v", err)
+	}
+}
+
+// addedMessages returns the IDs of the messages added to the mailbox since
+// startHistoryID. It returns nil without an error when that history is no
+// longer available, and a full sync is needed.
+func (p *pipeline) addedMessages(ctx context.Context, startHistoryID uint64) (map[string]bool, error) {
+	added := make(map[string]bool)
+	pageToken := ""
+	for {
+		r, err := p.hs.listHistory(ctx, p.service, startHistoryID, pageToken)
+		if apiErr, ok := err.(*googleapi.Error); ok && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, &messageError{msg: "Unable to retrieve the History", err: err}
+		}
+		for _, h := range r.History {
+			for _, m := range h.MessagesAdded {
+				if m.Message != nil {
+					added[m.Message.Id] = true
+				}
+			}
+		}
+		if len(r.NextPageToken) == 0 {
+			return added, nil
+		}
+		pageToken = r.NextPageToken
+	}
+}
+
+// lastSync returns how the last sync of the pipeline ran, nil if it
+// didn't sync.
+func (p *pipeline) lastSync() *syncResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.synced
+}
+
+func setSyncHeaders(h http.Header, p *pipeline) {
+	if s := p.lastSync(); s != nil {
+		h.Set(syncModeHeader, s.Mode)
+		if s.HistoryID != 0 {
+			h.Set(historyIDHeader, strconv.FormatUint(s.HistoryID, 10))
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+type mockHistory struct {
+	historyID uint64
+	// added lists the IDs of the messages added since any start, on pages
+	// of two.
+	added []string
+	err   error
+	// starts records the history IDs the history was listed from.
+	starts []uint64
+}
+
+func (h *mockHistory) getProfile(ctx context.Context, service *gmail.Service) (*gmail.Profile, error) {
+	return &gmail.Profile{EmailAddress: "test@mail.com", HistoryId: h.historyID}, nil
+}
+
+func (h *mockHistory) listHistory(
+	ctx context.Context, service *gmail.Service,
+	startHistoryID uint64,
+	pageToken string) (*gmail.ListHistoryResponse, error) {
+	h.starts = append(h.starts, startHistoryID)
+	if h.err != nil {
+		return nil, h.err
+	}
+
+	first := 0
+	if len(pageToken) != 0 {
+		first = 2
+	}
+	r := &gmail.ListHistoryResponse{HistoryId: h.historyID}
+	for i := first; i < len(h.added) && i < first+2; i++ {
+		r.History = append(r.History, &gmail.History{
+			MessagesAdded: []*gmail.HistoryMessageAdded{{Message: &gmail.Message{Id: h.added[i]}}},
+		})
+	}
+	if first == 0 && len(h.added) > 2 {
+		r.NextPageToken = "next"
+	}
+	return r, nil
+}
+
+func newSyncPipeline(h historyService) *pipeline {
+	return &pipeline{
+		service: new(gmail.Service),
+		ms:      &mockMessage{},
+		cont:    &mockMessageContentWithAttachment{},
+		as:      &mockAttachmentWithData{},
+		hs:      h,
+		syncing: true,
+	}
+}
+
+func Test_run_shouldSyncIncrementally(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	syncStates = newSyncStore("")
+	query := "from:test@mail.com"
+
+	tests := []struct {
+		name            string
+		history         *mockHistory
+		wantMode        string
+		wantAttachments int64
+		wantStart       []uint64
+	}{
+		{
+			name:            "first sync",
+			history:         &mockHistory{historyID: 100},
+			wantMode:        syncFull,
+			wantAttachments: 5,
+		},
+		{
+			name:            "added messages",
+			history:         &mockHistory{historyID: 120, added: []string{"41ff9", "unmatched", "fgb"}},
+			wantMode:        syncIncremental,
+			wantAttachments: 2,
+			wantStart:       []uint64{100, 100},
+		},
+		{
+			name:            "nothing added",
+			history:         &mockHistory{historyID: 130},
+			wantMode:        syncIncremental,
+			wantAttachments: 0,
+			wantStart:       []uint64{120},
+		},
+		{
+			name:            "expired history",
+			history:         &mockHistory{historyID: 200, err: &googleapi.Error{Code: http.StatusNotFound}},
+			wantMode:        syncFull,
+			wantAttachments: 5,
+			wantStart:       []uint64{130},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newSyncPipeline(tt.history)
+			if err := p.run(query, newZipWriter(&bytes.Buffer{})); err != nil {
+				t.Fatalf("run() unexpected error: %v", err)
+			}
+			p.commitSync()
+
+			want := &syncResult{Mode: tt.wantMode, HistoryID: tt.history.historyID}
+			if got := p.lastSync(); !reflect.DeepEqual(got, want) {
+				t.Errorf("run() sync = %v, want %v", got, want)
+			}
+			if p.attachments != tt.wantAttachments {
+				t.Errorf("run() saved %v attachments, want %v", p.attachments, tt.wantAttachments)
+			}
+			if !reflect.DeepEqual(tt.history.starts, tt.wantStart) {
+				t.Errorf("run() listed history from %v, want %v", tt.history.starts, tt.wantStart)
+			}
+			if id, _ := syncStates.get("test@mail.com", query); id != tt.history.historyID {
+				t.Errorf("run() saved history ID %v, want %v", id, tt.history.historyID)
+			}
+		})
+	}
+}
+
+func Test_run_shouldNotMoveTheSyncOnAfterFailures(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	syncStates = newSyncStore("")
+	query := "from:test@mail.com"
+	if err := syncStates.set("test@mail.com", query, 100); err != nil {
+		t.Fatalf("set() unexpected error: %v", err)
+	}
+
+	p := newSyncPipeline(&mockHistory{historyID: 120, added: []string{"41ff9", "fgb"}})
+	p.as = &mockAttachmentWithPermanentError{}
+	p.onError = skipOnError
+	if err := p.run(query, newZipWriter(&bytes.Buffer{})); err != nil {
+		t.Fatalf("run() unexpected error: %v", err)
+	}
+	p.commitSync()
+
+	if id, _ := syncStates.get("test@mail.com", query); id != 100 {
+		t.Errorf("run() saved history ID %v, want %v", id, 100)
+	}
+	if got := p.lastSync(); got.HistoryID != 100 {
+		t.Errorf("run() sync history ID = %v, want %v", got.HistoryID, 100)
+	}
+}
+
+func Test_run_shouldOnlyMoveTheSyncOnOnceTheArchiveIsDelivered(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	query := testFilter.query()
+
+	tests := []struct {
+		name    string
+		deliver func(p *pipeline) bool
+	}{
+		{
+			name: "response",
+			deliver: func(p *pipeline) bool {
+				w := httptest.NewRecorder()
+				sendArchive(w, httptest.NewRequest(http.MethodGet, "/", nil), p, func(aw ArchiveWriter) error {
+					return p.run(query, aw)
+				})
+				return w.Code == http.StatusOK
+			},
+		},
+		{
+			name: "job",
+			deliver: func(p *pipeline) bool {
+				j := newJob("owner", testFilter, p)
+				j.execute()
+				j.cleanup()
+				return j.status().State == jobSucceeded
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			syncStates = newSyncStore("")
+			if err := syncStates.set("test@mail.com", query, 100); err != nil {
+				t.Fatalf("set() unexpected error: %v", err)
+			}
+
+			failed := newSyncPipeline(&mockHistory{historyID: 120, added: []string{"41ff9", "fgb"}})
+			failed.sink = &mockSink{err: errors.New("sink unavailable")}
+			if tt.deliver(failed) {
+				t.Fatalf("delivered an archive to a failing sink")
+			}
+			if id, _ := syncStates.get("test@mail.com", query); id != 100 {
+				t.Errorf("saved history ID %v after a failed delivery, want %v", id, 100)
+			}
+
+			// The next sync starts from the same point, and scrapes the
+			// messages that were never delivered again.
+			history := &mockHistory{historyID: 130, added: []string{"41ff9", "fgb"}}
+			next := newSyncPipeline(history)
+			next.sink = &mockSink{}
+			if !tt.deliver(next) {
+				t.Fatalf("failed to deliver the archive")
+			}
+			if !reflect.DeepEqual(history.starts, []uint64{100}) || next.attachments != 2 {
+				t.Errorf("next sync listed history from %v and saved %v attachments, want [100] and 2", history.starts, next.attachments)
+			}
+			if id, _ := syncStates.get("test@mail.com", query); id != 130 {
+				t.Errorf("saved history ID %v, want %v", id, 130)
+			}
+		})
+	}
+}
+
+func Test_GetJobArchive_shouldMoveTheSyncOnOnceTheArchiveIsDownloaded(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	syncStates = newSyncStore("")
+	query := testFilter.query()
+	if err := syncStates.set("test@mail.com", query, 100); err != nil {
+		t.Fatalf("set() unexpected error: %v", err)
+	}
+
+	j := newJob("owner", testFilter, newSyncPipeline(&mockHistory{historyID: 120, added: []string{"41ff9"}}))
+	jobs.mu.Lock()
+	jobs.jobs[j.id] = j
+	jobs.mu.Unlock()
+	j.execute()
+	defer j.cleanup()
+	if j.status().State != jobSucceeded {
+		t.Fatalf("execute() state = %v, want %v", j.status().State, jobSucceeded)
+	}
+	if id, _ := syncStates.get("test@mail.com", query); id != 100 {
+		t.Errorf("execute() saved history ID %v before the archive was downloaded, want %v", id, 100)
+	}
+
+	download := func(rangeHeader string) int {
+		r := httptest.NewRequest(http.MethodGet, "/jobs/"+j.id+"/archive", nil)
+		r.Header.Add("Authorization", "Bearer "+newTestJwtToken(t, "owner"))
+		if len(rangeHeader) != 0 {
+			r.Header.Set("Range", rangeHeader)
+		}
+		r = mux.SetURLVars(r, map[string]string{"id": j.id})
+		w := httptest.NewRecorder()
+		GetJobArchive(w, r)
+		return w.Code
+	}
+
+	if code := download("bytes=0-9"); code != http.StatusPartialContent {
+		t.Fatalf("GetJobArchive() of a range = %v, want %v", code, http.StatusPartialContent)
+	}
+	if id, _ := syncStates.get("test@mail.com", query); id != 100 {
+		t.Errorf("GetJobArchive() saved history ID %v after a partial download, want %v", id, 100)
+	}
+	if code := download(""); code != http.StatusOK {
+		t.Fatalf("GetJobArchive() = %v, want %v", code, http.StatusOK)
+	}
+	if id, _ := syncStates.get("test@mail.com", query); id != 120 {
+		t.Errorf("GetJobArchive() saved history ID %v, want %v", id, 120)
+	}
+}
+
+func Test_sendArchive_shouldMoveTheSyncOnOnceTheArchiveIsServed(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	syncStates = newSyncStore("")
+	p := newSyncPipeline(&mockHistory{historyID: 100})
+	w := httptest.NewRecorder()
+
+	sendArchive(w, httptest.NewRequest(http.MethodGet, "/", nil), p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("sendArchive() = %v, want %v", w.Code, http.StatusOK)
+	}
+	if id, _ := syncStates.get("test@mail.com", "from:test@mail.com"); id != 100 {
+		t.Errorf("sendArchive() saved history ID %v, want %v", id, 100)
+	}
+}
+
+func Test_syncStore_shouldPersistStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sync-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sync.json")
+
+	s := newSyncStore(path)
+	if err := s.set("a@mail.com", "from:b@mail.com", 42); err != nil {
+		t.Fatalf("set() unexpected error: %v", err)
+	}
+	if err := s.set("b@mail.com", "from:b@mail.com", 7); err != nil {
+		t.Fatalf("set() unexpected error: %v", err)
+	}
+
+	reloaded := newSyncStore(path)
+	tests := []struct {
+		user   string
+		query  string
+		want   uint64
+		wantOk bool
+	}{
+		{user: "a@mail.com", query: "from:b@mail.com", want: 42, wantOk: true},
+		{user: "b@mail.com", query: "from:b@mail.com", want: 7, wantOk: true},
+		{user: "a@mail.com", query: "from:c@mail.com"},
+	}
+	for _, tt := range tests {
+		got, ok := reloaded.get(tt.user, tt.query)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("get(%v, %v) = %v, %v, want %v, %v", tt.user, tt.query, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func Test_streamArchive_shouldReportTheSync(t *testing.T) {
+	defer func(s *syncStore) { syncStates = s }(syncStates)
+	syncStates = newSyncStore("")
+	p := newSyncPipeline(&mockHistory{historyID: 100})
+	w := httptest.NewRecorder()
+
+	streamArchive(w, p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if got := w.Header().Get(syncModeHeader); got != syncFull {
+		t.Errorf("streamArchive() %v = %v, want %v", syncModeHeader, got, syncFull)
+	}
+	if got := w.Header().Get(historyIDHeader); got != "100" {
+		t.Errorf("streamArchive() %v = %v, want %v", historyIDHeader, got, "100")
+	}
+}
+
+func Test_writeFileAtomic_shouldReplaceTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomic-test")
+	if err != nil {
+		t.Fatalf("unable to create a directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	for _, content := range []string{"first", "second"} {
+		if err := writeFileAtomic(path, []byte(content)); err != nil {
+			t.Fatalf("writeFileAtomic() unexpected error: %v", err)
+		}
+	}
+
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "second" {
+		t.Errorf("writeFileAtomic() wrote %q, %v, want %q", b, err, "second")
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("writeFileAtomic() left %v files behind, want 1", len(files))
+	}
+}
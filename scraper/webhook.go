@@ -0,0 +1,273 @@
+package scraper
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Headers of a webhook delivery. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the secret
+// the webhook was registered with.
+const (
+	webhookSecretHeader    = "X-Webhook-Secret"
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+)
+
+// minWebhookSecretLength is the shortest secret accepted to sign webhooks.
+const minWebhookSecretLength = 16
+
+// Events sent to webhooks.
+const (
+	eventJobSucceeded = "job.succeeded"
+	eventJobFailed    = "job.failed"
+)
+
+// webhookClient only connects to public addresses, so webhooks can't be
+// used to reach the server itself or its private network.
+var webhookClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: refusePrivateAddresses,
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// privateNetworks are the ranges webhooks can't be delivered to, besides
+// the loopback, link-local, multicast and unspecified addresses.
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "172.16.0.0/12", "192.168.0.0/16",
+	"198.18.0.0/15", "fc00::/7",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks[i] = n
+	}
+	return networks
+}
+
+// isPublicIP reports whether ip may be reached by a webhook.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// refusePrivateAddresses is a net.Dialer Control refusing to connect to
+// addresses that aren't public. It runs on the address the host was
+// resolved to, so a host can't pass the check and resolve to another address
+// later.
+func refusePrivateAddresses(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+		return &privateAddressError{host: host}
+	}
+	return nil
+}
+
+// privateAddressError is the address of a webhook that isn't public.
+type privateAddressError struct {
+	host string
+}
+
+func (e *privateAddressError) Error() string {
+	return "webhooks can't be delivered to " + e.host
+}
+
+var webhookRetryPolicy = retryPolicy{
+	maxAttempts: envInt("WEBHOOK_MAX_ATTEMPTS", 5),
+	baseDelay:   time.Second,
+	maxDelay:    time.Minute,
+	sleep:       sleepContext,
+	retryable:   isRetryableDelivery,
+}
+
+// webhook is a URL notified when a job finishes.
+type webhook struct {
+	url    string
+	secret []byte
+}
+
+// webhookFromRequest reads the webhook URL of r and the secret its payloads
+// are signed with, sent in the X-Webhook-Secret header only so that it stays
+// out of access logs.
+func webhookFromRequest(r *http.Request) (*webhook, error) {
+	rawURL := r.FormValue("webhook")
+	if len(rawURL) == 0 {
+		return nil, nil
+	}
+	return newWebhook(rawURL, r.Header.Get(webhookSecretHeader))
+}
+
+// newWebhook checks that rawURL is an https URL that isn't obviously
+// private and that secret is long enough. The addresses the host resolves
+// to are checked on delivery.
+func newWebhook(rawURL, secret string) (*webhook, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "https" || len(u.Hostname()) == 0 {
+		return nil, errors.New("webhook must be an https URL")
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); (ip != nil && !isPublicIP(ip)) || host == "localhost" {
+		return nil, errors.New("webhook must be a public URL")
+	}
+
+	if len(secret) < minWebhookSecretLength {
+		return nil, fmt.Errorf("a webhookSecret of at least %d characters is required", minWebhookSecretLength)
+	}
+	return &webhook{url: u.String(), secret: []byte(secret)}, nil
+}
+
+// webhookEvent is the payload sent to a webhook when a job finishes.
+type webhookEvent struct {
+	Event string    `json:"event"`
+	Job   jobStatus `json:"job"`
+	// Archive is where the archive of a succeeded job can be found: a link
+	// to its sink, its directory on the server or the job archive endpoint.
+	Archive  string    `json:"archive,omitempty"`
+	Failures []failure `json:"failures,omitempty"`
+}
+
+// newWebhookEvent describes the outcome of j, once it has finished.
+func newWebhookEvent(j *job) *webhookEvent {
+	e := &webhookEvent{
+		Event:    eventJobFailed,
+		Job:      j.status(),
+		Failures: j.p.failureList(),
+	}
+	if e.Job.State == jobSucceeded {
+		e.Event = eventJobSucceeded
+		switch {
+		case len(e.Job.URL) != 0:
+			e.Archive = e.Job.URL
+		case len(e.Job.Directory) != 0:
+			e.Archive = e.Job.Directory
+		default:
+			e.Archive = "/jobs/" + e.Job.ID + "/archive"
+		}
+	}
+	return e
+}
+
+// sign returns the signature of body sent at timestamp.
+func (h *webhook) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, h.secret)
+	mac.Write([]byte(timestamp + ".")) // nolint
+	mac.Write(body)                    // nolint
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// deliver POSTs e to the webhook, retrying with backoff while the receiver
+// can't be reached or fails with a server error. Every attempt has the same
+// delivery ID so receivers can drop duplicates.
+func (h *webhook) deliver(client *http.Client, policy retryPolicy, e *webhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	delivery := uniuri.NewLen(20)
+
+	return policy.do(context.Background(), func() error {
+		req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(webhookEventHeader, e.Event)
+		req.Header.Set(webhookDeliveryHeader, delivery)
+		req.Header.Set(webhookTimestampHeader, timestamp)
+		req.Header.Set(webhookSignatureHeader, h.sign(timestamp, body))
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096)) // nolint
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode >= 300 {
+			return &deliveryError{code: res.StatusCode}
+		}
+		return nil
+	})
+}
+
+// deliveryError is the status of a webhook receiver that refused an event.
+type deliveryError struct {
+	code int
+}
+
+func (e *deliveryError) Error() string {
+	return "webhook responded with " + strconv.Itoa(e.code) + " " + http.StatusText(e.code)
+}
+
+// isRetryableDelivery reports whether a webhook delivery that failed with
+// err may succeed later: the receiver couldn't be reached, was rate limited
+// or failed with a server error.
+func isRetryableDelivery(err error) bool {
+	if dErr, ok := err.(*deliveryError); ok {
+		return dErr.code == http.StatusTooManyRequests || dErr.code >= 500
+	}
+	var pErr *privateAddressError
+	if errors.As(err, &pErr) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return false
+}
+
+// notify sends the outcome of j to its webhook in the background, once it
+// has finished.
+func (j *job) notify() {
+	h := j.p.webhook
+	if h == nil {
+		return
+	}
+	e := newWebhookEvent(j)
+	go func() {
+		if err := h.deliver(webhookClient, webhookRetryPolicy, e); err != nil {
+			log.Printf("unable to notify the webhook of job %s: %v", e.Job.ID, err)
+		}
+	}()
+}
@@ -0,0 +1,321 @@
+package scraper
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+const testWebhookSecret = "0123456789abcdef"
+
+func Test_webhookFromRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		webhook    string
+		secret     string
+		formSecret string
+		want       *webhook
+		wantErr    bool
+	}{
+		{name: "no webhook"},
+		{
+			name:    "secret header",
+			webhook: "https://hooks.example.com/scrapes",
+			secret:  testWebhookSecret,
+			want:    &webhook{url: "https://hooks.example.com/scrapes", secret: []byte(testWebhookSecret)},
+		},
+		{name: "secret parameter", webhook: "https://hooks.example.com/scrapes", formSecret: testWebhookSecret, wantErr: true},
+		{name: "short secret", webhook: "https://hooks.example.com/scrapes", secret: "secret", wantErr: true},
+		{name: "no secret", webhook: "https://hooks.example.com/scrapes", wantErr: true},
+		{name: "plain http", webhook: "http://hooks.example.com/scrapes", secret: testWebhookSecret, wantErr: true},
+		{name: "not a URL", webhook: "hooks", secret: testWebhookSecret, wantErr: true},
+		{name: "localhost", webhook: "https://localhost:8080/scrapes", secret: testWebhookSecret, wantErr: true},
+		{name: "loopback address", webhook: "https://127.0.0.1/scrapes", secret: testWebhookSecret, wantErr: true},
+		{name: "private address", webhook: "https://10.0.0.1/scrapes", secret: testWebhookSecret, wantErr: true},
+		{name: "link-local address", webhook: "https://[fe80::1]/scrapes", secret: testWebhookSecret, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{}
+			if len(tt.webhook) != 0 {
+				query.Set("webhook", tt.webhook)
+			}
+			if len(tt.formSecret) != 0 {
+				query.Set("webhookSecret", tt.formSecret)
+			}
+			r := httptest.NewRequest(http.MethodPost, "/jobs?"+query.Encode(), nil)
+			if len(tt.secret) != 0 {
+				r.Header.Set(webhookSecretHeader, tt.secret)
+			}
+
+			got, err := webhookFromRequest(r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("webhookFromRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if got != nil {
+					t.Errorf("webhookFromRequest() = %v, want nil", got)
+				}
+				return
+			}
+			if got == nil || got.url != tt.want.url || string(got.secret) != string(tt.want.secret) {
+				t.Errorf("webhookFromRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// webhookDelivery is a request received by a test webhook receiver.
+type webhookDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// newWebhookReceiver starts a receiver responding with statuses in turn, and
+// then with 204.
+func newWebhookReceiver(statuses ...int) (*httptest.Server, <-chan webhookDelivery) {
+	var mu sync.Mutex
+	deliveries := make(chan webhookDelivery, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		deliveries <- webhookDelivery{header: r.Header, body: body}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if len(statuses) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	return server, deliveries
+}
+
+func verifySignature(t *testing.T, d webhookDelivery) {
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(d.header.Get(webhookTimestampHeader) + "."))
+	mac.Write(d.body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := d.header.Get(webhookSignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("delivery signature = %v, want %v", got, want)
+	}
+}
+
+func Test_webhook_deliver_shouldRetryWithBackoff(t *testing.T) {
+	server, deliveries := newWebhookReceiver(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	defer server.Close()
+
+	var delays []time.Duration
+	policy := webhookRetryPolicy
+	policy.maxAttempts = 5
+	policy.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+
+	h := &webhook{url: server.URL, secret: []byte(testWebhookSecret)}
+	e := &webhookEvent{Event: eventJobSucceeded, Job: jobStatus{ID: "job"}}
+	if err := h.deliver(server.Client(), policy, e); err != nil {
+		t.Fatalf("deliver() unexpected error: %v", err)
+	}
+
+	if len(delays) != 2 {
+		t.Errorf("deliver() waited %v times, want %v", len(delays), 2)
+	}
+	var ids []string
+	for i := 0; i < 3; i++ {
+		d := <-deliveries
+		verifySignature(t, d)
+		ids = append(ids, d.header.Get(webhookDeliveryHeader))
+		if event := d.header.Get(webhookEventHeader); event != eventJobSucceeded {
+			t.Errorf("delivery event = %v, want %v", event, eventJobSucceeded)
+		}
+	}
+	if ids[0] == "" || ids[0] != ids[1] || ids[1] != ids[2] {
+		t.Errorf("delivery IDs = %v, want the same ID for every attempt", ids)
+	}
+}
+
+func Test_webhook_deliver_shouldNotRetryRefusedEvents(t *testing.T) {
+	server, _ := newWebhookReceiver(http.StatusBadRequest)
+	defer server.Close()
+
+	attempts := 0
+	policy := webhookRetryPolicy
+	policy.sleep = func(context.Context, time.Duration) error {
+		attempts++
+		return nil
+	}
+
+	h := &webhook{url: server.URL, secret: []byte(testWebhookSecret)}
+	err := h.deliver(server.Client(), policy, &webhookEvent{Event: eventJobFailed})
+	if err == nil || !strings.Contains(err.Error(), "400") {
+		t.Errorf("deliver() error = %v, want the status of the receiver", err)
+	}
+	if attempts != 0 {
+		t.Errorf("deliver() retried %v times, want %v", attempts, 0)
+	}
+}
+
+func Test_isPublicIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "93.184.216.34", want: true},
+		{ip: "2606:2800:220:1::1", want: true},
+		{ip: "127.0.0.1"},
+		{ip: "::1"},
+		{ip: "10.1.2.3"},
+		{ip: "172.20.0.1"},
+		{ip: "192.168.1.1"},
+		{ip: "100.64.0.1"},
+		{ip: "169.254.169.254"},
+		{ip: "fe80::1"},
+		{ip: "fd00::1"},
+		{ip: "0.0.0.0"},
+		{ip: "::ffff:127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("isPublicIP(%v) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func Test_webhook_deliver_shouldRefusePrivateAddresses(t *testing.T) {
+	server, deliveries := newWebhookReceiver(http.StatusOK)
+	defer server.Close()
+
+	attempts := 0
+	policy := webhookRetryPolicy
+	policy.sleep = func(context.Context, time.Duration) error {
+		attempts++
+		return nil
+	}
+
+	// The receiver listens on the loopback address.
+	h := &webhook{url: server.URL, secret: []byte(testWebhookSecret)}
+	err := h.deliver(webhookClient, policy, &webhookEvent{Event: eventJobFailed})
+	if err == nil || !strings.Contains(err.Error(), "can't be delivered") {
+		t.Errorf("deliver() error = %v, want the address to be refused", err)
+	}
+	if attempts != 0 || len(deliveries) != 0 {
+		t.Errorf("deliver() retried %v times and delivered %v events, want none", attempts, len(deliveries))
+	}
+}
+
+func Test_isRetryableDelivery(t *testing.T) {
+	_, err := http.Get("http://127.0.0.1:1")
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "unreachable", err: err, want: true},
+		{name: "server error", err: &deliveryError{code: 502}, want: true},
+		{name: "rate limited", err: &deliveryError{code: 429}, want: true},
+		{name: "not found", err: &deliveryError{code: 404}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableDelivery(tt.err); got != tt.want {
+				t.Errorf("isRetryableDelivery(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_job_execute_shouldNotifyTheWebhook(t *testing.T) {
+	server, deliveries := newWebhookReceiver()
+	defer server.Close()
+	defer func(c *http.Client) { webhookClient = c }(webhookClient)
+	webhookClient = server.Client()
+
+	tests := []struct {
+		name        string
+		p           *pipeline
+		wantEvent   string
+		wantArchive bool
+	}{
+		{
+			name: "succeeded",
+			p: &pipeline{
+				service: new(gmail.Service),
+				ms:      &mockMessage{},
+				cont:    &mockMessageContentWithAttachment{},
+				as:      &mockAttachmentWithPermanentError{},
+				onError: skipOnError,
+			},
+			wantEvent:   eventJobSucceeded,
+			wantArchive: true,
+		},
+		{
+			name:      "failed",
+			p:         newTestPipeline(&mockMessageWithFetchMessagesError{}),
+			wantEvent: eventJobFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.p.webhook = &webhook{url: server.URL, secret: []byte(testWebhookSecret)}
+			j := newJob("owner", testFilter, tt.p)
+			j.execute()
+			defer j.cleanup()
+
+			var d webhookDelivery
+			select {
+			case d = <-deliveries:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("execute() didn't notify the webhook")
+			}
+			verifySignature(t, d)
+
+			var e webhookEvent
+			if err := json.Unmarshal(d.body, &e); err != nil {
+				t.Fatalf("execute() sent invalid JSON: %v", err)
+			}
+			if e.Event != tt.wantEvent || e.Job.ID != j.id {
+				t.Errorf("execute() sent %v for job %v, want %v for job %v", e.Event, e.Job.ID, tt.wantEvent, j.id)
+			}
+			if (len(e.Archive) != 0) != tt.wantArchive {
+				t.Errorf("execute() archive = %q, wantArchive %v", e.Archive, tt.wantArchive)
+			}
+			if tt.wantArchive && (e.Job.Attachments != 4 || len(e.Failures) != 1) {
+				t.Errorf("execute() sent %v attachments and %v failures, want %v and %v",
+					e.Job.Attachments, len(e.Failures), 4, 1)
+			}
+			if !tt.wantArchive && len(e.Job.Error) == 0 {
+				t.Errorf("execute() expected the error of the job")
+			}
+		})
+	}
+}
+
+func Test_sendArchive_shouldRejectWebhooks(t *testing.T) {
+	p := newTestPipeline(&mockMessage{})
+	p.webhook = &webhook{url: "https://hooks.example.com", secret: []byte(testWebhookSecret)}
+	w := httptest.NewRecorder()
+
+	sendArchive(w, httptest.NewRequest(http.MethodGet, "/", nil), p, func(aw ArchiveWriter) error {
+		return p.run("from:test@mail.com", aw)
+	})
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("sendArchive() = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}